@@ -37,6 +37,12 @@ var (
 	nodeID     = flag.String("nodeid", "", "node id")
 	vgName     = flag.String("vgname", "k8s", "volume group name")
 	kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+	mode       = flag.String("mode", lvm.ModeAll, "CSI services to run: controller, node or all")
+	namespace  = flag.String("namespace", "default", "namespace to keep driver state such as pending deletions in")
+
+	nodeGonePolicy   = flag.String("node-gone-policy", "drop", "what to do with pending deletions of a deleted node: drop or keep")
+	metricsAddress   = flag.String("metrics-address", "", "address to serve prometheus metrics on, e.g. :9153, disabled if empty")
+	migrationAddress = flag.String("migration-address", "", "address to serve volumes migrating to other nodes on, e.g. :9154, disabled if empty")
 )
 
 func main() {
@@ -61,7 +67,17 @@ func handle() {
 	}
 
 	driver := lvm.GetLVMDriver(clientset)
-	driver.Run(*driverName, *nodeID, *endpoint, *vgName)
+	driver.Run(&lvm.Options{
+		DriverName:       *driverName,
+		NodeID:           *nodeID,
+		Endpoint:         *endpoint,
+		VGName:           *vgName,
+		Namespace:        *namespace,
+		NodeGonePolicy:   *nodeGonePolicy,
+		Mode:             *mode,
+		MetricsAddress:   *metricsAddress,
+		MigrationAddress: *migrationAddress,
+	})
 }
 
 func buildConfig(kubeconfig string) (*rest.Config, error) {
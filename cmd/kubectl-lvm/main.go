@@ -0,0 +1,221 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-lvm inspects and administers the volumes of the driver. Installed
+// on the PATH, it runs as "kubectl lvm".
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvm"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const usage = `Usage: kubectl lvm [flags] <command> [args]
+
+Commands:
+  volumes                     list the volumes with PVC, node, VG, size and health
+  nodes                       show the VG usage of each node
+  drift                       report mismatches between PVs and LVs
+  remove --node <node> <lv>   remove an LV through the lvmd of a node
+  tag --node <node> <lv> [+tag|-tag]...
+                              add (+) or remove (-) tags of an LV
+
+Flags:
+`
+
+var (
+	driverName = flag.String("drivername", "csi-lvmplugin", "name of the driver")
+	vgName     = flag.String("vgname", "k8s", "volume group name")
+	kubeconfig = flag.String("kubeconfig", "", "path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = *kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		fail(err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		fail(err)
+	}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "volumes":
+		err = listVolumes(client)
+	case "nodes":
+		err = listNodes(client)
+	case "drift":
+		err = listDrift(client)
+	case "remove":
+		err = removeLV(client, args)
+	case "tag":
+		err = tagLV(client, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
+
+func formatBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+}
+
+func listVolumes(client kubernetes.Interface) error {
+	volumes, err := lvm.ListVolumes(client, *driverName, *vgName)
+	if err != nil {
+		return err
+	}
+	w := newTable()
+	fmt.Fprintln(w, "VOLUME\tCLAIM\tNODE\tVG\tLV\tREQUESTED\tACTUAL\tHEALTH")
+	for _, v := range volumes {
+		actual := "<none>"
+		if v.Actual > 0 {
+			actual = formatBytes(v.Actual)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", v.Name, orNone(v.Claim), orNone(v.Node),
+			v.VGName, v.LVName, formatBytes(v.Requested), actual, v.Health)
+	}
+	return w.Flush()
+}
+
+func listNodes(client kubernetes.Interface) error {
+	usages, err := lvm.GetNodeUsage(client, *vgName)
+	if err != nil {
+		return err
+	}
+	w := newTable()
+	fmt.Fprintln(w, "NODE\tVG\tSIZE\tFREE\tUSED\tLVS\tERROR")
+	for _, u := range usages {
+		if u.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\t%s\n", u.Node, u.VGName, u.Error)
+			continue
+		}
+		used := "0%"
+		if u.Size > 0 {
+			used = strconv.FormatInt((u.Size-u.Free)*100/u.Size, 10) + "%"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t\n", u.Node, u.VGName, formatBytes(u.Size), formatBytes(u.Free), used, u.Volumes)
+	}
+	return w.Flush()
+}
+
+func listDrift(client kubernetes.Interface) error {
+	drifts, err := lvm.FindDrift(client, *driverName, *vgName)
+	if err != nil {
+		return err
+	}
+	if len(drifts) == 0 {
+		fmt.Println("No drift found.")
+		return nil
+	}
+	w := newTable()
+	fmt.Fprintln(w, "NODE\tVG\tLV\tVOLUME\tREASON\tMESSAGE")
+	for _, d := range drifts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Node, d.VGName, orNone(d.LVName), orNone(d.Volume), d.Reason, d.Message)
+	}
+	return w.Flush()
+}
+
+// parseLVArgs parses the flags of the remove and tag commands and returns
+// the node, the LV and the remaining arguments.
+func parseLVArgs(command string, args []string, force *bool) (string, string, []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	node := flags.String("node", "", "node of the LV")
+	if force != nil {
+		flags.BoolVar(force, "force", false, "remove the LV even if a PV uses it")
+	}
+	flags.Parse(args)
+	if *node == "" || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "%s needs --node and an LV name\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+	return *node, flags.Arg(0), flags.Args()[1:]
+}
+
+func removeLV(client kubernetes.Interface, args []string) error {
+	var force bool
+	node, lvName, _ := parseLVArgs("remove", args, &force)
+	if err := lvm.RemoveLV(client, *driverName, node, *vgName, lvName, force); err != nil {
+		return err
+	}
+	fmt.Printf("LV %s/%s removed from node %s\n", *vgName, lvName, node)
+	return nil
+}
+
+func tagLV(client kubernetes.Interface, args []string) error {
+	node, lvName, tags := parseLVArgs("tag", args, nil)
+	var add, remove []string
+	for _, tag := range tags {
+		switch {
+		case len(tag) > 1 && tag[0] == '+':
+			add = append(add, tag[1:])
+		case len(tag) > 1 && tag[0] == '-':
+			remove = append(remove, tag[1:])
+		default:
+			return fmt.Errorf("tag %q must start with + to add or - to remove it", tag)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return fmt.Errorf("no tag given")
+	}
+	if err := lvm.TagLV(client, node, *vgName, lvName, add, remove); err != nil {
+		return err
+	}
+	fmt.Printf("LV %s/%s on node %s tagged\n", *vgName, lvName, node)
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvm"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+var (
+	address    = flag.String("address", ":8443", "address to serve the webhook on")
+	certFile   = flag.String("tls-cert-file", "", "file with the TLS certificate of the webhook")
+	keyFile    = flag.String("tls-key-file", "", "file with the TLS key of the webhook")
+	driverName = flag.String("drivername", "csi-lvmplugin", "name of the driver")
+	vgName     = flag.String("vgname", "k8s", "volume group name")
+	kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *certFile == "" || *keyFile == "" {
+		glog.Error("--tls-cert-file and --tls-key-file are required, the API server only calls webhooks over HTTPS")
+		os.Exit(2)
+	}
+
+	config, err := buildConfig(*kubeconfig)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	webhook := lvm.NewAdmissionWebhook(clientset, *driverName, *vgName)
+	glog.Infof("Serving admission webhook on %s", *address)
+	if err := http.ListenAndServeTLS(*address, *certFile, *keyFile, webhook.Handler()); err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func buildConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
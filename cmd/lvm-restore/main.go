@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvm"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+var (
+	driverName = flag.String("drivername", "csi-lvmplugin", "name of the driver")
+	node       = flag.String("node", "", "node the trashed volume is on")
+	vgName     = flag.String("vgname", "k8s", "volume group name")
+	volumeId   = flag.String("volume", "", "id of the trashed volume, i.e. the name of its former pv")
+	claim      = flag.String("claim", "", "namespace/name of the pvc to reserve the restored pv for")
+	kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *node == "" || *volumeId == "" {
+		fmt.Fprintln(os.Stderr, "--node and --volume are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	pv, err := lvm.RestoreVolume(clientset, *driverName, *node, *vgName, *volumeId, *claim)
+	if err != nil {
+		glog.Error(err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("persistentvolume/%s restored on node %s\n", pv.GetName(), *node)
+}
@@ -0,0 +1,29 @@
+#!/bin/bash
+#
+# Creates a CA and the serving certificate of the LVM admission webhook,
+# stores them in the secret lvm-admission-webhook-tls and creates the
+# webhook with the CA bundle filled in.
+
+set -e
+
+cd `dirname $0`
+
+NAMESPACE=${NAMESPACE:-default}
+SERVICE=lvm-admission-webhook
+DIR=`mktemp -d`
+trap "rm -rf $DIR" EXIT
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=lvm-admission-webhook-ca" \
+    -keyout $DIR/ca.key -out $DIR/ca.crt
+openssl req -newkey rsa:2048 -nodes -subj "/CN=$SERVICE.$NAMESPACE.svc" \
+    -keyout $DIR/tls.key -out $DIR/tls.csr
+echo "subjectAltName=DNS:$SERVICE,DNS:$SERVICE.$NAMESPACE,DNS:$SERVICE.$NAMESPACE.svc" > $DIR/ext.cnf
+openssl x509 -req -days 3650 -in $DIR/tls.csr -CA $DIR/ca.crt -CAkey $DIR/ca.key -CAcreateserial \
+    -extfile $DIR/ext.cnf -out $DIR/tls.crt
+
+kubectl -n $NAMESPACE create secret tls $SERVICE-tls --cert=$DIR/tls.crt --key=$DIR/tls.key \
+    --dry-run -o yaml | kubectl -n $NAMESPACE apply -f -
+
+CA_BUNDLE=`base64 < $DIR/ca.crt | tr -d '\n'`
+sed -e "s|\${CA_BUNDLE}|$CA_BUNDLE|" -e "s|namespace: default|namespace: $NAMESPACE|" webhook.yaml | \
+    kubectl -n $NAMESPACE apply -f -
@@ -0,0 +1,434 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+// Administration of the volumes of the driver for cmd/kubectl-lvm. These
+// functions query the lvmd of each node directly.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	VolumeHealthOK         = "OK"
+	VolumeHealthMissing    = "Missing"
+	VolumeHealthNotCreated = "NotCreated"
+	VolumeHealthUnknown    = "Unknown"
+
+	DriftLVMissing    = "LVMissing"
+	DriftSizeMismatch = "SizeMismatch"
+	DriftNodeGone     = "NodeGone"
+	DriftNoPV         = "NoPV"
+	DriftUnreachable  = "NodeUnreachable"
+)
+
+// VolumeInfo describes the PV of a volume and its LV.
+type VolumeInfo struct {
+	Name string
+	// Claim is the namespace/name of the PVC, if bound.
+	Claim  string
+	Node   string
+	VGName string
+	LVName string
+	// Requested is the size requested by the PVC, or the capacity of the
+	// PV without one, Actual the size of the LV.
+	Requested int64
+	Actual    int64
+	// Health is the reason of an abnormal condition of the LV, or one of
+	// the VolumeHealth values.
+	Health string
+}
+
+// NodeUsage is the usage of a VG of a node.
+type NodeUsage struct {
+	Node    string
+	VGName  string
+	Size    int64
+	Free    int64
+	Volumes int
+	// Error is set if the lvmd of the node could not be queried.
+	Error string
+}
+
+// Drift is a mismatch between the PVs of the driver and the LVs of the
+// nodes.
+type Drift struct {
+	Node    string
+	VGName  string
+	LVName  string
+	Volume  string
+	Reason  string
+	Message string
+}
+
+// volumeLister lists the LVs of the nodes, connecting to each lvmd once.
+type volumeLister struct {
+	client kubernetes.Interface
+	lvs    map[string][]*lvmdproto.LogicalVolume
+	errs   map[string]error
+}
+
+func newVolumeLister(client kubernetes.Interface) *volumeLister {
+	return &volumeLister{
+		client: client,
+		lvs:    map[string][]*lvmdproto.LogicalVolume{},
+		errs:   map[string]error{},
+	}
+}
+
+func (l *volumeLister) list(node, vgName string) ([]*lvmdproto.LogicalVolume, error) {
+	key := node + "/" + vgName
+	if lvs, found := l.lvs[key]; found {
+		return lvs, l.errs[key]
+	}
+	var lvs []*lvmdproto.LogicalVolume
+	conn, err := connectLVMD(l.client, node)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		lvs, err = conn.ListLV(ctx, vgName)
+		cancel()
+		conn.Close()
+	}
+	l.lvs[key], l.errs[key] = lvs, err
+	return lvs, err
+}
+
+func (l *volumeLister) get(node, vgName, lvName string) (*lvmdproto.LogicalVolume, error) {
+	lvs, err := l.list(node, vgName)
+	if err != nil {
+		return nil, err
+	}
+	for _, lv := range lvs {
+		if lv.GetName() == lvName {
+			return lv, nil
+		}
+	}
+	return nil, nil
+}
+
+// listDriverPVs returns the PVs of the driver by name.
+func listDriverPVs(client kubernetes.Interface, driverName string) ([]v1.PersistentVolume, error) {
+	list, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pvs []v1.PersistentVolume
+	for _, pv := range list.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+			pvs = append(pvs, pv)
+		}
+	}
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].Name < pvs[j].Name })
+	return pvs, nil
+}
+
+// getVolumeLV returns the VG and LV of pv, which differ from the default
+// VG and the name of the PV for imported LVs.
+func getVolumeLV(pv *v1.PersistentVolume, vgName string) (string, string) {
+	lvName := pv.Name
+	if name := getVolumeAttribute(pv, lvNameKey); name != "" {
+		lvName = name
+		if vg := getVolumeAttribute(pv, vgNameKey); vg != "" {
+			vgName = vg
+		}
+	}
+	return vgName, lvName
+}
+
+// listLVMDNodes returns the names of the nodes running the node plugin,
+// which publishes an LVMNode for its node, so that other nodes are not
+// dialed in vain. Without the LVMNode resource, all nodes are returned.
+func listLVMDNodes(client kubernetes.Interface) ([]string, error) {
+	var names []string
+	lvmNodes, err := ListLVMNodes(client)
+	if apierrors.IsNotFound(err) {
+		nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes.Items {
+			names = append(names, node.Name)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	for _, node := range lvmNodes {
+		names = append(names, node.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListVolumes lists the PVs of the driver with their LVs.
+func ListVolumes(client kubernetes.Interface, driverName, vgName string) ([]VolumeInfo, error) {
+	pvs, err := listDriverPVs(client, driverName)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := client.CoreV1().PersistentVolumeClaims("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	requests := map[string]int64{}
+	for _, pvc := range claims.Items {
+		request := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		requests[string(pvc.UID)] = request.Value()
+	}
+
+	lister := newVolumeLister(client)
+	var volumes []VolumeInfo
+	for i := range pvs {
+		pv := &pvs[i]
+		info := VolumeInfo{
+			Name: pv.Name,
+			Node: pv.Annotations[lvmNodeAnnKey],
+		}
+		info.VGName, info.LVName = getVolumeLV(pv, vgName)
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		info.Requested = capacity.Value()
+		if claim := pv.Spec.ClaimRef; claim != nil {
+			info.Claim = claim.Namespace + "/" + claim.Name
+			if request, found := requests[string(claim.UID)]; found {
+				info.Requested = request
+			}
+		}
+		if info.Node == "" {
+			info.Health = VolumeHealthNotCreated
+			volumes = append(volumes, info)
+			continue
+		}
+		switch lv, err := lister.get(info.Node, info.VGName, info.LVName); {
+		case err != nil:
+			info.Health = VolumeHealthUnknown
+		case lv == nil:
+			info.Health = VolumeHealthMissing
+		default:
+			info.Actual = int64(lv.GetSize())
+			info.Health = VolumeHealthOK
+			if condition := getVolumeCondition(lv, nil); condition != nil {
+				info.Health = condition.reason
+			}
+		}
+		volumes = append(volumes, info)
+	}
+	return volumes, nil
+}
+
+// GetNodeUsage returns the usage of vgName on each node, or of all VGs if
+// vgName is empty.
+func GetNodeUsage(client kubernetes.Interface, vgName string) ([]NodeUsage, error) {
+	nodes, err := listLVMDNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	var usages []NodeUsage
+	for _, node := range nodes {
+		conn, err := connectLVMD(client, node)
+		if err != nil {
+			usages = append(usages, NodeUsage{Node: node, VGName: vgName, Error: err.Error()})
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		vgs, err := conn.ListVG(ctx)
+		if err != nil {
+			cancel()
+			conn.Close()
+			usages = append(usages, NodeUsage{Node: node, VGName: vgName, Error: err.Error()})
+			continue
+		}
+		for _, vg := range vgs {
+			if vgName != "" && vg.GetName() != vgName {
+				continue
+			}
+			usage := NodeUsage{
+				Node:   node,
+				VGName: vg.GetName(),
+				Size:   int64(vg.GetSize()),
+				Free:   int64(vg.GetFreeSize()),
+			}
+			if lvs, err := conn.ListLV(ctx, vg.GetName()); err == nil {
+				usage.Volumes = len(lvs)
+			}
+			usages = append(usages, usage)
+		}
+		cancel()
+		conn.Close()
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Node != usages[j].Node {
+			return usages[i].Node < usages[j].Node
+		}
+		return usages[i].VGName < usages[j].VGName
+	})
+	return usages, nil
+}
+
+// FindDrift compares the PVs of the driver with the LVs of vgName on the
+// nodes running the node plugin and the nodes of the PVs. It reports PVs
+// whose node is gone or whose LV is missing or smaller than the PV, and
+// LVs without PV. LVs which have no PV on purpose, such as trashed,
+// ephemeral or cache volumes, the leftovers of migrations and pools, are
+// not reported.
+func FindDrift(client kubernetes.Interface, driverName, vgName string) ([]Drift, error) {
+	pvs, err := listDriverPVs(client, driverName)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := listLVMDNodes(client)
+	if err != nil {
+		return nil, err
+	}
+	lister := newVolumeLister(client)
+	var drifts []Drift
+	claimed := map[string]bool{}
+	checked := map[string]bool{}
+	for _, node := range nodes {
+		checked[node] = true
+	}
+	for i := range pvs {
+		pv := &pvs[i]
+		node := pv.Annotations[lvmNodeAnnKey]
+		if node == "" {
+			continue
+		}
+		vg, lvName := getVolumeLV(pv, vgName)
+		claimed[node+"/"+vg+"/"+lvName] = true
+		drift := Drift{Node: node, VGName: vg, LVName: lvName, Volume: pv.Name}
+		if _, err := getNode(client, node); apierrors.IsNotFound(err) {
+			drift.Reason = DriftNodeGone
+			drift.Message = fmt.Sprintf("node %s no longer exists", node)
+			drifts = append(drifts, drift)
+			continue
+		}
+		if !checked[node] {
+			checked[node] = true
+			nodes = append(nodes, node)
+		}
+		lv, err := lister.get(node, vg, lvName)
+		if err != nil {
+			// reported below for all LVs of the node
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		switch {
+		case lv == nil:
+			drift.Reason = DriftLVMissing
+			drift.Message = fmt.Sprintf("LV %s/%s not found on %s", vg, lvName, node)
+		case int64(lv.GetSize()) < capacity.Value():
+			drift.Reason = DriftSizeMismatch
+			drift.Message = fmt.Sprintf("LV has %d bytes, PV %d", lv.GetSize(), capacity.Value())
+		default:
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		lvs, err := lister.list(node, vgName)
+		if err != nil {
+			drifts = append(drifts, Drift{Node: node, VGName: vgName, Reason: DriftUnreachable, Message: err.Error()})
+			continue
+		}
+		for _, lv := range lvs {
+			if claimed[node+"/"+vgName+"/"+lv.GetName()] || !isVolumeLV(lv) {
+				continue
+			}
+			drifts = append(drifts, Drift{
+				Node:    node,
+				VGName:  vgName,
+				LVName:  lv.GetName(),
+				Reason:  DriftNoPV,
+				Message: fmt.Sprintf("no PV of %s uses this LV", driverName),
+			})
+		}
+	}
+	return drifts, nil
+}
+
+// isVolumeLV reports whether lv is expected to have a PV.
+func isVolumeLV(lv *lvmdproto.LogicalVolume) bool {
+	switch lv.GetAttributes().GetType() {
+	case lvmdproto.LogicalVolume_Attributes_THIN_POOL,
+		lvmdproto.LogicalVolume_Attributes_THIN_POOL_DATA,
+		lvmdproto.LogicalVolume_Attributes_RAID_OR_THIN_POOL_METADATA:
+		return false
+	}
+	tags := lv.GetTags()
+	if hasTag(tags, ephemeralTag) || getTagValue(tags, trashedTagPrefix) != "" || getTagValue(tags, migrationTagPrefix) != "" {
+		return false
+	}
+	name := lv.GetName()
+	return !strings.HasSuffix(name, cacheLVSuffix) && !strings.HasSuffix(name, migrationSnapshotSuffix)
+}
+
+// RemoveLV removes an LV through the lvmd of node. It refuses to remove
+// the LV of a PV of the driver unless force is set.
+func RemoveLV(client kubernetes.Interface, driverName, node, vgName, lvName string, force bool) error {
+	if !force {
+		pvs, err := listDriverPVs(client, driverName)
+		if err != nil {
+			return err
+		}
+		for i := range pvs {
+			pv := &pvs[i]
+			vg, lv := getVolumeLV(pv, vgName)
+			if pv.Annotations[lvmNodeAnnKey] == node && vg == vgName && lv == lvName {
+				return fmt.Errorf("LV %s/%s is used by pv %s, delete the pv instead", vgName, lvName, pv.Name)
+			}
+		}
+	}
+	conn, err := connectLVMD(client, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.RemoveLV(context.Background(), vgName, lvName)
+}
+
+// TagLV adds and removes tags of an LV through the lvmd of node.
+func TagLV(client kubernetes.Interface, node, vgName, lvName string, add, remove []string) error {
+	for _, tag := range append(append([]string{}, add...), remove...) {
+		if !lvmTagRegexp.MatchString(tag) {
+			return fmt.Errorf("invalid LVM tag %q", tag)
+		}
+	}
+	conn, err := connectLVMD(client, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if len(add) > 0 {
+		if err := conn.AddTagLV(ctx, vgName, lvName, add); err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		return conn.RemoveTagLV(ctx, vgName, lvName, remove)
+	}
+	return nil
+}
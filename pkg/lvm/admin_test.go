@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"testing"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func adminLV(name string, size int64, tags ...string) *lvmdproto.LogicalVolume {
+	return &lvmdproto.LogicalVolume{
+		Name:       name,
+		Size:       uint64(size),
+		Tags:       tags,
+		Attributes: &lvmdproto.LogicalVolume_Attributes{},
+	}
+}
+
+func TestIsVolumeLV(t *testing.T) {
+	pool := adminLV("pool", gib(10))
+	pool.Attributes.Type = lvmdproto.LogicalVolume_Attributes_THIN_POOL
+	tests := []struct {
+		name     string
+		lv       *lvmdproto.LogicalVolume
+		expected bool
+	}{
+		{"volume", adminLV("pvc-1", gib(1)), true},
+		{"no attributes", &lvmdproto.LogicalVolume{Name: "pvc-1"}, true},
+		{"thin pool", pool, false},
+		{"ephemeral", adminLV("csi-1", gib(1), ephemeralTag), false},
+		{"trashed", adminLV("pvc-1", gib(1), trashedTagPrefix+"1"), false},
+		{"migration target", adminLV("pvc-1", gib(1), migrationTagPrefix+"m"), false},
+		{"cache", adminLV("pvc-1"+cacheLVSuffix, gib(1)), false},
+		{"migration snapshot", adminLV("pvc-1"+migrationSnapshotSuffix, gib(1)), false},
+	}
+	for _, test := range tests {
+		if result := isVolumeLV(test.lv); result != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestListLVMDNodes(t *testing.T) {
+	client, server := newFakeClient(t, lvmdNode("node-1"), lvmdNode("node-2"))
+	server.add(lvmNodesPath+"/node-2", &LVMNode{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}})
+	nodes, err := listLVMDNodes(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"node-2"}; !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected %v, got %v", expected, nodes)
+	}
+}
+
+func TestGetNodeUsage(t *testing.T) {
+	fake := newFakeLVMD(t)
+	fake.vgs = []*lvmdproto.VolumeGroup{
+		{Name: "k8s", Size: uint64(gib(100)), FreeSize: uint64(gib(70))},
+		{Name: "other", Size: uint64(gib(10)), FreeSize: uint64(gib(10))},
+	}
+	fake.addLV("k8s", adminLV("pvc-1", gib(30)))
+	// node-3 has no address and no LVMNode, it must not be dialed at all
+	client, server := newFakeClient(t, lvmdNode("node-1"), &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}})
+	for _, name := range []string{"node-1", "node-2"} {
+		server.add(lvmNodesPath+"/"+name, &LVMNode{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+
+	usages, err := GetNodeUsage(client, "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("expected the usage of node-1 and node-2, got %+v", usages)
+	}
+	expected := NodeUsage{Node: "node-1", VGName: "k8s", Size: gib(100), Free: gib(70), Volumes: 1}
+	if usages[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, usages[0])
+	}
+	if usages[1].Node != "node-2" || usages[1].Error == "" {
+		t.Errorf("expected an error for node-2 without address, got %+v", usages[1])
+	}
+}
+
+func TestFindDrift(t *testing.T) {
+	fake := newFakeLVMD(t)
+	pool := adminLV("pool", gib(50))
+	pool.Attributes.Type = lvmdproto.LogicalVolume_Attributes_THIN_POOL
+	for _, lv := range []*lvmdproto.LogicalVolume{
+		adminLV("pvc-ok", gib(1)),
+		adminLV("pvc-small", gib(1)),
+		adminLV("orphan", gib(1)),
+		adminLV("pvc-trashed", gib(1), trashedTagPrefix+"1"),
+		pool,
+	} {
+		fake.addLV("k8s", lv)
+	}
+	client, server := newFakeClient(t,
+		lvmdNode("node-1"),
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+		demandPV("pvc-ok", "node-1", "1Gi"),
+		demandPV("pvc-small", "node-1", "2Gi"),
+		demandPV("pvc-missing", "node-1", "1Gi"),
+		demandPV("pvc-gone", "node-4", "1Gi"),
+	)
+	for _, name := range []string{"node-1", "node-2"} {
+		server.add(lvmNodesPath+"/"+name, &LVMNode{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+
+	drifts, err := FindDrift(client, "csi-lvmplugin", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]string{}
+	for _, drift := range drifts {
+		reasons[drift.Node+"/"+drift.LVName] = drift.Reason
+	}
+	expected := map[string]string{
+		"node-1/pvc-small":   DriftSizeMismatch,
+		"node-1/pvc-missing": DriftLVMissing,
+		"node-4/pvc-gone":    DriftNodeGone,
+		"node-1/orphan":      DriftNoPV,
+		// node-2 runs the plugin but cannot be reached, node-3 does
+		// not run it and is left alone
+		"node-2/": DriftUnreachable,
+	}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("expected %v, got %v", expected, reasons)
+	}
+}
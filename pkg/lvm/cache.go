@@ -0,0 +1,246 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	// StorageClass parameters of cached volumes. The data LV is allocated
+	// from dataPVs, the cache LV of cacheSize from cachePVs. Both take
+	// comma separated devices or PV tags as @tag.
+	cacheTypeKey = "cacheType"
+	cacheSizeKey = "cacheSize"
+	cacheModeKey = "cacheMode"
+	cachePVsKey  = "cachePVs"
+	dataPVsKey   = "dataPVs"
+
+	cacheTypeCache      = "cache"
+	cacheTypeWritecache = "writecache"
+
+	cacheModeWritethrough = "writethrough"
+	cacheModeWriteback    = "writeback"
+
+	// cacheTagPrefix marks cached LVs with their cache type,
+	// uncacheTag asks the node to detach the cache before removal.
+	cacheTagPrefix = "csi-lvm.cache="
+	uncacheTag     = "csi-lvm.uncache"
+
+	cacheLVSuffix = "_cache"
+)
+
+type cacheOptions struct {
+	cacheType string
+	size      uint64
+	mode      string
+	cachePVs  []string
+	dataPVs   []string
+}
+
+// getCacheOptions returns the cache options of a volume, or nil if it is
+// not cached.
+func getCacheOptions(attributes map[string]string) (*cacheOptions, error) {
+	o := &cacheOptions{
+		cacheType: attributes[cacheTypeKey],
+		mode:      attributes[cacheModeKey],
+		cachePVs:  splitList(attributes[cachePVsKey]),
+		dataPVs:   splitList(attributes[dataPVsKey]),
+	}
+	switch o.cacheType {
+	case "":
+		return nil, nil
+	case cacheTypeCache:
+		if o.mode == "" {
+			o.mode = cacheModeWritethrough
+		}
+		if o.mode != cacheModeWritethrough && o.mode != cacheModeWriteback {
+			return nil, fmt.Errorf("invalid %s %q", cacheModeKey, o.mode)
+		}
+	case cacheTypeWritecache:
+		if o.mode != "" && o.mode != cacheModeWriteback {
+			return nil, fmt.Errorf("%s %s only supports %s %s", cacheTypeKey, cacheTypeWritecache, cacheModeKey, cacheModeWriteback)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s %q", cacheTypeKey, o.cacheType)
+	}
+	size, err := resource.ParseQuantity(attributes[cacheSizeKey])
+	if err != nil || size.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid %s %q", cacheSizeKey, attributes[cacheSizeKey])
+	}
+	o.size = uint64(size.Value())
+	if len(o.cachePVs) == 0 {
+		return nil, fmt.Errorf("%s needs %s", cacheTypeKey, cachePVsKey)
+	}
+	return o, nil
+}
+
+// checkCachePlacement returns an error if the cache options of a volume
+// choose its data physical volumes while its placement does too.
+func checkCachePlacement(o *cacheOptions, p *placement) error {
+	if o == nil || len(o.dataPVs) == 0 {
+		return nil
+	}
+	if len(p.pvTags) > 0 {
+		return fmt.Errorf("%s cannot be combined with %s", dataPVsKey, pvTagsKey)
+	}
+	if p.group != "" {
+		return fmt.Errorf("%s cannot be combined with %s", dataPVsKey, antiAffinityGroupKey)
+	}
+	return nil
+}
+
+// createCachedVolume creates the data LV on the slow and its cache LV on
+// the fast physical volumes, then attaches the cache to the data LV.
+func createCachedVolume(vgName, lvName string, size uint64, tags []string, o *cacheOptions) error {
+	cacheName := lvName + cacheLVSuffix
+	// lvconvert cannot tag, the data LV is tagged cached from the start
+	// and removed if attaching the cache fails.
+	dataTags := append(append([]string{}, tags...), cacheTagPrefix+o.cacheType)
+	if err := lvCreate(&lvmd.LVMOptions{VolumeGroup: vgName, Name: lvName, Size: size, Tags: dataTags, PVs: o.dataPVs}); err != nil {
+		return err
+	}
+	if err := lvCreate(&lvmd.LVMOptions{VolumeGroup: vgName, Name: cacheName, Size: o.size, PVs: o.cachePVs}); err != nil {
+		if err := lvRemove(vgName, lvName); err != nil {
+			glog.Errorf("Failed to clean up %s/%s: %v", vgName, lvName, err)
+		}
+		return err
+	}
+	args := []string{"-y", "--type", o.cacheType, "--cachevol", fmt.Sprintf("%s/%s", vgName, cacheName)}
+	if o.cacheType == cacheTypeCache {
+		args = append(args, "--cachemode", o.mode)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", vgName, lvName))
+	if _, err := runLVM("lvconvert", args...); err != nil {
+		for _, name := range []string{cacheName, lvName} {
+			if err := lvRemove(vgName, name); err != nil {
+				glog.Errorf("Failed to clean up %s/%s: %v", vgName, name, err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// uncacheVolume flushes the cache of an LV and detaches and removes it.
+func uncacheVolume(vgName, lvName string) error {
+	_, err := runLVM("lvconvert", "-y", "--uncache", fmt.Sprintf("%s/%s", vgName, lvName))
+	return err
+}
+
+// requestUncache asks the node hosting lv to detach its cache. It returns
+// true once the LV has no cache and may be removed.
+func requestUncache(ctx context.Context, conn lvmd.LVMConnection, vgName string, lv *lvmdproto.LogicalVolume) (bool, error) {
+	if getTagValue(lv.GetTags(), cacheTagPrefix) == "" {
+		return true, nil
+	}
+	if !hasTag(lv.GetTags(), uncacheTag) {
+		glog.V(3).Infof("requesting uncache of %s/%s", vgName, lv.GetName())
+		if err := conn.AddTagLV(ctx, vgName, lv.GetName(), []string{uncacheTag}); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// uncacheVolumes detaches the caches of the LVs of the node for which
+// DeleteVolume asked to.
+func (ns *nodeServer) uncacheVolumes() {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("uncacheVolumes: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lvs, err := conn.ListLV(ctx, ns.vgName)
+	if err != nil {
+		glog.Errorf("uncacheVolumes: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	for _, lv := range lvs {
+		cacheType := getTagValue(lv.GetTags(), cacheTagPrefix)
+		if cacheType == "" || !hasTag(lv.GetTags(), uncacheTag) {
+			continue
+		}
+		glog.Infof("Detaching %s of %s/%s", cacheType, ns.vgName, lv.GetName())
+		if err := uncacheVolume(ns.vgName, lv.GetName()); err != nil {
+			glog.Errorf("uncacheVolumes: %v", err)
+			continue
+		}
+		if err := conn.RemoveTagLV(ctx, ns.vgName, lv.GetName(), []string{cacheTagPrefix + cacheType, uncacheTag}); err != nil {
+			glog.Errorf("uncacheVolumes: failed to untag %s/%s: %v", ns.vgName, lv.GetName(), err)
+		}
+	}
+}
+
+// cacheCollector exports the statistics of the dm-cache LVs of the node.
+type cacheCollector struct {
+	vgName string
+}
+
+var (
+	cacheStats = []struct {
+		field string
+		desc  *prometheus.Desc
+	}{
+		{"cache_read_hits", prometheus.NewDesc("csi_lvm_cache_read_hits_total", "Reads served by the cache of the volume.", []string{"vg", "lv"}, nil)},
+		{"cache_read_misses", prometheus.NewDesc("csi_lvm_cache_read_misses_total", "Reads not served by the cache of the volume.", []string{"vg", "lv"}, nil)},
+		{"cache_write_hits", prometheus.NewDesc("csi_lvm_cache_write_hits_total", "Writes served by the cache of the volume.", []string{"vg", "lv"}, nil)},
+		{"cache_write_misses", prometheus.NewDesc("csi_lvm_cache_write_misses_total", "Writes not served by the cache of the volume.", []string{"vg", "lv"}, nil)},
+	}
+	cacheDirtyBlocksDesc = prometheus.NewDesc("csi_lvm_cache_dirty_blocks", "Blocks of the cache of the volume not written back yet.", []string{"vg", "lv"}, nil)
+)
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, stat := range cacheStats {
+		ch <- stat.desc
+	}
+	ch <- cacheDirtyBlocksDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	lvs, err := lvsReport(c.vgName, "lv_name", "lv_tags", "cache_read_hits", "cache_read_misses",
+		"cache_write_hits", "cache_write_misses", "cache_dirty_blocks")
+	if err != nil {
+		glog.Errorf("Failed to collect cache statistics: %v", err)
+		return
+	}
+	for _, lv := range lvs {
+		if lv["cache_read_hits"] == "" {
+			continue
+		}
+		for _, stat := range cacheStats {
+			if value, err := strconv.ParseFloat(lv[stat.field], 64); err == nil {
+				ch <- prometheus.MustNewConstMetric(stat.desc, prometheus.CounterValue, value, c.vgName, lv["lv_name"])
+			}
+		}
+		if value, err := strconv.ParseFloat(lv["cache_dirty_blocks"], 64); err == nil {
+			ch <- prometheus.MustNewConstMetric(cacheDirtyBlocksDesc, prometheus.GaugeValue, value, c.vgName, lv["lv_name"])
+		}
+	}
+}
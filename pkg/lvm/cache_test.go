@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetCacheOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		expected   *cacheOptions
+		fail       bool
+	}{
+		{
+			name:       "not cached",
+			attributes: map[string]string{cacheSizeKey: "1Gi"},
+		},
+		{
+			name:       "cache defaults to writethrough",
+			attributes: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "1Gi", cachePVsKey: "/dev/nvme0n1"},
+			expected:   &cacheOptions{cacheType: "cache", size: 1 << 30, mode: "writethrough", cachePVs: []string{"/dev/nvme0n1"}},
+		},
+		{
+			name: "writeback cache on tagged PVs",
+			attributes: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "512Mi", cacheModeKey: "writeback",
+				cachePVsKey: "@ssd", dataPVsKey: "@hdd, /dev/sdc"},
+			expected: &cacheOptions{cacheType: "cache", size: 512 << 20, mode: "writeback",
+				cachePVs: []string{"@ssd"}, dataPVs: []string{"@hdd", "/dev/sdc"}},
+		},
+		{
+			name:       "writecache",
+			attributes: map[string]string{cacheTypeKey: "writecache", cacheSizeKey: "1G", cachePVsKey: "@ssd"},
+			expected:   &cacheOptions{cacheType: "writecache", size: 1000000000, cachePVs: []string{"@ssd"}},
+		},
+		{
+			name:       "writecache is writeback only",
+			attributes: map[string]string{cacheTypeKey: "writecache", cacheSizeKey: "1Gi", cacheModeKey: "writethrough", cachePVsKey: "@ssd"},
+			fail:       true,
+		},
+		{
+			name:       "invalid cache type",
+			attributes: map[string]string{cacheTypeKey: "dm-cache", cacheSizeKey: "1Gi", cachePVsKey: "@ssd"},
+			fail:       true,
+		},
+		{
+			name:       "invalid cache mode",
+			attributes: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "1Gi", cacheModeKey: "writearound", cachePVsKey: "@ssd"},
+			fail:       true,
+		},
+		{
+			name:       "missing size",
+			attributes: map[string]string{cacheTypeKey: "cache", cachePVsKey: "@ssd"},
+			fail:       true,
+		},
+		{
+			name:       "negative size",
+			attributes: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "-1Gi", cachePVsKey: "@ssd"},
+			fail:       true,
+		},
+		{
+			name:       "missing cache PVs",
+			attributes: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "1Gi"},
+			fail:       true,
+		},
+	}
+	for _, test := range tests {
+		o, err := getCacheOptions(test.attributes)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, o)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(o, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, o)
+		}
+	}
+}
+
+func TestCheckCachePlacement(t *testing.T) {
+	onHDD := &cacheOptions{cacheType: "cache", dataPVs: []string{"@hdd"}}
+	tests := []struct {
+		name      string
+		cache     *cacheOptions
+		placement *placement
+		fail      bool
+	}{
+		{"not cached", nil, &placement{pvTags: []string{"fast"}}, false},
+		{"data PVs chosen by placement", &cacheOptions{cacheType: "cache"}, &placement{group: "db"}, false},
+		{"data PVs without placement", onHDD, &placement{}, false},
+		{"data PVs and PV tags", onHDD, &placement{pvTags: []string{"fast"}}, true},
+		{"data PVs and anti-affinity group", onHDD, &placement{group: "db"}, true},
+	}
+	for _, test := range tests {
+		if err := checkCachePlacement(test.cache, test.placement); (err != nil) != test.fail {
+			t.Errorf("%s: checkCachePlacement = %v, want failure %v", test.name, err, test.fail)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	minSizeKey         = "minSize"
+	maxSizeKey         = "maxSize"
+	sizeGranularityKey = "sizeGranularity"
+
+	// defaultExtentSize is the extent size vgcreate uses by default,
+	// assumed until the LVMNodes report the actual one.
+	defaultExtentSize = 4 * 1024 * 1024
+)
+
+// sizeOptions are the limits of the sizes of the volumes of a
+// StorageClass, 0 means no limit.
+type sizeOptions struct {
+	min         int64
+	max         int64
+	granularity int64
+}
+
+func getSizeOptions(attributes map[string]string) (*sizeOptions, error) {
+	o := &sizeOptions{}
+	for _, field := range []struct {
+		key   string
+		value *int64
+	}{{minSizeKey, &o.min}, {maxSizeKey, &o.max}, {sizeGranularityKey, &o.granularity}} {
+		if attributes[field.key] == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(attributes[field.key])
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", field.key, attributes[field.key])
+		}
+		*field.value = quantity.Value()
+	}
+	if o.max > 0 && o.min > o.max {
+		return nil, fmt.Errorf("%s %s is larger than %s %s", minSizeKey, attributes[minSizeKey], maxSizeKey, attributes[maxSizeKey])
+	}
+	return o, nil
+}
+
+// volumeSize returns the size of a volume for the capacity range between
+// required and limit bytes: at least the minimum size, rounded up to the
+// granularity and then to the extent size of the VG, as LVM would do. A
+// decimal granularity such as 1G is thus only approximated, rounding to a
+// common multiple of both could give huge volumes.
+func (o *sizeOptions) volumeSize(required, limit, extentSize int64) (int64, error) {
+	size := required
+	if size < o.min {
+		size = o.min
+	}
+	if size <= 0 {
+		size = 1
+	}
+	if o.granularity > 0 {
+		size = roundUp(size, o.granularity)
+	}
+	size = roundUp(size, extentSize)
+	if o.max > 0 && size > o.max {
+		return 0, fmt.Errorf("volume size %s exceeds %s %s", formatSize(size), maxSizeKey, formatSize(o.max))
+	}
+	if limit > 0 && size > limit {
+		return 0, fmt.Errorf("volume size %s rounded up to the granularity and the extent size %s exceeds the limit of %s", formatSize(size), formatSize(extentSize), formatSize(limit))
+	}
+	return size, nil
+}
+
+func roundUp(size, multiple int64) int64 {
+	return (size + multiple - 1) / multiple * multiple
+}
+
+func formatSize(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+// getExtentSizeOfNodes returns the largest extent size of vgName reported
+// by the LVMNodes, so that rounded sizes fit the VG of every node.
+func getExtentSizeOfNodes(client kubernetes.Interface, vgName string) int64 {
+	nodes, err := ListLVMNodes(client)
+	if err != nil {
+		glog.Warningf("Failed to list LVMNodes, assuming extent size %s: %v", formatSize(defaultExtentSize), err)
+		return defaultExtentSize
+	}
+	var extentSize int64
+	for _, node := range nodes {
+		for _, vg := range node.Status.VolumeGroups {
+			if vg.Name == vgName && vg.ExtentSize > extentSize {
+				extentSize = vg.ExtentSize
+			}
+		}
+	}
+	if extentSize == 0 {
+		return defaultExtentSize
+	}
+	return extentSize
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVolumeSize(t *testing.T) {
+	const (
+		mi = int64(1) << 20
+		gi = int64(1) << 30
+		g  = int64(1000000000)
+	)
+	tests := []struct {
+		name       string
+		params     map[string]string
+		required   int64
+		limit      int64
+		extentSize int64
+		expected   int64
+		err        string
+	}{
+		{name: "extent multiple", required: gi, extentSize: 4 * mi, expected: gi},
+		{name: "rounded to extent", required: gi + 1, extentSize: 4 * mi, expected: gi + 4*mi},
+		{name: "no size", extentSize: 4 * mi, expected: 4 * mi},
+		{name: "large extents", required: 5 * mi, extentSize: 32 * mi, expected: 32 * mi},
+		{name: "minimum", params: map[string]string{minSizeKey: "10Gi"}, required: gi, extentSize: 4 * mi, expected: 10 * gi},
+		{name: "binary granularity", params: map[string]string{sizeGranularityKey: "1Gi"}, required: gi + 1, extentSize: 4 * mi, expected: 2 * gi},
+		{name: "binary granularity below extent", params: map[string]string{sizeGranularityKey: "1Mi"}, required: 5 * mi, extentSize: 4 * mi, expected: 8 * mi},
+		{name: "decimal granularity", params: map[string]string{sizeGranularityKey: "1G"}, required: gi, extentSize: 4 * mi, expected: 1908 * mi},
+		{name: "decimal granularity multiple", params: map[string]string{sizeGranularityKey: "1G"}, required: g, extentSize: 4 * mi, expected: 956 * mi},
+		{name: "decimal granularity within limit", params: map[string]string{sizeGranularityKey: "1G"}, required: 10 * g, limit: 10 * gi, extentSize: 4 * mi, expected: 9540 * mi},
+		{name: "maximum", params: map[string]string{maxSizeKey: "1Gi"}, required: gi, extentSize: 4 * mi, expected: gi},
+		{name: "above maximum", params: map[string]string{maxSizeKey: "1Gi"}, required: gi + 1, extentSize: 4 * mi, err: "exceeds maxSize"},
+		{name: "granularity above maximum", params: map[string]string{sizeGranularityKey: "1Gi", maxSizeKey: "1536Mi"}, required: gi + 1, extentSize: 4 * mi, err: "exceeds maxSize"},
+		{name: "limit", required: gi, limit: gi, extentSize: 4 * mi, expected: gi},
+		{name: "rounded above limit", required: gi - 1, limit: gi - 1, extentSize: 4 * mi, err: "exceeds the limit"},
+		{name: "minimum above limit", params: map[string]string{minSizeKey: "2Gi"}, required: gi, limit: gi, extentSize: 4 * mi, err: "exceeds the limit"},
+	}
+	for _, test := range tests {
+		o, err := getSizeOptions(test.params)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		size, err := o.volumeSize(test.required, test.limit, test.extentSize)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %d, %v", test.name, test.err, size, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if size != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, size)
+		}
+	}
+}
+
+func TestGetSizeOptions(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		fail   bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{minSizeKey: "1Gi", maxSizeKey: "1Gi", sizeGranularityKey: "1G"}, false},
+		{map[string]string{minSizeKey: "0"}, true},
+		{map[string]string{maxSizeKey: "-1Gi"}, true},
+		{map[string]string{sizeGranularityKey: "1 GB"}, true},
+		{map[string]string{minSizeKey: "2Gi", maxSizeKey: "1Gi"}, true},
+	}
+	for _, test := range tests {
+		if _, err := getSizeOptions(test.params); (err != nil) != test.fail {
+			t.Errorf("%v: getSizeOptions = %v, want failure %v", test.params, err, test.fail)
+		}
+	}
+}
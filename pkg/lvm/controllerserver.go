@@ -23,10 +23,14 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
 )
@@ -38,11 +42,34 @@ const (
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	client kubernetes.Interface
-	vgName string
+	client     kubernetes.Interface
+	recorder   record.EventRecorder
+	driverName string
+	vgName     string
+
+	deletions      *deletionQueue
+	nodeGonePolicy string
+	quotas         *quotaChecker
+	reservations   *reservationLedger
+
+	// elector elects the replica which serves CreateVolume and
+	// DeleteVolume and carries out the background work.
+	elector *leaderElector
+}
+
+// checkLeader refuses requests to replicas which do not lead, the external
+// provisioner next to the leader serves them.
+func (cs *controllerServer) checkLeader() error {
+	if !cs.elector.isLeader() {
+		return status.Errorf(codes.Unavailable, "%s is not the leading controller", cs.elector.identity)
+	}
+	return nil
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := cs.checkLeader(); err != nil {
+		return nil, err
+	}
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		glog.V(3).Infof("invalid create volume req: %v", req)
 		return nil, err
@@ -55,12 +82,37 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
 
+	if err := validateParameters(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// volumes are created in the VG of the driver, vgName only asserts it
+	if vgName := req.GetParameters()[vgNameKey]; vgName != "" && vgName != cs.vgName {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s differs from the VG %s of the driver", vgNameKey, vgName, cs.vgName)
+	}
+
 	volumeId := req.GetName()
 
+	sizes, err := getSizeOptions(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	extentSize := getExtentSizeOfNodes(cs.client, cs.vgName)
+	size, err := sizes.volumeSize(req.GetCapacityRange().GetRequiredBytes(), req.GetCapacityRange().GetLimitBytes(), extentSize)
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	if err := cs.quotas.check(volumeId, req.GetParameters(), size); err != nil {
+		if _, ok := err.(*quotaExceededError); ok {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to check quota of volume %s: %v", volumeId, err)
+	}
+
 	response := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			Id:            volumeId,
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			CapacityBytes: size,
 			Attributes:    req.GetParameters(),
 		},
 	}
@@ -68,32 +120,168 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if err := cs.checkLeader(); err != nil {
+		return nil, err
+	}
 	vid := req.GetVolumeId()
-	node, err := getVolumeNode(cs.client, vid)
+	pv, err := getPV(cs.client, vid)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Failed to getVolumeNode for %v: %v", vid, err))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Failed to get pv for %v: %v", vid, err))
 	}
+	if lvName := getVolumeAttribute(pv, lvNameKey); lvName != "" {
+		glog.Infof("Volume %v imports LV %v, retaining it", vid, lvName)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	protected, err := cs.isVolumeProtected(pv)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to check protection of %v: %v", vid, err)
+	}
+	if protected {
+		cs.recorder.Eventf(pv, v1.EventTypeWarning, reasonDeleteVolumeFailed, "The volume is protected from deletion by the annotation %s", protectedAnnKey)
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %v is protected from deletion", vid)
+	}
+	node := pv.Annotations[lvmNodeAnnKey]
 	if node != "" {
-		addr, err := getLVMDAddr(cs.client, node)
-		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Failed to getLVMDAddr for %v: %v", node, err))
+		d := &pendingDeletion{
+			Node:         node,
+			VGName:       cs.vgName,
+			WipePolicy:   getVolumeAttribute(pv, wipePolicyKey),
+			TrashTTL:     getVolumeAttribute(pv, trashTTLKey),
+			StorageClass: pv.Spec.StorageClassName,
 		}
+		err := cs.removeVolume(ctx, vid, d)
+		if status.Code(err) == codes.Unavailable {
+			// The node is down or gone, remember the LV and let the
+			// PV go, reconcileDeletions removes the LV later on.
+			glog.Warningf("Deferring deletion of %v: %v", vid, err)
+			cs.recorder.Eventf(pv, v1.EventTypeWarning, "DeletionDeferred", "Node %s is unreachable, the LV is removed once it is back: %v", node, err)
+			d.Reason = err.Error()
+			d.Since = time.Now()
+			if err := cs.deletions.add(vid, d); err != nil {
+				return nil, status.Errorf(codes.Internal, "Failed to record pending deletion of %v: %v", vid, err)
+			}
+		} else if err != nil {
+			if status.Code(err) != codes.Aborted {
+				cs.recorder.Event(pv, v1.EventTypeWarning, reasonDeleteVolumeFailed, err.Error())
+			}
+			return nil, err
+		}
+	}
+	response := &csi.DeleteVolumeResponse{}
+	return response, nil
+}
 
-		conn, err := lvmd.NewLVMConnection(addr, connectTimeout)
-		defer conn.Close()
-		if err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to connect to %v: %v", addr, err))
+// removeVolume removes or trashes the LV of a volume on its node. It
+// returns an Unavailable error if the lvmd of the node cannot be reached,
+// and succeeds without removing anything only if lvmd lists the VG
+// without the LV.
+func (cs *controllerServer) removeVolume(ctx context.Context, vid string, d *pendingDeletion) error {
+	node, vgName := d.Node, d.VGName
+
+	addr, err := getLVMDAddr(cs.client, node)
+	if err != nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("Failed to getLVMDAddr for %v: %v", node, err))
+	}
+
+	conn, err := lvmd.NewLVMConnection(addr, connectTimeout)
+	if err != nil {
+		return status.Error(codes.Unavailable, fmt.Sprintf("Failed to connect to %v: %v", addr, err))
+	}
+	defer conn.Close()
+
+	// lvmd fails to list a single volume which does not exist, as for
+	// any other error, so list the VG to tell that the volume is gone.
+	listCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	all, err := conn.ListLV(listCtx, vgName)
+	cancel()
+	if err != nil {
+		if c := status.Code(err); c == codes.Unavailable || c == codes.DeadlineExceeded {
+			return status.Error(codes.Unavailable, fmt.Sprintf("Failed to connect to %v: %v", addr, err))
+		}
+		return status.Errorf(codes.Internal, "Failed to list volumes of %v on node %v: %v", vgName, node, err)
+	}
+	var lvs []*lvmdproto.LogicalVolume
+	for _, lv := range all {
+		if lv.GetName() == vid {
+			lvs = append(lvs, lv)
+		}
+	}
+	if len(lvs) == 0 {
+		return nil
+	}
+	if hasTag(lvs[0].GetTags(), adoptedTag) {
+		glog.Infof("Volume %v has been adopted, retaining it", vid)
+		return nil
+	}
+	if hasTag(lvs[0].GetTags(), lvmd.ProtectedTag) {
+		return status.Errorf(codes.FailedPrecondition, "Volume %v is protected from deletion on node %v", vid, node)
+	}
+
+	if d.TrashTTL != "" {
+		if err := trashVolume(ctx, conn, vgName, lvs[0], d); err != nil {
+			return status.Errorf(codes.Internal, "Failed to trash volume %v: %v", vid, err)
+		}
+		return nil
+	}
+
+	uncached, err := requestUncache(ctx, conn, vgName, lvs[0])
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to request uncache of volume %v: %v", vid, err)
+	}
+	if !uncached {
+		return status.Errorf(codes.Aborted, "Cache of volume %v is being detached on node %v", vid, node)
+	}
+
+	wiped, err := requestWipe(ctx, conn, vgName, lvs[0], d.WipePolicy)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to request wipe of volume %v: %v", vid, err)
+	}
+	if !wiped {
+		return status.Errorf(codes.Aborted, "Volume %v is being wiped on node %v", vid, node)
+	}
+	if err := conn.RemoveLV(ctx, vgName, vid); err != nil {
+		if _, ok := err.(*lvmd.ProtectedError); ok {
+			return status.Error(codes.FailedPrecondition, err.Error())
 		}
+		return status.Errorf(
+			codes.Internal,
+			"Failed to remove volume: err=%v",
+			err)
+	}
+	return nil
+}
 
-		if _, err := conn.GetLV(ctx, cs.vgName, vid); err == nil {
-			if err := conn.RemoveLV(ctx, cs.vgName, vid); err != nil {
-				return nil, status.Errorf(
-					codes.Internal,
-					"Failed to remove volume: err=%v",
-					err)
+// reconcileDeletions retries the deletions which DeleteVolume could not
+// carry out because the node was unreachable.
+func (cs *controllerServer) reconcileDeletions() {
+	pending, err := cs.deletions.list()
+	if err != nil {
+		glog.Errorf("reconcileDeletions: %v", err)
+		return
+	}
+	for vid := range pending {
+		d, err := cs.deletions.claim(vid)
+		if err != nil {
+			glog.Errorf("reconcileDeletions: failed to claim %v: %v", vid, err)
+			continue
+		} else if d == nil {
+			// gone or carried out by another replica
+			continue
+		}
+		if _, err := getNode(cs.client, d.Node); apierrors.IsNotFound(err) {
+			if cs.nodeGonePolicy == NodeGonePolicyKeep {
+				glog.V(3).Infof("reconcileDeletions: node %v of %v is gone, keeping it", d.Node, vid)
+				continue
 			}
+			glog.Warningf("reconcileDeletions: node %v of %v is gone, dropping it", d.Node, vid)
+		} else if err := cs.removeVolume(context.Background(), vid, d); err != nil {
+			glog.V(3).Infof("reconcileDeletions: %v", err)
+			continue
+		} else {
+			glog.Infof("reconcileDeletions: removed %v from node %v", vid, d.Node)
+		}
+		if err := cs.deletions.removeClaimed(vid); err != nil {
+			glog.Errorf("reconcileDeletions: %v", err)
 		}
 	}
-	response := &csi.DeleteVolumeResponse{}
-	return response, nil
 }
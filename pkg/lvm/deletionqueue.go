@@ -0,0 +1,228 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	pendingDeletionsConfigMap  = "csi-lvm-pending-deletions"
+	reconcileDeletionsInterval = time.Minute
+
+	// deletionClaimTTL is how long a replica may carry out a pending
+	// deletion without renewing its claim before another one takes over.
+	deletionClaimTTL = 5 * time.Minute
+
+	NodeGonePolicyDrop = "drop"
+	NodeGonePolicyKeep = "keep"
+)
+
+// pendingDeletion describes how to delete the LV of a volume. Those
+// which DeleteVolume could not carry out because the lvmd of the node was
+// unreachable are kept in the deletionQueue.
+type pendingDeletion struct {
+	Node         string    `json:"node"`
+	VGName       string    `json:"vgName"`
+	WipePolicy   string    `json:"wipePolicy,omitempty"`
+	TrashTTL     string    `json:"trashTTL,omitempty"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Since        time.Time `json:"since"`
+
+	// ClaimedBy is the controller replica carrying out the deletion, it
+	// renews ClaimedAt on every attempt.
+	ClaimedBy string     `json:"claimedBy,omitempty"`
+	ClaimedAt *time.Time `json:"claimedAt,omitempty"`
+}
+
+// deletionQueue stores pending deletions in a ConfigMap keyed by volume
+// id, so that they survive restarts of the driver. Replicas claim a
+// pending deletion before carrying it out, so that only one of them
+// removes the LV at a time.
+type deletionQueue struct {
+	client    kubernetes.Interface
+	namespace string
+	identity  string
+
+	mutex sync.Mutex
+	// observed holds the claims of other replicas by volume id with the
+	// local time they were first seen, claims expire by the local clock
+	// like client-go leases do.
+	observed map[string]claimObservation
+}
+
+type claimObservation struct {
+	claim string
+	at    time.Time
+}
+
+func newDeletionQueue(client kubernetes.Interface, namespace, identity string) *deletionQueue {
+	return &deletionQueue{
+		client:    client,
+		namespace: namespace,
+		identity:  identity,
+		observed:  map[string]claimObservation{},
+	}
+}
+
+func (q *deletionQueue) add(volumeId string, d *pendingDeletion) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := q.getConfigMap()
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[volumeId] = string(data)
+		_, err = q.client.CoreV1().ConfigMaps(q.namespace).Update(cm)
+		return err
+	})
+}
+
+// claim claims the pending deletion of volumeId for this replica and
+// returns it, or nil if it is gone or claimed by another replica.
+func (q *deletionQueue) claim(volumeId string) (*pendingDeletion, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var claimed *pendingDeletion
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		claimed = nil
+		cm, err := q.getConfigMap()
+		if err != nil {
+			return err
+		}
+		data, found := cm.Data[volumeId]
+		if !found {
+			delete(q.observed, volumeId)
+			return nil
+		}
+		d := &pendingDeletion{}
+		if err := json.Unmarshal([]byte(data), d); err != nil {
+			return err
+		}
+		now := time.Now()
+		if d.ClaimedBy != "" && d.ClaimedBy != q.identity && d.ClaimedAt != nil {
+			if !q.claimExpired(volumeId, d.ClaimedBy+"@"+d.ClaimedAt.String(), now) {
+				return nil
+			}
+		}
+		d.ClaimedBy = q.identity
+		d.ClaimedAt = &now
+		updated, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		cm.Data[volumeId] = string(updated)
+		if _, err := q.client.CoreV1().ConfigMaps(q.namespace).Update(cm); err != nil {
+			return err
+		}
+		delete(q.observed, volumeId)
+		claimed = d
+		return nil
+	})
+	return claimed, err
+}
+
+// claimExpired returns whether claim of volumeId has not changed for
+// deletionClaimTTL since this replica first saw it.
+func (q *deletionQueue) claimExpired(volumeId, claim string, now time.Time) bool {
+	o, found := q.observed[volumeId]
+	if !found || o.claim != claim {
+		q.observed[volumeId] = claimObservation{claim: claim, at: now}
+		return false
+	}
+	return now.Sub(o.at) >= deletionClaimTTL
+}
+
+// removeClaimed removes the pending deletion of volumeId if this replica
+// still holds its claim, DeleteVolume may have queued it anew meanwhile.
+func (q *deletionQueue) removeClaimed(volumeId string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := q.getConfigMap()
+		if err != nil {
+			return err
+		}
+		data, found := cm.Data[volumeId]
+		if !found {
+			return nil
+		}
+		d := &pendingDeletion{}
+		if err := json.Unmarshal([]byte(data), d); err != nil {
+			return err
+		}
+		if d.ClaimedBy != q.identity {
+			return nil
+		}
+		delete(cm.Data, volumeId)
+		_, err = q.client.CoreV1().ConfigMaps(q.namespace).Update(cm)
+		return err
+	})
+}
+
+func (q *deletionQueue) list() (map[string]*pendingDeletion, error) {
+	cm, err := q.getConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	pending := map[string]*pendingDeletion{}
+	for volumeId, data := range cm.Data {
+		d := &pendingDeletion{}
+		if err := json.Unmarshal([]byte(data), d); err != nil {
+			return nil, err
+		}
+		pending[volumeId] = d
+	}
+	return pending, nil
+}
+
+func (q *deletionQueue) getConfigMap() (*v1.ConfigMap, error) {
+	return getOrCreateConfigMap(q.client, q.namespace, pendingDeletionsConfigMap)
+}
+
+// getOrCreateConfigMap returns the ConfigMap namespace/name, creating it
+// empty if it does not exist.
+func getOrCreateConfigMap(client kubernetes.Interface, namespace, name string) (*v1.ConfigMap, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return cm, err
+	}
+	cm, err = client.CoreV1().ConfigMaps(namespace).Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	})
+	if apierrors.IsAlreadyExists(err) {
+		return client.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	}
+	return cm, err
+}
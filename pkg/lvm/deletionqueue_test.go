@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClaimExpired(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		claim   string
+		after   time.Duration
+		expired bool
+	}{
+		{"first sight", "a@1", 0, false},
+		{"unchanged within ttl", "a@1", deletionClaimTTL / 2, false},
+		{"unchanged for ttl", "a@1", deletionClaimTTL, true},
+		{"renewed", "a@2", deletionClaimTTL + time.Minute, false},
+		{"renewal within ttl", "a@2", 2 * deletionClaimTTL, false},
+		{"renewal expired", "a@2", 2*deletionClaimTTL + time.Minute, true},
+	}
+	q := newDeletionQueue(nil, "default", "b")
+	for _, test := range tests {
+		if expired := q.claimExpired("pv", test.claim, start.Add(test.after)); expired != test.expired {
+			t.Errorf("%s: claimExpired = %v, want %v", test.name, expired, test.expired)
+		}
+	}
+	if q.claimExpired("other", "a@2", start.Add(3*deletionClaimTTL)) {
+		t.Errorf("claims of other volumes must be observed separately")
+	}
+}
+
+func TestRemoveVolume(t *testing.T) {
+	tests := []struct {
+		name     string
+		present  bool
+		failure  error
+		expected codes.Code
+		removed  bool
+	}{
+		{"present", true, nil, codes.OK, true},
+		{"absent", false, nil, codes.OK, true},
+		{"lvmd unavailable", true, status.Error(codes.Unavailable, "connection refused"), codes.Unavailable, false},
+		{"listing fails", true, errors.New("Volume group \"k8s\" not found"), codes.Internal, false},
+		{"listing fails for an absent volume", false, errors.New("Volume group \"k8s\" not found"), codes.Internal, true},
+	}
+	for _, test := range tests {
+		client, _ := newFakeClient(t, lvmdNode("node-1"))
+		fake := newFakeLVMD(t)
+		fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-2"})
+		if test.present {
+			fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-1"})
+		}
+		if test.failure != nil {
+			fake.failOnce("ListLV", test.failure)
+		}
+		cs := &controllerServer{client: client}
+		err := cs.removeVolume(context.Background(), "pvc-1", &pendingDeletion{Node: "node-1", VGName: "k8s"})
+		if code := status.Code(err); code != test.expected {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.expected, code, err)
+		}
+		if removed := fake.getLV("k8s", "pvc-1") == nil; removed != test.removed {
+			t.Errorf("%s: expected removed %v, got %v", test.name, test.removed, removed)
+		}
+		if fake.getLV("k8s", "pvc-2") == nil {
+			t.Errorf("%s: removed another volume", test.name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	// Inline ephemeral volumes are marked by kubelet with
+	// csiEphemeralKey, or by the pod with ephemeralKey. Their LVs are
+	// created in the VG of the node plugin with the size from sizeKey.
+	csiEphemeralKey = "csi.storage.k8s.io/ephemeral"
+	ephemeralKey    = "ephemeral"
+	sizeKey         = "size"
+
+	ephemeralTag = "csi-lvm.ephemeral"
+	// ephemeralPodTagPrefix records the UID of the pod of an ephemeral
+	// volume, e.g. "csi-lvm.pod=8e3b6f2c-...".
+	ephemeralPodTagPrefix = "csi-lvm.pod="
+	podUIDKey             = "csi.storage.k8s.io/pod.uid"
+
+	// kubeletPodsDir holds a directory per pod of the node, named by its
+	// UID, which contains the target paths of its volumes.
+	kubeletPodsDir = "/var/lib/kubelet/pods"
+)
+
+func isEphemeral(attributes map[string]string) bool {
+	return attributes[csiEphemeralKey] == "true" || attributes[ephemeralKey] == "true"
+}
+
+// getPodUID returns the UID of the pod of a NodePublishVolume call, passed
+// by kubelet or else taken from the target path in its pod directory.
+func getPodUID(attributes map[string]string, targetPath string) string {
+	if uid := attributes[podUIDKey]; uid != "" {
+		return uid
+	}
+	rel, err := filepath.Rel(kubeletPodsDir, targetPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return strings.Split(rel, string(filepath.Separator))[0]
+}
+
+// createEphemeralVolume creates the LV of an inline ephemeral volume of
+// the pod podUID on the local node, there is no PV for it. Its space is
+// reserved like the one of other volumes, but ephemeral volumes are not
+// counted against the quotas of the namespaces, which only cover PVCs.
+func (ns *nodeServer) createEphemeralVolume(ctx context.Context, volumeId, podUID string, attributes map[string]string) error {
+	if attributes[sizeKey] == "" {
+		return status.Errorf(codes.InvalidArgument, "Ephemeral volume %s needs a %s", volumeId, sizeKey)
+	}
+	size, err := resource.ParseQuantity(attributes[sizeKey])
+	if err != nil || size.Sign() <= 0 {
+		return status.Errorf(codes.InvalidArgument, "Invalid %s %q of ephemeral volume %s", sizeKey, attributes[sizeKey], volumeId)
+	}
+
+	tags := append([]string{ephemeralTag}, createWipeTags(attributes[createWipePolicyKey])...)
+	if podUID != "" {
+		tags = append(tags, ephemeralPodTagPrefix+podUID)
+	}
+
+	ns.createMutex.Lock()
+	defer ns.createMutex.Unlock()
+	if err := ns.reserveVolume(ctx, volumeId, size.Value()); err != nil {
+		return err
+	}
+	defer func() {
+		if err := ns.reservations.release(volumeId); err != nil {
+			glog.Warningf("Failed to release the reservation of volume %s: %v", volumeId, err)
+		}
+	}()
+
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return status.Error(lvmdCode(err), err.Error())
+	}
+	defer conn.Close()
+
+	resp, err := conn.CreateLV(ctx, &lvmd.LVMOptions{
+		VolumeGroup: ns.vgName,
+		Name:        volumeId,
+		Size:        uint64(size.Value()),
+		Tags:        tags,
+	})
+	glog.V(3).Infof("CreateLV: %v", resp)
+	if err != nil {
+		return status.Errorf(lvmdCode(err), "Error in CreateLogicalVolume: err=%v", err)
+	}
+	return nil
+}
+
+// removeEphemeralVolume removes the LV of volumeId if it belongs to an
+// inline ephemeral volume.
+func (ns *nodeServer) removeEphemeralVolume(ctx context.Context, volumeId string) error {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", ns.vgName, volumeId))
+	if err != nil || len(lvs) == 0 || !hasTag(lvs[0].GetTags(), ephemeralTag) {
+		// not an ephemeral volume or already removed
+		return nil
+	}
+	glog.Infof("Removing ephemeral volume %s/%s", ns.vgName, volumeId)
+	return conn.RemoveLV(ctx, ns.vgName, volumeId)
+}
+
+// cleanupEphemeralVolumes removes the LVs of ephemeral volumes whose pod
+// is gone, e.g. because the node plugin was down when it went away. It
+// runs before the node plugin serves kubelet.
+func (ns *nodeServer) cleanupEphemeralVolumes() {
+	pods, err := ns.client.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", ns.GetNodeID()).String(),
+	})
+	if err != nil {
+		glog.Errorf("cleanupEphemeralVolumes: failed to list pods: %v", err)
+		return
+	}
+	podUIDs := map[string]bool{}
+	for _, pod := range pods.Items {
+		podUIDs[string(pod.UID)] = true
+	}
+
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("cleanupEphemeralVolumes: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lvs, err := conn.ListLV(ctx, ns.vgName)
+	if err != nil {
+		glog.Errorf("cleanupEphemeralVolumes: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	for _, lv := range lvs {
+		if !hasTag(lv.GetTags(), ephemeralTag) || lv.GetAttributes().GetOpen() {
+			continue
+		}
+		if isEphemeralVolumeInUse(lv.GetTags(), podUIDs, kubeletPodsDir) {
+			glog.V(3).Infof("cleanupEphemeralVolumes: keeping %s/%s, its pod is still there", ns.vgName, lv.GetName())
+			continue
+		}
+		glog.Infof("Removing leftover ephemeral volume %s/%s", ns.vgName, lv.GetName())
+		if err := conn.RemoveLV(ctx, ns.vgName, lv.GetName()); err != nil {
+			glog.Errorf("cleanupEphemeralVolumes: failed to remove %s/%s: %v", ns.vgName, lv.GetName(), err)
+		}
+	}
+}
+
+// isEphemeralVolumeInUse tells whether the ephemeral volume with tags may
+// still be used: its pod is one of podUIDs or still has a directory in
+// podsDir. Volumes without the pod tag are never considered unused.
+func isEphemeralVolumeInUse(tags []string, podUIDs map[string]bool, podsDir string) bool {
+	uid := getTagValue(tags, ephemeralPodTagPrefix)
+	if uid == "" {
+		return true
+	}
+	if podUIDs[uid] {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(podsDir, uid))
+	return !os.IsNotExist(err)
+}
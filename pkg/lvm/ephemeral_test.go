@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPodUID(t *testing.T) {
+	tests := []struct {
+		attributes map[string]string
+		targetPath string
+		expected   string
+	}{
+		{map[string]string{podUIDKey: "uid-1"}, "/var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/scratch/mount", "uid-1"},
+		{nil, "/var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/scratch/mount", "uid-2"},
+		{nil, "/mnt/scratch", ""},
+	}
+	for _, test := range tests {
+		if uid := getPodUID(test.attributes, test.targetPath); uid != test.expected {
+			t.Errorf("%v %s: expected %q, got %q", test.attributes, test.targetPath, test.expected, uid)
+		}
+	}
+}
+
+func TestIsEphemeralVolumeInUse(t *testing.T) {
+	podsDir, err := ioutil.TempDir("", "pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(podsDir)
+	if err := os.Mkdir(filepath.Join(podsDir, "terminating"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	podUIDs := map[string]bool{"running": true}
+
+	tests := []struct {
+		tags     []string
+		expected bool
+	}{
+		{[]string{ephemeralTag, ephemeralPodTagPrefix + "running"}, true},
+		{[]string{ephemeralTag, ephemeralPodTagPrefix + "terminating"}, true},
+		{[]string{ephemeralTag, ephemeralPodTagPrefix + "gone"}, false},
+		{[]string{ephemeralTag}, true},
+	}
+	for _, test := range tests {
+		if inUse := isEphemeralVolumeInUse(test.tags, podUIDs, podsDir); inUse != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.tags, test.expected, inUse)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	schedulerapi "k8s.io/kubernetes/pkg/scheduler/api"
+)
+
+const (
+	// ScorePolicyBinpack prefers the nodes with the least free space
+	// left, ScorePolicySpread those with the most.
+	ScorePolicyBinpack = "binpack"
+	ScorePolicySpread  = "spread"
+)
+
+// SchedulerExtender is an HTTP scheduler extender which filters out the
+// nodes whose VG cannot fit the LVM volumes a pod still needs, and scores
+// the others by their free space.
+type SchedulerExtender struct {
+	client      kubernetes.Interface
+	driverName  string
+	vgName      string
+	scorePolicy string
+	ledger      *reservationLedger
+}
+
+func NewSchedulerExtender(client kubernetes.Interface, driverName, vgName, namespace, scorePolicy string) (*SchedulerExtender, error) {
+	if scorePolicy != ScorePolicyBinpack && scorePolicy != ScorePolicySpread {
+		return nil, fmt.Errorf("invalid score policy %q", scorePolicy)
+	}
+	return &SchedulerExtender{
+		client:      client,
+		driverName:  driverName,
+		vgName:      vgName,
+		scorePolicy: scorePolicy,
+		ledger:      newReservationLedger(client, namespace),
+	}, nil
+}
+
+// Handler returns the handler of the filter and prioritize verbs, to be
+// configured as urlPrefix with filterVerb "filter" and prioritizeVerb
+// "prioritize" in the scheduler policy.
+func (e *SchedulerExtender) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter", e.serveFilter)
+	mux.HandleFunc("/prioritize", e.servePrioritize)
+	return mux
+}
+
+// podDemand is the space a pod needs for the volumes of the driver which
+// have no LV yet, and the size of all its volumes of the driver.
+type podDemand struct {
+	bytes int64
+	total int64
+	// volumes are the ids of the pod's volumes which may already be
+	// reserved, their reservations are not counted against the pod.
+	volumes map[string]bool
+}
+
+func (e *SchedulerExtender) getDemand(pod *v1.Pod) (*podDemand, error) {
+	return getPodDemand(e.client, e.driverName, pod)
+}
+
+// getPodDemand returns the space pod needs for the claims of driverName
+// whose LVs have not been created yet.
+func getPodDemand(client kubernetes.Interface, driverName string, pod *v1.Pod) (*podDemand, error) {
+	demand := &podDemand{volumes: map[string]bool{}}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if pvc.Spec.VolumeName == "" {
+			if pvc.Spec.StorageClassName == nil {
+				continue
+			}
+			sc, err := client.StorageV1().StorageClasses().Get(*pvc.Spec.StorageClassName, metav1.GetOptions{})
+			if err != nil || sc.Provisioner != driverName {
+				continue
+			}
+			request := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+			demand.bytes += request.Value()
+			demand.total += request.Value()
+			continue
+		}
+		pv, err := getPV(client, pvc.Spec.VolumeName)
+		if err != nil {
+			return nil, err
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		demand.total += capacity.Value()
+		if pv.Annotations[lvmNodeAnnKey] != "" || getVolumeAttribute(pv, lvNameKey) != "" {
+			// the LV exists and pins the pod to its node
+			continue
+		}
+		demand.bytes += capacity.Value()
+		demand.volumes[pv.Name] = true
+	}
+	return demand, nil
+}
+
+// nodeSpace is the size of the VG of a node and its free space net of the
+// reservations of other pods.
+type nodeSpace struct {
+	size      int64
+	available int64
+	err       error
+}
+
+func (e *SchedulerExtender) getSpace(nodes []string, demand *podDemand) map[string]*nodeSpace {
+	reservations, err := e.ledger.list()
+	space := map[string]*nodeSpace{}
+	for _, node := range nodes {
+		space[node] = &nodeSpace{err: err}
+	}
+	if err != nil {
+		return space
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node string, s *nodeSpace) {
+			defer wg.Done()
+			s.size, s.available, s.err = e.getVGSpace(node)
+		}(node, space[node])
+	}
+	wg.Wait()
+	for volumeId, r := range reservations {
+		if s, found := space[r.Node]; found && r.VGName == e.vgName && !demand.volumes[volumeId] {
+			s.available -= r.Bytes
+		}
+	}
+	return space
+}
+
+func (e *SchedulerExtender) getVGSpace(node string) (int64, int64, error) {
+	conn, err := connectLVMD(e.client, node)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	vgs, err := conn.ListVG(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, vg := range vgs {
+		if vg.GetName() == e.vgName {
+			return int64(vg.GetSize()), int64(vg.GetFreeSize()), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("volume group %s not found", e.vgName)
+}
+
+func getNodeNames(args *schedulerapi.ExtenderArgs) []string {
+	if args.NodeNames != nil {
+		return *args.NodeNames
+	}
+	var names []string
+	if args.Nodes != nil {
+		for _, node := range args.Nodes.Items {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+func (e *SchedulerExtender) filter(args *schedulerapi.ExtenderArgs) *schedulerapi.ExtenderFilterResult {
+	result := &schedulerapi.ExtenderFilterResult{
+		Nodes:       args.Nodes,
+		NodeNames:   args.NodeNames,
+		FailedNodes: schedulerapi.FailedNodesMap{},
+	}
+	demand, err := e.getDemand(args.Pod)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if demand.bytes == 0 {
+		return result
+	}
+
+	nodes := getNodeNames(args)
+	space := e.getSpace(nodes, demand)
+	fits := map[string]bool{}
+	for _, node := range nodes {
+		s := space[node]
+		switch {
+		case s.err != nil:
+			result.FailedNodes[node] = fmt.Sprintf("LVM capacity unknown: %v", s.err)
+		case s.available < demand.bytes:
+			result.FailedNodes[node] = fmt.Sprintf("LVM volume group %s has %d bytes available, %d needed", e.vgName, s.available, demand.bytes)
+		default:
+			fits[node] = true
+		}
+	}
+
+	if args.NodeNames != nil {
+		names := []string{}
+		for _, node := range *args.NodeNames {
+			if fits[node] {
+				names = append(names, node)
+			}
+		}
+		result.NodeNames = &names
+	}
+	if args.Nodes != nil {
+		list := &v1.NodeList{}
+		for _, node := range args.Nodes.Items {
+			if fits[node.Name] {
+				list.Items = append(list.Items, node)
+			}
+		}
+		result.Nodes = list
+	}
+	return result
+}
+
+func (e *SchedulerExtender) prioritize(args *schedulerapi.ExtenderArgs) schedulerapi.HostPriorityList {
+	nodes := getNodeNames(args)
+	priorities := schedulerapi.HostPriorityList{}
+	demand, err := e.getDemand(args.Pod)
+	if err != nil {
+		glog.Errorf("Failed to get LVM demand of pod %s/%s: %v", args.Pod.Namespace, args.Pod.Name, err)
+	}
+	var space map[string]*nodeSpace
+	if err == nil && demand.bytes > 0 {
+		space = e.getSpace(nodes, demand)
+	}
+	for _, node := range nodes {
+		score := 0
+		if s := space[node]; s != nil && s.err == nil && s.size > 0 {
+			left := s.available - demand.bytes
+			if left < 0 {
+				left = 0
+			}
+			if e.scorePolicy == ScorePolicyBinpack {
+				score = int((s.size - left) * schedulerapi.MaxPriority / s.size)
+			} else {
+				score = int(left * schedulerapi.MaxPriority / s.size)
+			}
+		}
+		priorities = append(priorities, schedulerapi.HostPriority{Host: node, Score: score})
+	}
+	return priorities
+}
+
+func (e *SchedulerExtender) serveFilter(w http.ResponseWriter, r *http.Request) {
+	args := &schedulerapi.ExtenderArgs{}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil || args.Pod == nil {
+		http.Error(w, fmt.Sprintf("invalid extender args: %v", err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, e.filter(args))
+}
+
+func (e *SchedulerExtender) servePrioritize(w http.ResponseWriter, r *http.Request) {
+	args := &schedulerapi.ExtenderArgs{}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil || args.Pod == nil {
+		http.Error(w, fmt.Sprintf("invalid extender args: %v", err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, e.prioritize(args))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	schedulerapi "k8s.io/kubernetes/pkg/scheduler/api"
+)
+
+func gib(n int64) int64 { return n << 30 }
+
+// demandPV returns a PV of the driver of size with its LV on node.
+func demandPV(name, node, size string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{lvmNodeAnnKey: node}},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "csi-lvmplugin", VolumeHandle: name},
+			},
+		},
+	}
+}
+
+// demandClaim returns a PVC of size, bound to volume if set.
+func demandClaim(name, storageClass, volume, size string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClass,
+			VolumeName:       volume,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+// demandPod returns a pod using claims.
+func demandPod(claims ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"}}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name:         "config",
+		VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}},
+	})
+	for _, claim := range claims {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: claim,
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			},
+		})
+	}
+	return pod
+}
+
+// demandObjects are claims of the driver and of another provisioner,
+// unbound and bound to volumes with and without LV.
+func demandObjects() []interface{} {
+	created := demandPV("pvc-created", "node-1", "4Gi")
+	pending := demandPV("pvc-pending", "", "8Gi")
+	pending.Annotations = map[string]string{}
+	foreign := demandPV("pv-foreign", "", "16Gi")
+	foreign.Spec.CSI.Driver = "other"
+	return []interface{}{
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "lvm"}, Provisioner: "csi-lvmplugin"},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "nfs"}, Provisioner: "example.com/nfs"},
+		created, pending, foreign,
+		demandClaim("unbound", "lvm", "", "2Gi"),
+		demandClaim("unbound-nfs", "nfs", "", "32Gi"),
+		demandClaim("created", "lvm", "pvc-created", "4Gi"),
+		demandClaim("pending", "lvm", "pvc-pending", "8Gi"),
+		demandClaim("foreign", "nfs", "pv-foreign", "16Gi"),
+	}
+}
+
+func TestGetPodDemand(t *testing.T) {
+	client, _ := newFakeClient(t, demandObjects()...)
+	tests := []struct {
+		name     string
+		pod      *v1.Pod
+		expected *podDemand
+		failed   bool
+	}{
+		{
+			name:     "no claims",
+			pod:      demandPod(),
+			expected: &podDemand{volumes: map[string]bool{}},
+		},
+		{
+			name:     "unbound claim",
+			pod:      demandPod("unbound"),
+			expected: &podDemand{bytes: gib(2), total: gib(2), volumes: map[string]bool{}},
+		},
+		{
+			name:     "bound without LV",
+			pod:      demandPod("pending"),
+			expected: &podDemand{bytes: gib(8), total: gib(8), volumes: map[string]bool{"pvc-pending": true}},
+		},
+		{
+			name:     "bound with LV",
+			pod:      demandPod("created"),
+			expected: &podDemand{total: gib(4), volumes: map[string]bool{}},
+		},
+		{
+			name:     "other provisioners",
+			pod:      demandPod("unbound-nfs", "foreign"),
+			expected: &podDemand{volumes: map[string]bool{}},
+		},
+		{
+			name:     "all",
+			pod:      demandPod("unbound", "unbound-nfs", "created", "pending", "foreign"),
+			expected: &podDemand{bytes: gib(10), total: gib(14), volumes: map[string]bool{"pvc-pending": true}},
+		},
+		{
+			name:   "missing claim",
+			pod:    demandPod("unbound", "missing"),
+			failed: true,
+		},
+	}
+	for _, test := range tests {
+		demand, err := getPodDemand(client, "csi-lvmplugin", test.pod)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: getPodDemand error = %v, want failure %v", test.name, err, test.failed)
+			continue
+		}
+		if !reflect.DeepEqual(demand, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, demand)
+		}
+	}
+}
+
+// newExtenderTest returns an extender with a VG of 100Gi, 50Gi free, on
+// node-1 and node-2, and node-3 whose lvmd cannot be reached. The pod
+// demand of 10Gi of pvc-pending is reserved on node-1, and 45Gi of
+// another volume on node-2.
+func newExtenderTest(t *testing.T, scorePolicy string) *SchedulerExtender {
+	fake := newFakeLVMD(t)
+	fake.vgs = []*lvmdproto.VolumeGroup{{Name: "k8s", Size: uint64(gib(100)), FreeSize: uint64(gib(50))}}
+	objects := append(demandObjects(),
+		lvmdNode("node-1"),
+		lvmdNode("node-2"),
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+	)
+	client, _ := newFakeClient(t, objects...)
+	e, err := NewSchedulerExtender(client, "csi-lvmplugin", "k8s", "kube-system", scorePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for volumeId, r := range map[string]*reservation{
+		"pvc-pending": {Node: "node-1", VGName: "k8s", Bytes: gib(8)},
+		"pvc-other":   {Node: "node-2", VGName: "k8s", Bytes: gib(45)},
+		"pvc-hdd":     {Node: "node-1", VGName: "hdd", Bytes: gib(100)},
+	} {
+		if err := e.ledger.reserve(volumeId, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+func TestExtenderFilter(t *testing.T) {
+	e := newExtenderTest(t, ScorePolicyBinpack)
+	names := []string{"node-1", "node-2", "node-3"}
+	tests := []struct {
+		name   string
+		pod    *v1.Pod
+		fits   []string
+		failed []string
+	}{
+		{
+			name: "no demand",
+			pod:  demandPod("created", "foreign"),
+			fits: names,
+		},
+		{
+			// the reservation of pvc-pending on node-1 is the pod's own
+			name:   "demand",
+			pod:    demandPod("unbound", "pending"),
+			fits:   []string{"node-1"},
+			failed: []string{"node-2", "node-3"},
+		},
+	}
+	for _, test := range tests {
+		nodeNames := append([]string{}, names...)
+		result := e.filter(&schedulerapi.ExtenderArgs{Pod: test.pod, NodeNames: &nodeNames})
+		if result.Error != "" {
+			t.Errorf("%s: unexpected error %s", test.name, result.Error)
+			continue
+		}
+		if !reflect.DeepEqual(*result.NodeNames, test.fits) {
+			t.Errorf("%s: expected nodes %v, got %v", test.name, test.fits, *result.NodeNames)
+		}
+		var failed []string
+		for node := range result.FailedNodes {
+			failed = append(failed, node)
+		}
+		sort.Strings(failed)
+		if !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("%s: expected failed nodes %v, got %v", test.name, test.failed, result.FailedNodes)
+		}
+	}
+
+	nodes := &v1.NodeList{Items: []v1.Node{*lvmdNode("node-1"), *lvmdNode("node-2")}}
+	result := e.filter(&schedulerapi.ExtenderArgs{Pod: demandPod("unbound", "pending"), Nodes: nodes})
+	if len(result.Nodes.Items) != 1 || result.Nodes.Items[0].Name != "node-1" {
+		t.Errorf("expected node list with node-1, got %+v", result.Nodes.Items)
+	}
+
+	result = e.filter(&schedulerapi.ExtenderArgs{Pod: demandPod("missing"), NodeNames: &names})
+	if result.Error == "" {
+		t.Errorf("expected an error for a missing claim")
+	}
+}
+
+func TestExtenderPrioritize(t *testing.T) {
+	// node-1 has 50Gi available, 40Gi left for the 10Gi of the pod, node-2
+	// 5Gi, less than the pod needs.
+	tests := []struct {
+		scorePolicy string
+		pod         *v1.Pod
+		expected    map[string]int
+	}{
+		{ScorePolicyBinpack, demandPod("unbound", "pending"), map[string]int{"node-1": 6, "node-2": 10, "node-3": 0}},
+		{ScorePolicySpread, demandPod("unbound", "pending"), map[string]int{"node-1": 4, "node-2": 0, "node-3": 0}},
+		{ScorePolicySpread, demandPod("created"), map[string]int{"node-1": 0, "node-2": 0, "node-3": 0}},
+		{ScorePolicySpread, demandPod("missing"), map[string]int{"node-1": 0, "node-2": 0, "node-3": 0}},
+	}
+	for _, test := range tests {
+		e := newExtenderTest(t, test.scorePolicy)
+		names := []string{"node-1", "node-2", "node-3"}
+		scores := map[string]int{}
+		for _, priority := range e.prioritize(&schedulerapi.ExtenderArgs{Pod: test.pod, NodeNames: &names}) {
+			scores[priority.Host] = priority.Score
+		}
+		if !reflect.DeepEqual(scores, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.scorePolicy, test.expected, scores)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// lastFailureAnnKey summarizes the last failure to provision the
+	// volume of a PVC, it is removed once the volume is published.
+	lastFailureAnnKey = "lvm/last-failure"
+
+	// Pod of a NodePublishVolume call, passed by kubelet if the
+	// CSIDriver object asks for pod info on mount.
+	podNameKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey = "csi.storage.k8s.io/pod.namespace"
+
+	// Reasons of failure events.
+	reasonLVMDUnavailable    = "LVMDUnavailable"
+	reasonInsufficientSpace  = "InsufficientSpace"
+	reasonCreateVolumeFailed = "CreateVolumeFailed"
+	reasonFormatFailed       = "FormatFailed"
+	reasonDeleteVolumeFailed = "DeleteVolumeFailed"
+
+	// maxFailureMessage bounds the LVM output kept in the annotation.
+	maxFailureMessage = 1024
+)
+
+// volumeFailure is the value of lastFailureAnnKey, modelled after the
+// conditions of Kubernetes objects.
+type volumeFailure struct {
+	Reason             string      `json:"reason"`
+	Message            string      `json:"message"`
+	Node               string      `json:"node,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// createFailureReason classifies an error of creating an LV.
+func createFailureReason(err error) string {
+	if c := status.Code(err); c == codes.Unavailable || c == codes.DeadlineExceeded {
+		return reasonLVMDUnavailable
+	}
+	if strings.Contains(err.Error(), "Insufficient free") || strings.Contains(err.Error(), "insufficient free") {
+		return reasonInsufficientSpace
+	}
+	return reasonCreateVolumeFailed
+}
+
+// getPodRef returns the pod of a NodePublishVolume call, or nil if kubelet
+// did not pass it.
+func getPodRef(attributes map[string]string) *v1.ObjectReference {
+	if attributes[podNameKey] == "" {
+		return nil
+	}
+	return &v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  attributes[podNamespaceKey],
+		Name:       attributes[podNameKey],
+	}
+}
+
+// reportFailure records a warning event on the PV of volumeId, its PVC and
+// pod, and stores the failure in the annotation of the PVC.
+func reportFailure(client kubernetes.Interface, recorder record.EventRecorder, node, volumeId string, pod *v1.ObjectReference, reason, message string) {
+	if pod != nil {
+		recorder.Event(pod, v1.EventTypeWarning, reason, message)
+	}
+	pv, err := getPV(client, volumeId)
+	if err != nil {
+		return
+	}
+	recorder.Event(pv, v1.EventTypeWarning, reason, message)
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return
+	}
+	recorder.Event(claim, v1.EventTypeWarning, reason, message)
+
+	if len(message) > maxFailureMessage {
+		message = message[:maxFailureMessage]
+	}
+	value, err := json.Marshal(&volumeFailure{
+		Reason:             reason,
+		Message:            message,
+		Node:               node,
+		LastTransitionTime: metav1.Now(),
+	})
+	if err != nil {
+		return
+	}
+	if err := setClaimAnnotation(client, claim, lastFailureAnnKey, string(value)); err != nil {
+		glog.Errorf("Failed to annotate pvc %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+}
+
+// clearFailure removes the failure annotation from the PVC of volumeId.
+func clearFailure(client kubernetes.Interface, volumeId string) {
+	claim := getClaimRef(client, volumeId)
+	if claim == nil {
+		return
+	}
+	if err := setClaimAnnotation(client, claim, lastFailureAnnKey, ""); err != nil {
+		glog.Errorf("Failed to annotate pvc %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+}
+
+// setClaimAnnotation sets or, if value is empty, removes an annotation of
+// a PVC.
+func setClaimAnnotation(client kubernetes.Interface, claim *v1.ObjectReference, key, value string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvc, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current, ok := pvc.Annotations[key]; current == value && (ok || value == "") {
+			return nil
+		}
+		if value == "" {
+			delete(pvc.Annotations, key)
+		} else {
+			if pvc.Annotations == nil {
+				pvc.Annotations = map[string]string{}
+			}
+			pvc.Annotations[key] = value
+		}
+		_, err = client.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(pvc)
+		return err
+	})
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCreateFailureReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"lvmd down", status.Error(codes.Unavailable, "connection refused"), reasonLVMDUnavailable},
+		{"lvmd timeout", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), reasonLVMDUnavailable},
+		{"lvcreate out of space", errors.New(`Volume group "vg" has insufficient free space (10 extents): 256 required.`), reasonInsufficientSpace},
+		{"lvmd out of space", status.Error(codes.Internal, "Insufficient free space: 256 extents needed, but only 10 available"), reasonInsufficientSpace},
+		{"other", status.Error(codes.Internal, "Logical Volume \"pvc-1\" already exists in volume group \"vg\""), reasonCreateVolumeFailed},
+	}
+	for _, test := range tests {
+		if reason := createFailureReason(test.err); reason != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, reason)
+		}
+	}
+}
+
+func TestGetPodRef(t *testing.T) {
+	if ref := getPodRef(map[string]string{}); ref != nil {
+		t.Errorf("expected no pod without %s, got %+v", podNameKey, ref)
+	}
+	expected := &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: "default", Name: "web-0"}
+	ref := getPodRef(map[string]string{podNamespaceKey: "default", podNameKey: "web-0"})
+	if !reflect.DeepEqual(ref, expected) {
+		t.Errorf("expected %+v, got %+v", expected, ref)
+	}
+}
+
+// newCreateVolumeTest returns the node server of node-1 with the PV pvc-1
+// of 1Gi to create, the VG k8s of the fake lvmd has 2Gi free.
+func newCreateVolumeTest(t *testing.T) (*nodeServer, *fakeLVMD) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": "csi-lvmplugin"}},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+		},
+	}
+	client, _ := newFakeClient(t, pv, lvmdNode("node-1"))
+	fake := newFakeLVMD(t)
+	fake.vgs = []*lvmdproto.VolumeGroup{{Name: "k8s", Size: 4 << 30, FreeSize: 2 << 30}}
+	return &nodeServer{
+		client:       client,
+		recorder:     record.NewFakeRecorder(100),
+		nodeID:       "node-1",
+		vgName:       "k8s",
+		reservations: newReservationLedger(client, "kube-system"),
+	}, fake
+}
+
+func TestCreateVolumeFailures(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup          func(*testing.T, *nodeServer, *fakeLVMD)
+		expectedCode   codes.Code
+		expectedReason string
+	}{
+		{
+			name: "lvmd unreachable",
+			setup: func(t *testing.T, ns *nodeServer, fake *fakeLVMD) {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, lvmdPort, _ = net.SplitHostPort(listener.Addr().String())
+				listener.Close()
+			},
+			expectedCode:   codes.Unavailable,
+			expectedReason: reasonLVMDUnavailable,
+		},
+		{
+			name: "lvmd unavailable while creating",
+			setup: func(t *testing.T, ns *nodeServer, fake *fakeLVMD) {
+				fake.failOnce("CreateLV", status.Error(codes.Unavailable, "transport is closing"))
+			},
+			expectedCode:   codes.Unavailable,
+			expectedReason: reasonLVMDUnavailable,
+		},
+		{
+			name: "lvcreate out of space",
+			setup: func(t *testing.T, ns *nodeServer, fake *fakeLVMD) {
+				fake.failOnce("CreateLV", errors.New(`Volume group "k8s" has insufficient free space (10 extents): 256 required.`))
+			},
+			expectedCode:   codes.Internal,
+			expectedReason: reasonInsufficientSpace,
+		},
+		{
+			name: "reserved for other volumes",
+			setup: func(t *testing.T, ns *nodeServer, fake *fakeLVMD) {
+				if err := ns.reservations.reserve("pvc-2", &reservation{Node: "node-1", VGName: "k8s", Bytes: 3 << 29}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedCode:   codes.ResourceExhausted,
+			expectedReason: reasonInsufficientSpace,
+		},
+	}
+	for _, test := range tests {
+		ns, fake := newCreateVolumeTest(t)
+		test.setup(t, ns, fake)
+		_, err := ns.createVolume(context.Background(), "pvc-1")
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.expectedCode, code, err)
+		}
+		if reason := createFailureReason(err); reason != test.expectedReason {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.expectedReason, reason, err)
+		}
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	ns, fake := newCreateVolumeTest(t)
+	pv, err := ns.createVolume(context.Background(), "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Annotations[lvmNodeAnnKey] != "node-1" || pv.Spec.NodeAffinity == nil {
+		t.Errorf("expected pv on node-1, got %v %v", pv.Annotations, pv.Spec.NodeAffinity)
+	}
+	if lv := fake.getLV("k8s", "pvc-1"); lv == nil || lv.Size != 1<<30 {
+		t.Errorf("expected a volume of 1Gi, got %v", lv)
+	}
+	if reserved, err := ns.reservations.reserved("node-1", "k8s"); err != nil || reserved != 0 {
+		t.Errorf("expected the reservation to be released, got %d, %v", reserved, err)
+	}
+}
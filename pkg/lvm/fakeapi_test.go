@@ -0,0 +1,363 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeAPIServer is a minimal in-memory API server. Objects are stored as
+// JSON by their REST path, which is enough for the typed clientset and the
+// raw REST calls the driver makes for its custom resources.
+type fakeAPIServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	objects map[string]map[string]interface{}
+	version int
+}
+
+// collections are the last path segments that name a collection rather
+// than an object.
+var collections = map[string]bool{
+	"persistentvolumes":      true,
+	"persistentvolumeclaims": true,
+	"nodes":                  true,
+	"pods":                   true,
+	"configmaps":             true,
+	"secrets":                true,
+	"events":                 true,
+	"storageclasses":         true,
+	"volumeattachments":      true,
+	"lvmnodes":               true,
+	"lvmvolumemigrations":    true,
+}
+
+// newFakeClient starts a fake API server holding the given objects and
+// returns a clientset talking to it.
+func newFakeClient(t *testing.T, objects ...interface{}) (kubernetes.Interface, *fakeAPIServer) {
+	server := &fakeAPIServer{objects: map[string]map[string]interface{}{}}
+	server.Server = httptest.NewServer(server)
+	t.Cleanup(server.Close)
+	for _, object := range objects {
+		server.add(objectPath(object), object)
+	}
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// objectPath returns the REST path of a typed object.
+func objectPath(object interface{}) string {
+	switch o := object.(type) {
+	case *v1.PersistentVolume:
+		return "/api/v1/persistentvolumes/" + o.Name
+	case *v1.PersistentVolumeClaim:
+		return fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", o.Namespace, o.Name)
+	case *v1.Node:
+		return "/api/v1/nodes/" + o.Name
+	case *v1.Pod:
+		return fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", o.Namespace, o.Name)
+	case *v1.ConfigMap:
+		return fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", o.Namespace, o.Name)
+	case *v1.Secret:
+		return fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", o.Namespace, o.Name)
+	case *storagev1.StorageClass:
+		return "/apis/storage.k8s.io/v1/storageclasses/" + o.Name
+	}
+	panic(fmt.Sprintf("objectPath: unsupported type %T", object))
+}
+
+// add stores an object at the given path.
+func (s *fakeAPIServer) add(path string, object interface{}) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		panic(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		panic(err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store(path, decoded)
+}
+
+// get decodes the object stored at the given path into out and reports
+// whether it exists.
+func (s *fakeAPIServer) get(path string, out interface{}) bool {
+	s.mutex.Lock()
+	object, found := s.objects[path]
+	s.mutex.Unlock()
+	if !found {
+		return false
+	}
+	data, _ := json.Marshal(object)
+	if err := json.Unmarshal(data, out); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (s *fakeAPIServer) store(path string, object map[string]interface{}) {
+	s.version++
+	metadata, _ := object["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		object["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = strconv.Itoa(s.version)
+	if metadata["uid"] == nil {
+		metadata["uid"] = fmt.Sprintf("uid-%d", s.version)
+	}
+	s.objects[path] = object
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	subresource := ""
+	if strings.HasSuffix(path, "/status") {
+		path, subresource = strings.TrimSuffix(path, "/status"), "status"
+	}
+	segments := strings.Split(path, "/")
+	collection := collections[segments[len(segments)-1]]
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("watch") != "":
+		w.WriteHeader(http.StatusOK)
+		s.mutex.Unlock()
+		<-r.Context().Done()
+		s.mutex.Lock()
+	case r.Method == http.MethodGet && collection:
+		s.writeList(w, r, path)
+	case r.Method == http.MethodGet:
+		if object, found := s.objects[path]; found {
+			writeObject(w, http.StatusOK, object)
+		} else {
+			writeFailure(w, http.StatusNotFound, "NotFound", path)
+		}
+	case r.Method == http.MethodPost && collection:
+		object, err := readObject(r)
+		if err != nil {
+			writeFailure(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		metadata, _ := object["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		if name == "" {
+			name = fmt.Sprintf("%s%d", metadata["generateName"], s.version+1)
+			metadata["name"] = name
+		}
+		if _, found := s.objects[path+"/"+name]; found {
+			writeFailure(w, http.StatusConflict, "AlreadyExists", name)
+			return
+		}
+		s.store(path+"/"+name, object)
+		writeObject(w, http.StatusCreated, object)
+	case r.Method == http.MethodPut:
+		current, found := s.objects[path]
+		if !found {
+			writeFailure(w, http.StatusNotFound, "NotFound", path)
+			return
+		}
+		object, err := readObject(r)
+		if err != nil {
+			writeFailure(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		metadata, _ := object["metadata"].(map[string]interface{})
+		if version, _ := metadata["resourceVersion"].(string); version != "" &&
+			version != current["metadata"].(map[string]interface{})["resourceVersion"] {
+			writeFailure(w, http.StatusConflict, "Conflict", path)
+			return
+		}
+		if subresource == "status" {
+			current["status"] = object["status"]
+			object = current
+		}
+		s.store(path, object)
+		writeObject(w, http.StatusOK, object)
+	case r.Method == http.MethodPatch:
+		current, found := s.objects[path]
+		if !found {
+			writeFailure(w, http.StatusNotFound, "NotFound", path)
+			return
+		}
+		patch, err := readObject(r)
+		if err != nil {
+			writeFailure(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		object := mergePatch(current, patch).(map[string]interface{})
+		s.store(path, object)
+		writeObject(w, http.StatusOK, object)
+	case r.Method == http.MethodDelete:
+		if _, found := s.objects[path]; !found {
+			writeFailure(w, http.StatusNotFound, "NotFound", path)
+			return
+		}
+		delete(s.objects, path)
+		writeObject(w, http.StatusOK, map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Success"})
+	default:
+		writeFailure(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// writeList answers a collection GET, across namespaces if the path has
+// none, filtered by simple equality label and field selectors.
+func (s *fakeAPIServer) writeList(w http.ResponseWriter, r *http.Request, path string) {
+	segments := strings.Split(path, "/")
+	resource := segments[len(segments)-1]
+	prefix := strings.TrimSuffix(path, resource)
+	var keys []string
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.Split(strings.TrimPrefix(key, prefix), "/")
+		if len(rest) == 2 && rest[0] == resource ||
+			!strings.Contains(path, "/namespaces/") && len(rest) == 4 && rest[0] == "namespaces" && rest[2] == resource {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	items := []interface{}{}
+	for _, key := range keys {
+		object := s.objects[key]
+		if matchSelector(object, "metadata.labels.", r.URL.Query().Get("labelSelector")) &&
+			matchSelector(object, "", r.URL.Query().Get("fieldSelector")) {
+			items = append(items, object)
+		}
+	}
+	writeObject(w, http.StatusOK, map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": strconv.Itoa(s.version)},
+		"items":    items,
+	})
+}
+
+// matchSelector evaluates a comma separated list of key=value and
+// key!=value terms against the dotted field paths of an object.
+func matchSelector(object map[string]interface{}, prefix, selector string) bool {
+	for _, term := range strings.Split(selector, ",") {
+		if term == "" {
+			continue
+		}
+		negate := strings.Contains(term, "!=")
+		parts := strings.SplitN(strings.Replace(term, "!=", "=", 1), "=", 2)
+		value := lookupField(object, prefix+parts[0])
+		if len(parts) == 1 {
+			if value == nil {
+				return false
+			}
+			continue
+		}
+		if (fmt.Sprint(value) == parts[1]) == negate {
+			return false
+		}
+	}
+	return true
+}
+
+func lookupField(object map[string]interface{}, path string) interface{} {
+	var current interface{} = object
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+	if current == nil {
+		return ""
+	}
+	return current
+}
+
+// mergePatch applies a JSON merge patch, which is also how the strategic
+// merge patches the driver sends behave on maps.
+func mergePatch(current, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	currentMap, ok := current.(map[string]interface{})
+	if !ok {
+		currentMap = map[string]interface{}{}
+	}
+	result := map[string]interface{}{}
+	for key, value := range currentMap {
+		result[key] = value
+	}
+	for key, value := range patchMap {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergePatch(result[key], value)
+		}
+	}
+	return result
+}
+
+func readObject(r *http.Request) (map[string]interface{}, error) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	if reflect.ValueOf(object).IsNil() {
+		return nil, fmt.Errorf("empty body")
+	}
+	return object, nil
+}
+
+func writeObject(w http.ResponseWriter, code int, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(object)
+}
+
+func writeFailure(w http.ResponseWriter, code int, reason, message string) {
+	writeObject(w, code, map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"status":     "Failure",
+		"reason":     reason,
+		"message":    message,
+		"code":       code,
+	})
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeLVMD is an in-memory lvmd listening on localhost. The nodes of the
+// tests point to it with the InternalIP 127.0.0.1.
+type fakeLVMD struct {
+	mutex sync.Mutex
+	vgs   []*lvmdproto.VolumeGroup
+	// lvs are keyed by "vg/name".
+	lvs map[string]*lvmdproto.LogicalVolume
+	// failures holds an error to return once per method name.
+	failures map[string]error
+}
+
+// newFakeLVMD starts a fake lvmd and points lvmdPort to it.
+func newFakeLVMD(t *testing.T) *fakeLVMD {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeLVMD{
+		lvs:      map[string]*lvmdproto.LogicalVolume{},
+		failures: map[string]error{},
+	}
+	server := grpc.NewServer()
+	lvmdproto.RegisterLVMServer(server, fake)
+	go server.Serve(listener)
+	port := lvmdPort
+	_, lvmdPort, _ = net.SplitHostPort(listener.Addr().String())
+	t.Cleanup(func() {
+		server.Stop()
+		lvmdPort = port
+	})
+	return fake
+}
+
+// lvmdNode returns a node whose lvmd is the fake one.
+func lvmdNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{NodeLabelKey: name},
+		},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "127.0.0.1"}},
+		},
+	}
+}
+
+// addLV stores lv in vg.
+func (f *fakeLVMD) addLV(vg string, lv *lvmdproto.LogicalVolume) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lvs[vg+"/"+lv.Name] = lv
+}
+
+// getLV returns a copy of the LV vg/name, or nil.
+func (f *fakeLVMD) getLV(vg, name string) *lvmdproto.LogicalVolume {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if lv, found := f.lvs[vg+"/"+name]; found {
+		return proto.Clone(lv).(*lvmdproto.LogicalVolume)
+	}
+	return nil
+}
+
+// failOnce makes the next call of method fail with err.
+func (f *fakeLVMD) failOnce(method string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures[method] = err
+}
+
+// failure returns the pending failure of method, the caller holds mutex.
+func (f *fakeLVMD) failure(method string) error {
+	err := f.failures[method]
+	delete(f.failures, method)
+	return err
+}
+
+func (f *fakeLVMD) ListLV(ctx context.Context, req *lvmdproto.ListLVRequest) (*lvmdproto.ListLVReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("ListLV"); err != nil {
+		return nil, err
+	}
+	reply := &lvmdproto.ListLVReply{}
+	if strings.Contains(req.VolumeGroup, "/") {
+		lv, found := f.lvs[req.VolumeGroup]
+		if !found {
+			// like lvs, which fails for volumes which do not exist
+			return nil, status.Errorf(codes.Unknown, "Failed to find logical volume %q", req.VolumeGroup)
+		}
+		reply.Volumes = append(reply.Volumes, proto.Clone(lv).(*lvmdproto.LogicalVolume))
+		return reply, nil
+	}
+	for key, lv := range f.lvs {
+		if strings.HasPrefix(key, req.VolumeGroup+"/") {
+			reply.Volumes = append(reply.Volumes, proto.Clone(lv).(*lvmdproto.LogicalVolume))
+		}
+	}
+	return reply, nil
+}
+
+func (f *fakeLVMD) CreateLV(ctx context.Context, req *lvmdproto.CreateLVRequest) (*lvmdproto.CreateLVReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("CreateLV"); err != nil {
+		return nil, err
+	}
+	key := req.VolumeGroup + "/" + req.Name
+	if _, found := f.lvs[key]; found {
+		return nil, status.Errorf(codes.AlreadyExists, "logical volume %s already exists", key)
+	}
+	f.lvs[key] = &lvmdproto.LogicalVolume{
+		Name:       req.Name,
+		Size:       req.Size,
+		Tags:       req.Tags,
+		Attributes: &lvmdproto.LogicalVolume_Attributes{},
+	}
+	return &lvmdproto.CreateLVReply{}, nil
+}
+
+func (f *fakeLVMD) RemoveLV(ctx context.Context, req *lvmdproto.RemoveLVRequest) (*lvmdproto.RemoveLVReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("RemoveLV"); err != nil {
+		return nil, err
+	}
+	key := req.VolumeGroup + "/" + req.Name
+	if _, found := f.lvs[key]; !found {
+		return nil, status.Errorf(codes.Unknown, "Failed to find logical volume %q", key)
+	}
+	delete(f.lvs, key)
+	return &lvmdproto.RemoveLVReply{}, nil
+}
+
+func (f *fakeLVMD) CloneLV(ctx context.Context, req *lvmdproto.CloneLVRequest) (*lvmdproto.CloneLVReply, error) {
+	return nil, status.Error(codes.Unimplemented, "CloneLV")
+}
+
+func (f *fakeLVMD) AddTagLV(ctx context.Context, req *lvmdproto.AddTagLVRequest) (*lvmdproto.AddTagLVReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("AddTagLV"); err != nil {
+		return nil, err
+	}
+	lv, found := f.lvs[req.VolumeGroup+"/"+req.Name]
+	if !found {
+		return nil, status.Errorf(codes.Unknown, "Failed to find logical volume %q", req.Name)
+	}
+	for _, tag := range req.Tags {
+		if !hasTag(lv.Tags, tag) {
+			lv.Tags = append(lv.Tags, tag)
+		}
+	}
+	return &lvmdproto.AddTagLVReply{}, nil
+}
+
+func (f *fakeLVMD) RemoveTagLV(ctx context.Context, req *lvmdproto.RemoveTagLVRequest) (*lvmdproto.RemoveTagLVReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("RemoveTagLV"); err != nil {
+		return nil, err
+	}
+	lv, found := f.lvs[req.VolumeGroup+"/"+req.Name]
+	if !found {
+		return nil, status.Errorf(codes.Unknown, "Failed to find logical volume %q", req.Name)
+	}
+	var tags []string
+	for _, tag := range lv.Tags {
+		if !hasTag(req.Tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	lv.Tags = tags
+	return &lvmdproto.RemoveTagLVReply{}, nil
+}
+
+func (f *fakeLVMD) ListVG(ctx context.Context, req *lvmdproto.ListVGRequest) (*lvmdproto.ListVGReply, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.failure("ListVG"); err != nil {
+		return nil, err
+	}
+	return &lvmdproto.ListVGReply{VolumeGroups: f.vgs}, nil
+}
+
+func (f *fakeLVMD) CreateVG(ctx context.Context, req *lvmdproto.CreateVGRequest) (*lvmdproto.CreateVGReply, error) {
+	return nil, status.Error(codes.Unimplemented, "CreateVG")
+}
+
+func (f *fakeLVMD) RemoveVG(ctx context.Context, req *lvmdproto.CreateVGRequest) (*lvmdproto.RemoveVGReply, error) {
+	return nil, status.Error(codes.Unimplemented, "RemoveVG")
+}
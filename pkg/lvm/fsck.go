@@ -0,0 +1,160 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+const (
+	fsckPolicyKey = "fsckPolicy"
+
+	fsckPolicyNever  = "never"
+	fsckPolicyCheck  = "check"
+	fsckPolicyRepair = "repair"
+)
+
+// fsckResult is the outcome of checking a filesystem before mounting it.
+type fsckResult int
+
+const (
+	fsckClean fsckResult = iota
+	fsckRepaired
+	// fsckSkipped means the filesystem could not be checked, e.g. because
+	// its type has no checker or its log needs to be replayed by mounting.
+	fsckSkipped
+	fsckCorrupted
+)
+
+func validFsckPolicy(policy string) bool {
+	switch policy {
+	case "", fsckPolicyNever, fsckPolicyCheck, fsckPolicyRepair:
+		return true
+	}
+	return false
+}
+
+// checkFilesystem runs e2fsck or xfs_repair on devicePath according to
+// policy. It returns fsckCorrupted if errors are left which must keep the
+// filesystem from being mounted, along with the output of the checker.
+func checkFilesystem(devicePath, fstype, policy string) (fsckResult, string, error) {
+	if policy == "" || policy == fsckPolicyNever {
+		return fsckSkipped, "", nil
+	}
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		return checkExtFilesystem(devicePath, policy)
+	case "xfs":
+		return checkXfsFilesystem(devicePath, policy)
+	}
+	return fsckSkipped, fmt.Sprintf("no checker for filesystem type %s", fstype), nil
+}
+
+func checkExtFilesystem(devicePath, policy string) (fsckResult, string, error) {
+	args := []string{"-n", devicePath}
+	if policy == fsckPolicyRepair {
+		args = []string{"-p", devicePath}
+	} else {
+		// e2fsck -n does not replay the journal and would report the
+		// filesystem of a crashed node as corrupted, mounting replays it.
+		output, status, err := runChecker("dumpe2fs", "-h", devicePath)
+		if err != nil || status != 0 {
+			return fsckCorrupted, output, fmt.Errorf("dumpe2fs failed with exit status %d: %v", status, err)
+		}
+		if extNeedsRecovery(output) {
+			return fsckSkipped, "the journal needs to be replayed", nil
+		}
+	}
+	output, status, err := runChecker("e2fsck", args...)
+	if err != nil {
+		return fsckCorrupted, output, err
+	}
+	return extResult(status), output, extError(status)
+}
+
+// extNeedsRecovery returns whether the header printed by dumpe2fs -h lists
+// the feature needs_recovery, i.e. the journal has not been replayed.
+func extNeedsRecovery(header string) bool {
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "Filesystem features:") {
+			continue
+		}
+		for _, feature := range strings.Fields(strings.TrimPrefix(line, "Filesystem features:")) {
+			if feature == "needs_recovery" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func extError(status int) error {
+	if status >= 8 {
+		return fmt.Errorf("e2fsck failed with exit status %d", status)
+	}
+	return nil
+}
+
+// extResult maps the exit status of e2fsck to the result of the check.
+func extResult(status int) fsckResult {
+	// e2fsck exits with a bit mask: 1 and 2 mean errors were corrected,
+	// 4 that errors were left uncorrected and 8 or higher that it failed.
+	switch {
+	case status == 0:
+		return fsckClean
+	case status >= 8, status&4 != 0:
+		return fsckCorrupted
+	}
+	return fsckRepaired
+}
+
+func checkXfsFilesystem(devicePath, policy string) (fsckResult, string, error) {
+	args := []string{"-n", devicePath}
+	if policy == fsckPolicyRepair {
+		args = []string{devicePath}
+	}
+	output, status, err := runChecker("xfs_repair", args...)
+	if err != nil {
+		return fsckCorrupted, output, err
+	}
+	if status == 0 {
+		return fsckClean, output, nil
+	}
+	if strings.Contains(output, "metadata changes in a log") {
+		// xfs_repair refuses to touch a dirty log, mounting replays it.
+		return fsckSkipped, output, nil
+	}
+	return fsckCorrupted, output, nil
+}
+
+// runChecker runs a filesystem checker and returns its output and exit
+// status. An error is only returned if it could not be run at all.
+func runChecker(name string, args ...string) (string, int, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err == nil {
+		return string(output), 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return string(output), ws.ExitStatus(), nil
+		}
+	}
+	return string(output), 0, fmt.Errorf("csi-lvm: %s: %v", name, err)
+}
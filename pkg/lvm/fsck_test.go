@@ -0,0 +1,78 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import "testing"
+
+func TestExtNeedsRecovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		recovery bool
+	}{
+		{
+			name:     "clean",
+			header:   "Filesystem volume name:   <none>\nFilesystem features:      has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super\nFilesystem flags:         signed_directory_hash\n",
+			recovery: false,
+		},
+		{
+			name:     "unreplayed journal",
+			header:   "Filesystem volume name:   <none>\nFilesystem features:      has_journal ext_attr resize_inode dir_index filetype needs_recovery extent 64bit\n",
+			recovery: true,
+		},
+		{
+			name:     "feature name in another field",
+			header:   "Filesystem volume name:   needs_recovery\nFilesystem features:      has_journal\n",
+			recovery: false,
+		},
+		{
+			name:     "no features",
+			header:   "",
+			recovery: false,
+		},
+	}
+	for _, test := range tests {
+		if recovery := extNeedsRecovery(test.header); recovery != test.recovery {
+			t.Errorf("%s: extNeedsRecovery = %v, want %v", test.name, recovery, test.recovery)
+		}
+	}
+}
+
+func TestExtResult(t *testing.T) {
+	tests := []struct {
+		status int
+		result fsckResult
+		failed bool
+	}{
+		{0, fsckClean, false},
+		{1, fsckRepaired, false},
+		{2, fsckRepaired, false},
+		{3, fsckRepaired, false},
+		{4, fsckCorrupted, false},
+		{5, fsckCorrupted, false},
+		{8, fsckCorrupted, true},
+		{12, fsckCorrupted, true},
+	}
+	for _, test := range tests {
+		if result := extResult(test.status); result != test.result {
+			t.Errorf("extResult(%d) = %v, want %v", test.status, result, test.result)
+		}
+		if err := extError(test.status); (err != nil) != test.failed {
+			t.Errorf("extError(%d) = %v, want failure %v", test.status, err, test.failed)
+		}
+	}
+}
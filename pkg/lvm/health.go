@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	checkHealthInterval = time.Minute
+
+	// healthAnnKey holds the abnormal condition of the volume of a PV and
+	// its PVC, it is removed once the volume is healthy again.
+	healthAnnKey = "lvm/health"
+
+	// thinPoolFullPercent is the data or metadata usage from which the
+	// pool of a thin volume is reported as nearly full.
+	thinPoolFullPercent = 90
+
+	reasonVolumeDegraded     = "VolumeDegraded"
+	reasonVolumeDiskMissing  = "VolumeDiskMissing"
+	reasonVolumeSuspended    = "VolumeSuspended"
+	reasonSnapshotInvalid    = "SnapshotInvalid"
+	reasonThinPoolNearlyFull = "ThinPoolNearlyFull"
+	reasonVolumeHealthy      = "VolumeHealthy"
+)
+
+// volumeCondition is an abnormal condition of a volume.
+type volumeCondition struct {
+	reason  string
+	message string
+}
+
+// healthMonitor remembers the conditions found by the last check for the
+// metrics.
+type healthMonitor struct {
+	vgName string
+
+	mutex      sync.Mutex
+	conditions map[string]*volumeCondition
+}
+
+func newHealthMonitor(vgName string) *healthMonitor {
+	return &healthMonitor{
+		vgName:     vgName,
+		conditions: map[string]*volumeCondition{},
+	}
+}
+
+// getVolumeCondition returns the abnormal condition of lv, or nil if it is
+// healthy. pools holds the lvs report of the thin volumes and pools.
+func getVolumeCondition(lv *lvmdproto.LogicalVolume, pools map[string]map[string]string) *volumeCondition {
+	attributes := lv.GetAttributes()
+	switch attributes.GetHealth() {
+	case lvmdproto.LogicalVolume_Attributes_PARTIAL:
+		return &volumeCondition{reasonVolumeDiskMissing, "one or more physical volumes of the volume are missing"}
+	case lvmdproto.LogicalVolume_Attributes_REFRESH_NEEDED:
+		return &volumeCondition{reasonVolumeDegraded, "a physical volume of the volume had a write error, the volume needs a refresh"}
+	case lvmdproto.LogicalVolume_Attributes_MISMATCHES_EXIST:
+		return &volumeCondition{reasonVolumeDegraded, "the RAID or mirror images of the volume have mismatches"}
+	}
+	switch attributes.GetState() {
+	case lvmdproto.LogicalVolume_Attributes_SUSPENDED,
+		lvmdproto.LogicalVolume_Attributes_MAPPED_DEVICE_PRESENT_WITHOUT_TABLES:
+		return &volumeCondition{reasonVolumeSuspended, fmt.Sprintf("the volume is in state %s", attributes.GetState())}
+	case lvmdproto.LogicalVolume_Attributes_INVALID_SNAPSHOT,
+		lvmdproto.LogicalVolume_Attributes_INVALID_SUSPENDED_SNAPSHOT,
+		lvmdproto.LogicalVolume_Attributes_SNAPSHOT_MERGE_FAILED,
+		lvmdproto.LogicalVolume_Attributes_SUSPENDED_SNAPSHOT_MERGE_FAILED:
+		return &volumeCondition{reasonSnapshotInvalid, fmt.Sprintf("the snapshot is in state %s", attributes.GetState())}
+	}
+	if pool := pools[pools[lv.GetName()]["pool_lv"]]; pool != nil {
+		for _, field := range []string{"data_percent", "metadata_percent"} {
+			if percent, err := strconv.ParseFloat(pool[field], 64); err == nil && percent >= thinPoolFullPercent {
+				return &volumeCondition{reasonThinPoolNearlyFull, fmt.Sprintf("thin pool %s is %s%% full (%s)", pool["lv_name"], pool[field], field)}
+			}
+		}
+	}
+	return nil
+}
+
+// checkHealth checks the LVs of PVs on the node and reports changes of
+// their conditions as events and annotations of the PV and PVC.
+func (ns *nodeServer) checkHealth() {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("checkHealth: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	lvs, err := conn.ListLV(context.Background(), ns.vgName)
+	if err != nil {
+		glog.Errorf("checkHealth: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	pools := map[string]map[string]string{}
+	if report, err := lvsReport(ns.vgName, "lv_name", "pool_lv", "data_percent", "metadata_percent"); err == nil {
+		for _, lv := range report {
+			pools[lv["lv_name"]] = lv
+		}
+	} else {
+		glog.V(3).Infof("checkHealth: no thin pool usage: %v", err)
+	}
+
+	conditions := map[string]*volumeCondition{}
+	for _, lv := range lvs {
+		pv, err := getPV(ns.client, lv.GetName())
+		if err != nil {
+			// not the LV of a PV
+			continue
+		}
+		condition := getVolumeCondition(lv, pools)
+		if condition != nil {
+			conditions[lv.GetName()] = condition
+		}
+		ns.reportHealth(pv, condition)
+	}
+
+	ns.health.mutex.Lock()
+	ns.health.conditions = conditions
+	ns.health.mutex.Unlock()
+}
+
+// healthReason returns the reason of the value of healthAnnKey.
+func healthReason(value string) string {
+	return strings.SplitN(value, ": ", 2)[0]
+}
+
+// reportHealth records an event and updates the annotations of pv and its
+// PVC if the reason of the condition of the volume changed. Messages may
+// change with every check, e.g. the usage of a thin pool.
+func (ns *nodeServer) reportHealth(pv *v1.PersistentVolume, condition *volumeCondition) {
+	value, reason := "", ""
+	if condition != nil {
+		value = condition.reason + ": " + condition.message
+		reason = condition.reason
+	}
+	if healthReason(pv.Annotations[healthAnnKey]) == reason {
+		return
+	}
+	if condition != nil {
+		glog.Warningf("Volume %s: %s", pv.Name, value)
+		ns.recorder.Event(pv, v1.EventTypeWarning, condition.reason, condition.message)
+	} else {
+		ns.recorder.Event(pv, v1.EventTypeNormal, reasonVolumeHealthy, "the volume is healthy again")
+	}
+	claim := pv.Spec.ClaimRef
+	if claim != nil {
+		if condition != nil {
+			ns.recorder.Event(claim, v1.EventTypeWarning, condition.reason, condition.message)
+		} else {
+			ns.recorder.Event(claim, v1.EventTypeNormal, reasonVolumeHealthy, "the volume is healthy again")
+		}
+		if err := setClaimAnnotation(ns.client, claim, healthAnnKey, value); err != nil {
+			glog.Errorf("checkHealth: failed to annotate pvc %s/%s: %v", claim.Namespace, claim.Name, err)
+		}
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := getPV(ns.client, pv.Name)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			delete(pv.Annotations, healthAnnKey)
+		} else {
+			if pv.Annotations == nil {
+				pv.Annotations = map[string]string{}
+			}
+			pv.Annotations[healthAnnKey] = value
+		}
+		_, err = updatePV(ns.client, pv)
+		return err
+	})
+	if err != nil {
+		glog.Errorf("checkHealth: failed to annotate pv %s: %v", pv.Name, err)
+	}
+}
+
+var volumeAbnormalDesc = prometheus.NewDesc("csi_lvm_volume_abnormal",
+	"1 if the volume has an abnormal condition, by reason.", []string{"vg", "lv", "reason"}, nil)
+
+func (m *healthMonitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeAbnormalDesc
+}
+
+func (m *healthMonitor) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for lv, condition := range m.conditions {
+		ch <- prometheus.MustNewConstMetric(volumeAbnormalDesc, prometheus.GaugeValue, 1, m.vgName, lv, condition.reason)
+	}
+}
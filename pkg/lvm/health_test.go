@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	lvmdproto "github.com/google/lvmd/proto"
+)
+
+func TestGetVolumeCondition(t *testing.T) {
+	lv := func(name string, health lvmdproto.LogicalVolume_Attributes_Health, state lvmdproto.LogicalVolume_Attributes_State) *lvmdproto.LogicalVolume {
+		return &lvmdproto.LogicalVolume{
+			Name:       name,
+			Attributes: &lvmdproto.LogicalVolume_Attributes{Health: health, State: state},
+		}
+	}
+	healthy := func(name string) *lvmdproto.LogicalVolume {
+		return lv(name, lvmdproto.LogicalVolume_Attributes_OK, lvmdproto.LogicalVolume_Attributes_ACTIVE)
+	}
+	pools := map[string]map[string]string{
+		"pool0":  {"lv_name": "pool0", "data_percent": "95.20", "metadata_percent": "10.00"},
+		"pool1":  {"lv_name": "pool1", "data_percent": "50.00", "metadata_percent": "90.00"},
+		"pool2":  {"lv_name": "pool2", "data_percent": "89.99", "metadata_percent": ""},
+		"thin0":  {"lv_name": "thin0", "pool_lv": "pool0"},
+		"thin1":  {"lv_name": "thin1", "pool_lv": "pool1"},
+		"thin2":  {"lv_name": "thin2", "pool_lv": "pool2"},
+		"linear": {"lv_name": "linear", "pool_lv": ""},
+	}
+	tests := []struct {
+		name     string
+		lv       *lvmdproto.LogicalVolume
+		expected string
+	}{
+		{"healthy", healthy("linear"), ""},
+		{"missing pv", lv("linear", lvmdproto.LogicalVolume_Attributes_PARTIAL, lvmdproto.LogicalVolume_Attributes_ACTIVE), reasonVolumeDiskMissing},
+		{"refresh needed", lv("linear", lvmdproto.LogicalVolume_Attributes_REFRESH_NEEDED, lvmdproto.LogicalVolume_Attributes_ACTIVE), reasonVolumeDegraded},
+		{"mismatches", lv("linear", lvmdproto.LogicalVolume_Attributes_MISMATCHES_EXIST, lvmdproto.LogicalVolume_Attributes_ACTIVE), reasonVolumeDegraded},
+		{"write mostly", lv("linear", lvmdproto.LogicalVolume_Attributes_WRITEMOSTLY, lvmdproto.LogicalVolume_Attributes_ACTIVE), ""},
+		{"suspended", lv("linear", lvmdproto.LogicalVolume_Attributes_OK, lvmdproto.LogicalVolume_Attributes_SUSPENDED), reasonVolumeSuspended},
+		{"no tables", lv("linear", lvmdproto.LogicalVolume_Attributes_OK, lvmdproto.LogicalVolume_Attributes_MAPPED_DEVICE_PRESENT_WITHOUT_TABLES), reasonVolumeSuspended},
+		{"invalid snapshot", lv("linear", lvmdproto.LogicalVolume_Attributes_OK, lvmdproto.LogicalVolume_Attributes_INVALID_SNAPSHOT), reasonSnapshotInvalid},
+		{"merge failed", lv("linear", lvmdproto.LogicalVolume_Attributes_OK, lvmdproto.LogicalVolume_Attributes_SNAPSHOT_MERGE_FAILED), reasonSnapshotInvalid},
+		{"pool data full", healthy("thin0"), reasonThinPoolNearlyFull},
+		{"pool metadata full", healthy("thin1"), reasonThinPoolNearlyFull},
+		{"pool below threshold", healthy("thin2"), ""},
+		{"not reported", healthy("new"), ""},
+		{"missing pv of thin volume", lv("thin0", lvmdproto.LogicalVolume_Attributes_PARTIAL, lvmdproto.LogicalVolume_Attributes_ACTIVE), reasonVolumeDiskMissing},
+	}
+	for _, test := range tests {
+		reason := ""
+		if condition := getVolumeCondition(test.lv, pools); condition != nil {
+			reason = condition.reason
+		}
+		if reason != test.expected {
+			t.Errorf("%s: expected reason %q, got %q", test.name, test.expected, reason)
+		}
+	}
+}
+
+func TestHealthReason(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"ThinPoolNearlyFull: thin pool pool0 is 95.20% full (data_percent)", reasonThinPoolNearlyFull},
+		{"VolumeSuspended: the volume is in state SUSPENDED", reasonVolumeSuspended},
+		{"VolumeDegraded", reasonVolumeDegraded},
+	}
+	for _, test := range tests {
+		if reason := healthReason(test.value); reason != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.value, test.expected, reason)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewInterval = 5 * time.Second
+
+	// leaderConfigMap holds the leader record where the API server does
+	// not serve Leases, i.e. before Kubernetes 1.12.
+	leaderConfigMap    = "csi-lvm-leader"
+	leaderConfigMapKey = "leader"
+)
+
+// leaderRecord is the state of the leader lock, stored in a Lease or in
+// leaderConfigMap.
+type leaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int32     `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaderTransitions    int32     `json:"leaderTransitions"`
+}
+
+// leaderLock stores the leaderRecord. update must fail if the record
+// changed since get.
+type leaderLock interface {
+	// get returns the record, nil if there is none yet.
+	get() (*leaderRecord, error)
+	create(record *leaderRecord) error
+	update(record *leaderRecord) error
+	describe() string
+}
+
+// leaderElector elects one of the controller replicas to run the
+// background work, e.g. reconciling pending deletions. CSI calls are
+// served by every replica.
+type leaderElector struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	identity  string
+	lock      leaderLock
+
+	mutex  sync.Mutex
+	leader bool
+	// renewed is when the lock was last renewed by this replica.
+	renewed time.Time
+
+	// observed is the record last seen with the local time it was first
+	// seen, the lock expires by the local clock, as the clocks of the
+	// replicas may differ.
+	observed     leaderRecord
+	observedTime time.Time
+}
+
+func newLeaderElector(client kubernetes.Interface, namespace, name, identity string) *leaderElector {
+	return &leaderElector{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+	}
+}
+
+func (le *leaderElector) run(stopCh <-chan struct{}) {
+	wait.Until(le.tryAcquireOrRenew, renewInterval, stopCh)
+}
+
+func (le *leaderElector) isLeader() bool {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.leader && time.Since(le.renewed) < leaseDuration
+}
+
+func (le *leaderElector) setLeader(leader bool) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if leader && !le.leader {
+		glog.Infof("Acquired leadership of %s", le.lock.describe())
+	} else if !leader && le.leader {
+		glog.Infof("Lost leadership of %s", le.lock.describe())
+	}
+	le.leader = leader
+	if leader {
+		le.renewed = time.Now()
+	}
+}
+
+// getLock returns the Lease lock if the API server serves Leases and the
+// ConfigMap lock otherwise.
+func (le *leaderElector) getLock() (leaderLock, error) {
+	if le.lock != nil {
+		return le.lock, nil
+	}
+	groupVersion := coordinationv1beta1.SchemeGroupVersion.String()
+	resources, err := le.client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	servesLeases := false
+	if err == nil {
+		for _, resource := range resources.APIResources {
+			if resource.Name == "leases" {
+				servesLeases = true
+			}
+		}
+	}
+	if servesLeases {
+		le.lock = &leaseLock{client: le.client, namespace: le.namespace, name: le.name}
+	} else {
+		glog.Infof("The API server does not serve %s leases, using ConfigMap %s/%s as leader lock", groupVersion, le.namespace, leaderConfigMap)
+		le.lock = &configMapLock{client: le.client, namespace: le.namespace, name: leaderConfigMap}
+	}
+	return le.lock, nil
+}
+
+func (le *leaderElector) tryAcquireOrRenew() {
+	lock, err := le.getLock()
+	if err != nil {
+		glog.Errorf("Failed to discover the leader lock: %v", err)
+		return
+	}
+	now := time.Now()
+	desired := &leaderRecord{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int32(leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	record, err := lock.get()
+	if err != nil {
+		glog.Errorf("Failed to get %s: %v", lock.describe(), err)
+		le.setLeader(false)
+		return
+	}
+	if record == nil {
+		err = lock.create(desired)
+		if err != nil {
+			glog.V(3).Infof("Failed to create %s: %v", lock.describe(), err)
+		}
+		le.setLeader(err == nil)
+		return
+	}
+
+	if record.HolderIdentity == le.identity {
+		desired.AcquireTime = record.AcquireTime
+		desired.LeaderTransitions = record.LeaderTransitions
+	} else {
+		if !le.leaseExpired(record, now) {
+			le.setLeader(false)
+			return
+		}
+		desired.LeaderTransitions = record.LeaderTransitions + 1
+	}
+	if err := lock.update(desired); err != nil {
+		glog.V(3).Infof("Failed to update %s: %v", lock.describe(), err)
+		le.setLeader(false)
+		return
+	}
+	le.setLeader(true)
+}
+
+// leaseExpired returns whether record is free or has not been renewed for
+// its duration since this replica first saw it.
+func (le *leaderElector) leaseExpired(record *leaderRecord, now time.Time) bool {
+	if record.HolderIdentity == "" {
+		return true
+	}
+	if le.observedTime.IsZero() || !recordsEqual(&le.observed, record) {
+		le.observed = *record
+		le.observedTime = now
+		return false
+	}
+	return now.Sub(le.observedTime) >= time.Duration(record.LeaseDurationSeconds)*time.Second
+}
+
+func recordsEqual(a, b *leaderRecord) bool {
+	return a.HolderIdentity == b.HolderIdentity &&
+		a.LeaseDurationSeconds == b.LeaseDurationSeconds &&
+		a.AcquireTime.Equal(b.AcquireTime) &&
+		a.RenewTime.Equal(b.RenewTime) &&
+		a.LeaderTransitions == b.LeaderTransitions
+}
+
+// leaseLock is a leaderLock on a coordination.k8s.io/v1beta1 Lease,
+// served since Kubernetes 1.12.
+type leaseLock struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	lease     *coordinationv1beta1.Lease
+}
+
+func (l *leaseLock) get() (*leaderRecord, error) {
+	lease, err := l.client.CoordinationV1beta1().Leases(l.namespace).Get(l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	record := &leaderRecord{}
+	if lease.Spec.HolderIdentity != nil {
+		record.HolderIdentity = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = *lease.Spec.LeaseDurationSeconds
+	}
+	if lease.Spec.AcquireTime != nil {
+		record.AcquireTime = lease.Spec.AcquireTime.Time
+	}
+	if lease.Spec.RenewTime != nil {
+		record.RenewTime = lease.Spec.RenewTime.Time
+	}
+	if lease.Spec.LeaseTransitions != nil {
+		record.LeaderTransitions = *lease.Spec.LeaseTransitions
+	}
+	return record, nil
+}
+
+func (l *leaseLock) create(record *leaderRecord) error {
+	lease, err := l.client.CoordinationV1beta1().Leases(l.namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+		},
+		Spec: leaseSpec(record),
+	})
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *leaseLock) update(record *leaderRecord) error {
+	if l.lease == nil {
+		return fmt.Errorf("lease %s/%s not got yet", l.namespace, l.name)
+	}
+	l.lease.Spec = leaseSpec(record)
+	lease, err := l.client.CoordinationV1beta1().Leases(l.namespace).Update(l.lease)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *leaseLock) describe() string {
+	return fmt.Sprintf("lease %s/%s", l.namespace, l.name)
+}
+
+func leaseSpec(record *leaderRecord) coordinationv1beta1.LeaseSpec {
+	acquireTime := metav1.NewMicroTime(record.AcquireTime)
+	renewTime := metav1.NewMicroTime(record.RenewTime)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &record.HolderIdentity,
+		LeaseDurationSeconds: &record.LeaseDurationSeconds,
+		AcquireTime:          &acquireTime,
+		RenewTime:            &renewTime,
+		LeaseTransitions:     &record.LeaderTransitions,
+	}
+}
+
+// configMapLock is a leaderLock on the JSON leaderRecord in a ConfigMap.
+type configMapLock struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	cm        *v1.ConfigMap
+}
+
+func (l *configMapLock) get() (*leaderRecord, error) {
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l.cm = cm
+	record := &leaderRecord{}
+	if data := cm.Data[leaderConfigMapKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), record); err != nil {
+			return nil, fmt.Errorf("invalid leader record in %s: %v", l.describe(), err)
+		}
+	}
+	return record, nil
+}
+
+func (l *configMapLock) create(record *leaderRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.name,
+			Namespace: l.namespace,
+		},
+		Data: map[string]string{leaderConfigMapKey: string(data)},
+	})
+	if err != nil {
+		return err
+	}
+	l.cm = cm
+	return nil
+}
+
+func (l *configMapLock) update(record *leaderRecord) error {
+	if l.cm == nil {
+		return fmt.Errorf("configmap %s/%s not got yet", l.namespace, l.name)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if l.cm.Data == nil {
+		l.cm.Data = map[string]string{}
+	}
+	l.cm.Data[leaderConfigMapKey] = string(data)
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Update(l.cm)
+	if err != nil {
+		return err
+	}
+	l.cm = cm
+	return nil
+}
+
+func (l *configMapLock) describe() string {
+	return fmt.Sprintf("configmap %s/%s", l.namespace, l.name)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaseExpired(t *testing.T) {
+	start := time.Now()
+	// renewal times come from the clock of the holder, which may be far
+	// behind or ahead of the local one
+	held := func(holder string, renewed time.Time) *leaderRecord {
+		return &leaderRecord{
+			HolderIdentity:       holder,
+			LeaseDurationSeconds: int32(leaseDuration / time.Second),
+			RenewTime:            renewed,
+		}
+	}
+	stale := start.Add(-time.Hour)
+	tests := []struct {
+		name    string
+		record  *leaderRecord
+		after   time.Duration
+		expired bool
+	}{
+		{"free", held("", stale), 0, true},
+		{"first sight of a stale renewal", held("a", stale), 0, false},
+		{"unchanged within duration", held("a", stale), leaseDuration / 2, false},
+		{"unchanged for duration", held("a", stale), leaseDuration, true},
+		{"renewed", held("a", stale.Add(renewInterval)), leaseDuration + time.Second, false},
+		{"renewal within duration", held("a", stale.Add(renewInterval)), 2 * leaseDuration, false},
+		{"renewal expired", held("a", stale.Add(renewInterval)), 2*leaseDuration + time.Second, true},
+		{"new holder", held("b", stale.Add(renewInterval)), 3 * leaseDuration, false},
+	}
+	le := newLeaderElector(nil, "default", "csi-lvmplugin", "c")
+	for _, test := range tests {
+		if expired := le.leaseExpired(test.record, start.Add(test.after)); expired != test.expired {
+			t.Errorf("%s: leaseExpired = %v, want %v", test.name, expired, test.expired)
+		}
+	}
+}
+
+func TestControllerServesOnlyAsLeader(t *testing.T) {
+	cs := &controllerServer{elector: &leaderElector{identity: "csi-provisioner-1"}}
+	if _, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("CreateVolume: expected Unavailable, got %v", err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("DeleteVolume: expected Unavailable, got %v", err)
+	}
+	cs.elector.leader, cs.elector.renewed = true, time.Now()
+	if err := cs.checkLeader(); err != nil {
+		t.Errorf("expected the leader to serve, got %v", err)
+	}
+}
@@ -17,9 +17,14 @@ limitations under the License.
 package lvm
 
 import (
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -36,6 +41,34 @@ type lvm struct {
 	cscap []*csi.ControllerServiceCapability
 }
 
+// Options configures the driver, see cmd/k8s-csi-lvm for the
+// corresponding flags.
+type Options struct {
+	DriverName string
+	NodeID     string
+	Endpoint   string
+	VGName     string
+	// Namespace holds the objects the driver keeps its state in.
+	Namespace string
+	// NodeGonePolicy decides what happens to pending deletions whose
+	// node object has been deleted.
+	NodeGonePolicy string
+	// Mode selects the CSI services to run: ModeController, ModeNode or
+	// ModeAll.
+	Mode string
+	// MetricsAddress is where to serve prometheus metrics, if set.
+	MetricsAddress string
+	// MigrationAddress is where the node plugin serves volumes migrating
+	// to other nodes, if set.
+	MigrationAddress string
+}
+
+const (
+	ModeController = "controller"
+	ModeNode       = "node"
+	ModeAll        = "all"
+)
+
 var (
 	lvmDriver     *lvm
 	vendorVersion = "0.3.0"
@@ -45,47 +78,147 @@ func GetLVMDriver(client kubernetes.Interface) *lvm {
 	return &lvm{client: client}
 }
 
-func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
+func NewIdentityServer(d *csicommon.CSIDriver, controller bool) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		controller:            controller,
 	}
 }
 
-func NewControllerServer(d *csicommon.CSIDriver, c kubernetes.Interface, vgName string) *controllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, c kubernetes.Interface, recorder record.EventRecorder, driverName string, vgName string, namespace string, nodeGonePolicy string, identity string) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		client:                  c,
-		vgName:            vgName,
+		recorder:                recorder,
+		driverName:              driverName,
+		vgName:                  vgName,
+		deletions:               newDeletionQueue(c, namespace, identity),
+		nodeGonePolicy:          nodeGonePolicy,
+		quotas:                  newQuotaChecker(c, namespace, driverName, vgName),
+		reservations:            newReservationLedger(c, namespace),
+		elector:                 newLeaderElector(c, namespace, driverName, identity),
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver, c kubernetes.Interface, nodeID string, vgName string) *nodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, c kubernetes.Interface, recorder record.EventRecorder, nodeID string, vgName string, namespace string, migrationAddress string) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 		client:            c,
+		recorder:          recorder,
 		nodeID:            nodeID,
 		vgName:            vgName,
+		namespace:         namespace,
+		migrationAddress:  migrationAddress,
+		reservations:      newReservationLedger(c, namespace),
+		health:            newHealthMonitor(vgName),
 	}
 }
 
-func (lvm *lvm) Run(driverName, nodeID, endpoint string, vgName string) {
-	glog.Infof("Driver: %v ", driverName)
+func (lvm *lvm) Run(opt *Options) {
+	glog.Infof("Driver: %v ", opt.DriverName)
+
+	runController := opt.Mode == ModeController || opt.Mode == ModeAll
+	runNode := opt.Mode == ModeNode || opt.Mode == ModeAll
+	if !runController && !runNode {
+		glog.Fatalf("Invalid mode %q", opt.Mode)
+	}
+	if opt.NodeGonePolicy != NodeGonePolicyDrop && opt.NodeGonePolicy != NodeGonePolicyKeep {
+		glog.Fatalf("Invalid node gone policy %q", opt.NodeGonePolicy)
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed to get hostname: %v", err)
+	}
+	nodeID := opt.NodeID
+	if nodeID == "" && !runNode {
+		// The controller does not need a node, but the library driver
+		// does.
+		nodeID = identity
+	}
 
 	// Initialize default library driver
-	lvm.driver = csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
+	lvm.driver = csicommon.NewCSIDriver(opt.DriverName, vendorVersion, nodeID)
 
 	if lvm.driver == nil {
 		glog.Fatalln("Failed to initialize CSI Driver.")
 	}
-	lvm.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	if runController {
+		lvm.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		})
+	}
 	lvm.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
-	// Create GRPC servers
-	lvm.ids = NewIdentityServer(lvm.driver)
-	lvm.ns = NewNodeServer(lvm.driver, lvm.client, nodeID, vgName)
-	lvm.cs = NewControllerServer(lvm.driver, lvm.client, vgName)
+	// Create GRPC servers, leaving out the services of other modes
+	lvm.ids = NewIdentityServer(lvm.driver, runController)
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+
+	if runController {
+		recorder := newEventRecorder(lvm.client, opt.DriverName, identity)
+		lvm.cs = NewControllerServer(lvm.driver, lvm.client, recorder, opt.DriverName, opt.VGName, opt.Namespace, opt.NodeGonePolicy, identity)
+		cs = lvm.cs
+		prometheus.MustRegister(lvm.cs.quotas)
+
+		// Several replicas may run, e.g. during a rolling update. Only
+		// the leader creates and deletes volumes, carries out pending
+		// deletions and keeps the reservation ledger.
+		elector := lvm.cs.elector
+		go elector.run(wait.NeverStop)
+		go wait.Until(func() {
+			if elector.isLeader() {
+				lvm.cs.reconcileDeletions()
+			}
+		}, reconcileDeletionsInterval, wait.NeverStop)
+		go wait.Until(func() {
+			if elector.isLeader() {
+				lvm.cs.reconcileReservations()
+			}
+		}, reconcileReservationsInterval, wait.NeverStop)
+		go wait.Until(func() {
+			if elector.isLeader() {
+				lvm.cs.reconcileProtection()
+			}
+		}, reconcileProtectionInterval, wait.NeverStop)
+	}
+
+	if !runController {
+		// The external attacher talks to the node socket and asks for
+		// the controller capabilities, none of which tells it that
+		// volumes need no attachment.
+		cs = csicommon.NewDefaultControllerServer(lvm.driver)
+	}
+
+	if runNode {
+		recorder := newEventRecorder(lvm.client, opt.DriverName, opt.NodeID)
+		lvm.ns = NewNodeServer(lvm.driver, lvm.client, recorder, opt.NodeID, opt.VGName, opt.Namespace, opt.MigrationAddress)
+		ns = lvm.ns
+
+		// before kubelet can publish volumes again
+		lvm.ns.cleanupEphemeralVolumes()
+		go wait.Until(lvm.ns.wipeVolumes, wipeInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.purgeTrash, purgeInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.uncacheVolumes, wipeInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.updateCapacity, updateCapacityInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.provisionVolumeGroups, provisionVolumeGroupsInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.updateInventory, updateInventoryInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.checkHealth, checkHealthInterval, wait.NeverStop)
+		go wait.Until(lvm.ns.migrateVolumes, migrateInterval, wait.NeverStop)
+		if opt.MigrationAddress != "" {
+			go lvm.ns.serveMigrations(opt.MigrationAddress)
+		}
+
+		prometheus.MustRegister(&cacheCollector{vgName: opt.VGName})
+		prometheus.MustRegister(lvm.ns.health)
+	}
+
+	if opt.MetricsAddress != "" {
+		go serveMetrics(opt.MetricsAddress)
+	}
 
 	server := csicommon.NewNonBlockingGRPCServer()
-	server.Start(endpoint, lvm.ids, lvm.cs, lvm.ns)
+	server.Start(opt.Endpoint, lvm.ids, cs, ns)
 	server.Wait()
 }
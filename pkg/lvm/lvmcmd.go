@@ -0,0 +1,116 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+// lvmd offers no way to rename LVs, to choose the physical volumes of an
+// LV nor to convert LVs, so the node plugin runs the LVM commands for those
+// itself. This needs the lvm2 tools in the image and /etc/lvm and /run/lvm
+// of the host mounted into the container.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+func runLVM(cmd string, args ...string) (string, error) {
+	glog.V(3).Infof("Running %s %s", cmd, strings.Join(args, " "))
+	output, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("csi-lvm: %s failed: %v: %s", cmd, err, output)
+	}
+	return string(output), nil
+}
+
+// lvCreate creates an LV like lvmd would, but allocated from opt.PVs if
+// set.
+func lvCreate(opt *lvmd.LVMOptions) error {
+	args := []string{"-y", "-n", opt.Name, "-L", fmt.Sprintf("%db", opt.Size)}
+	for _, tag := range opt.Tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, opt.VolumeGroup)
+	args = append(args, opt.PVs...)
+	_, err := runLVM("lvcreate", args...)
+	return err
+}
+
+func lvRename(vgName, oldName, newName string) error {
+	_, err := runLVM("lvrename", vgName, oldName, newName)
+	return err
+}
+
+func lvRemove(vgName, lvName string) error {
+	_, err := runLVM("lvremove", "-y", fmt.Sprintf("%s/%s", vgName, lvName))
+	return err
+}
+
+// lvsReport runs lvs on vgName with a JSON report of the given fields.
+func lvsReport(vgName string, fields ...string) ([]map[string]string, error) {
+	return report("lvs", "lv", "-o", strings.Join(fields, ","), vgName)
+}
+
+// pvsReport reports the given fields of the physical volumes of vgName.
+func pvsReport(vgName string, fields ...string) ([]map[string]string, error) {
+	return report("pvs", "pv", "-o", strings.Join(fields, ","), "--select", "vg_name="+vgName)
+}
+
+// getExtentSize returns the physical extent size of vgName in bytes.
+func getExtentSize(vgName string) (int64, error) {
+	vgs, err := report("vgs", "vg", "-o", "vg_extent_size", vgName)
+	if err != nil {
+		return 0, err
+	}
+	if len(vgs) == 0 {
+		return 0, fmt.Errorf("csi-lvm: volume group %s not found", vgName)
+	}
+	return strconv.ParseInt(vgs[0]["vg_extent_size"], 10, 64)
+}
+
+func report(cmd, kind string, args ...string) ([]map[string]string, error) {
+	output, err := runLVM(cmd, append([]string{"--reportformat", "json", "--units", "b", "--nosuffix"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var report struct {
+		Report []map[string][]map[string]string `json:"report"`
+	}
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		return nil, fmt.Errorf("csi-lvm: cannot parse output of %s: %v", cmd, err)
+	}
+	var items []map[string]string
+	for _, r := range report.Report {
+		items = append(items, r[kind]...)
+	}
+	return items, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LVMNodeGroupVersion is the API of the cluster scoped LVMNode
+	// resource, defined by deploy/kubernetes/lvmnode-crd.yaml.
+	LVMNodeGroupVersion = "lvm.paas.com/v1alpha1"
+	LVMNodeKind         = "LVMNode"
+	lvmNodesPath        = "/apis/" + LVMNodeGroupVersion + "/lvmnodes"
+
+	updateInventoryInterval = time.Minute
+)
+
+// LVMNode publishes the LVM inventory of the node of the same name.
+type LVMNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status LVMNodeStatus `json:"status,omitempty"`
+}
+
+type LVMNodeStatus struct {
+	VolumeGroups   []VolumeGroupStatus   `json:"volumeGroups,omitempty"`
+	LogicalVolumes []LogicalVolumeStatus `json:"logicalVolumes,omitempty"`
+	// UpdateTime is when the node plugin last refreshed the inventory.
+	UpdateTime metav1.Time `json:"updateTime,omitempty"`
+	// Error is set if the inventory could not be refreshed.
+	Error string `json:"error,omitempty"`
+}
+
+type VolumeGroupStatus struct {
+	Name     string   `json:"name"`
+	UUID     string   `json:"uuid,omitempty"`
+	Size     int64    `json:"size"`
+	FreeSize int64    `json:"freeSize"`
+	Tags     []string `json:"tags,omitempty"`
+	// ExtentSize and PhysicalVolumes are only reported for the VG of the
+	// driver.
+	ExtentSize      int64                  `json:"extentSize,omitempty"`
+	PhysicalVolumes []PhysicalVolumeStatus `json:"physicalVolumes,omitempty"`
+}
+
+type PhysicalVolumeStatus struct {
+	Name     string   `json:"name"`
+	Size     int64    `json:"size"`
+	FreeSize int64    `json:"freeSize"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type LogicalVolumeStatus struct {
+	Name        string   `json:"name"`
+	VolumeGroup string   `json:"volumeGroup"`
+	UUID        string   `json:"uuid,omitempty"`
+	Size        int64    `json:"size"`
+	Type        string   `json:"type"`
+	Permissions string   `json:"permissions"`
+	State       string   `json:"state"`
+	Open        bool     `json:"open"`
+	Health      string   `json:"health"`
+	Tags        []string `json:"tags,omitempty"`
+	// DataPercent and MetadataPercent are the usage of thin pools.
+	DataPercent     string `json:"dataPercent,omitempty"`
+	MetadataPercent string `json:"metadataPercent,omitempty"`
+}
+
+// GetLVMNode returns the LVMNode of node.
+func GetLVMNode(client kubernetes.Interface, node string) (*LVMNode, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(lvmNodesPath, node).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	lvmNode := &LVMNode{}
+	if err := json.Unmarshal(data, lvmNode); err != nil {
+		return nil, err
+	}
+	return lvmNode, nil
+}
+
+type lvmNodeList struct {
+	Items []LVMNode `json:"items"`
+}
+
+// ListLVMNodes returns the LVMNodes of all nodes.
+func ListLVMNodes(client kubernetes.Interface) ([]LVMNode, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(lvmNodesPath).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := &lvmNodeList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// saveLVMNode creates or updates lvmNode.
+func saveLVMNode(client kubernetes.Interface, lvmNode *LVMNode) error {
+	data, err := json.Marshal(lvmNode)
+	if err != nil {
+		return err
+	}
+	if lvmNode.ResourceVersion == "" {
+		return client.Discovery().RESTClient().Post().AbsPath(lvmNodesPath).Body(data).Do().Error()
+	}
+	return client.Discovery().RESTClient().Put().AbsPath(lvmNodesPath, lvmNode.Name).Body(data).Do().Error()
+}
+
+// updateInventory refreshes the LVMNode of the node from lvmd, creating it
+// owned by the node if it does not exist yet.
+func (ns *nodeServer) updateInventory() {
+	lvmNode, err := GetLVMNode(ns.client, ns.GetNodeID())
+	if apierrors.IsNotFound(err) {
+		node, err := getNode(ns.client, ns.GetNodeID())
+		if err != nil {
+			glog.Errorf("updateInventory: %v", err)
+			return
+		}
+		lvmNode = &LVMNode{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: LVMNodeGroupVersion,
+				Kind:       LVMNodeKind,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: node.Name,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       node.Name,
+					UID:        node.UID,
+				}},
+			},
+		}
+	} else if err != nil {
+		glog.Errorf("updateInventory: failed to get LVMNode %s: %v", ns.GetNodeID(), err)
+		return
+	}
+
+	lvmNode.Status = ns.getInventory()
+	if err := saveLVMNode(ns.client, lvmNode); err != nil {
+		glog.Errorf("updateInventory: failed to save LVMNode %s: %v", ns.GetNodeID(), err)
+	}
+}
+
+func (ns *nodeServer) getInventory() LVMNodeStatus {
+	status := LVMNodeStatus{UpdateTime: metav1.Now()}
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	vgs, err := conn.ListVG(ctx)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	for _, vg := range vgs {
+		vgStatus := VolumeGroupStatus{
+			Name:     vg.GetName(),
+			UUID:     vg.GetUuid(),
+			Size:     int64(vg.GetSize()),
+			FreeSize: int64(vg.GetFreeSize()),
+			Tags:     vg.GetTags(),
+		}
+		if vg.GetName() == ns.vgName {
+			vgStatus.PhysicalVolumes = getPhysicalVolumes(vg.GetName())
+			if extentSize, err := getExtentSize(vg.GetName()); err != nil {
+				glog.V(3).Infof("Failed to get extent size of %s: %v", vg.GetName(), err)
+			} else {
+				vgStatus.ExtentSize = extentSize
+			}
+		}
+		status.VolumeGroups = append(status.VolumeGroups, vgStatus)
+
+		lvs, err := conn.ListLV(ctx, vg.GetName())
+		if err != nil {
+			status.Error = err.Error()
+			continue
+		}
+		pools := getThinPoolUsage(vg.GetName())
+		for _, lv := range lvs {
+			attributes := lv.GetAttributes()
+			lvStatus := LogicalVolumeStatus{
+				Name:        lv.GetName(),
+				VolumeGroup: vg.GetName(),
+				UUID:        lv.GetUuid(),
+				Size:        int64(lv.GetSize()),
+				Type:        attributes.GetType().String(),
+				Permissions: attributes.GetPermissions().String(),
+				State:       attributes.GetState().String(),
+				Open:        attributes.GetOpen(),
+				Health:      attributes.GetHealth().String(),
+				Tags:        lv.GetTags(),
+			}
+			if usage, found := pools[lv.GetName()]; found {
+				lvStatus.DataPercent = usage["data_percent"]
+				lvStatus.MetadataPercent = usage["metadata_percent"]
+			}
+			status.LogicalVolumes = append(status.LogicalVolumes, lvStatus)
+		}
+	}
+	return status
+}
+
+// getPhysicalVolumes lists the physical volumes of vgName with the LVM
+// tools, lvmd does not report them.
+func getPhysicalVolumes(vgName string) []PhysicalVolumeStatus {
+	pvs, err := pvsReport(vgName, "pv_name", "pv_size", "pv_free", "pv_tags")
+	if err != nil {
+		glog.V(3).Infof("Failed to list physical volumes of %s: %v", vgName, err)
+		return nil
+	}
+	var statuses []PhysicalVolumeStatus
+	for _, pv := range pvs {
+		size, _ := strconv.ParseInt(pv["pv_size"], 10, 64)
+		free, _ := strconv.ParseInt(pv["pv_free"], 10, 64)
+		statuses = append(statuses, PhysicalVolumeStatus{
+			Name:     pv["pv_name"],
+			Size:     size,
+			FreeSize: free,
+			Tags:     splitList(pv["pv_tags"]),
+		})
+	}
+	return statuses
+}
+
+// getThinPoolUsage returns the data and metadata usage of the thin pools
+// of vgName by name.
+func getThinPoolUsage(vgName string) map[string]map[string]string {
+	lvs, err := lvsReport(vgName, "lv_name", "segtype", "data_percent", "metadata_percent")
+	if err != nil {
+		glog.V(3).Infof("Failed to get thin pool usage of %s: %v", vgName, err)
+		return nil
+	}
+	pools := map[string]map[string]string{}
+	for _, lv := range lvs {
+		if lv["segtype"] == "thin-pool" {
+			pools[lv["lv_name"]] = lv
+		}
+	}
+	return pools
+}
@@ -0,0 +1,803 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	// LVMVolumeMigrationKind is the cluster scoped resource requesting to
+	// move a volume to another node, defined by
+	// deploy/kubernetes/lvmvolumemigration-crd.yaml.
+	LVMVolumeMigrationKind  = "LVMVolumeMigration"
+	lvmVolumeMigrationsPath = "/apis/" + LVMNodeGroupVersion + "/lvmvolumemigrations"
+
+	migrateInterval = 10 * time.Second
+
+	// The snapshot of the source and the copy on the target carry the
+	// name of their migration, e.g. "csi-lvm.migration=move-pvc-1234".
+	migrationTagPrefix      = "csi-lvm.migration="
+	migrationSnapshotSuffix = "_migrate"
+	// migrationSnapshotSize is the space reserved for the writes to the
+	// source while its snapshot is copied. The snapshot becomes invalid
+	// once they exceed it, which fails the migration.
+	migrationSnapshotSize = "20%ORIGIN"
+
+	// migrationChunkSize is the unit in which source and copy are
+	// compared and resynchronized.
+	migrationChunkSize = 4 << 20
+
+	MigrationPhasePending    = "Pending"
+	MigrationPhaseCopying    = "Copying"
+	MigrationPhaseSyncing    = "Syncing"
+	MigrationPhaseRebinding  = "Rebinding"
+	MigrationPhaseCleaningUp = "CleaningUp"
+	MigrationPhaseCompleted  = "Completed"
+	MigrationPhaseFailed     = "Failed"
+)
+
+// LVMVolumeMigration moves the LV of a PV to another node. The node
+// plugin of the source snapshots the LV and serves it, the one of the
+// target copies it into a new LV, resynchronizes the chunks written in
+// the meantime once the volume is no longer in use, verifies the copy and
+// rebinds the PV. The source LV is removed last.
+type LVMVolumeMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LVMVolumeMigrationSpec   `json:"spec"`
+	Status LVMVolumeMigrationStatus `json:"status,omitempty"`
+}
+
+type LVMVolumeMigrationSpec struct {
+	// VolumeName is the name of the PV to move.
+	VolumeName string `json:"volumeName"`
+	TargetNode string `json:"targetNode"`
+}
+
+type LVMVolumeMigrationStatus struct {
+	Phase      string `json:"phase,omitempty"`
+	SourceNode string `json:"sourceNode,omitempty"`
+	// Endpoint is where the source serves the volume.
+	Endpoint   string   `json:"endpoint,omitempty"`
+	SizeBytes  int64    `json:"sizeBytes,omitempty"`
+	SourceTags []string `json:"sourceTags,omitempty"`
+	// BytesCopied is the progress of copying the snapshot, ChunksResynced
+	// the number of chunks copied again from the source once it was no
+	// longer in use.
+	BytesCopied    int64 `json:"bytesCopied,omitempty"`
+	ChunksResynced int   `json:"chunksResynced,omitempty"`
+	// Checksum is the SHA-256 of the chunk checksums of the verified copy.
+	Checksum       string       `json:"checksum,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+type lvmVolumeMigrationList struct {
+	Items []LVMVolumeMigration `json:"items"`
+}
+
+func listVolumeMigrations(client kubernetes.Interface) ([]LVMVolumeMigration, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(lvmVolumeMigrationsPath).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := &lvmVolumeMigrationList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// GetVolumeMigration returns the LVMVolumeMigration name.
+func GetVolumeMigration(client kubernetes.Interface, name string) (*LVMVolumeMigration, error) {
+	data, err := client.Discovery().RESTClient().Get().AbsPath(lvmVolumeMigrationsPath, name).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	m := &LVMVolumeMigration{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// updateMigrationStatus applies update to the latest status of the
+// migration name. update sees the phase the node acted on and returns an
+// error to abort if another node moved on in the meantime.
+func updateMigrationStatus(client kubernetes.Interface, name, phase string, update func(*LVMVolumeMigrationStatus)) error {
+	rest := client.Discovery().RESTClient()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		m, err := GetVolumeMigration(client, name)
+		if err != nil {
+			return err
+		}
+		if m.Status.Phase != phase && !(phase == MigrationPhasePending && m.Status.Phase == "") {
+			return fmt.Errorf("migration %s is %s, no longer %s", name, m.Status.Phase, phase)
+		}
+		update(&m.Status)
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return rest.Put().AbsPath(lvmVolumeMigrationsPath, name).Body(data).Do().Error()
+	})
+}
+
+// setMigrationMessage records why a migration does not progress, it is
+// retried later on.
+func (ns *nodeServer) setMigrationMessage(m *LVMVolumeMigration, err error) {
+	glog.Warningf("Migration %s of %s: %v", m.Name, m.Spec.VolumeName, err)
+	message := err.Error()
+	if m.Status.Message == message {
+		return
+	}
+	err = updateMigrationStatus(ns.client, m.Name, m.Status.Phase, func(s *LVMVolumeMigrationStatus) {
+		s.Message = message
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+	}
+}
+
+// failMigration gives up a migration which cannot succeed. It must not be
+// called once the PV is being rebound.
+func (ns *nodeServer) failMigration(m *LVMVolumeMigration, err error) {
+	glog.Errorf("Migration %s of %s failed: %v", m.Name, m.Spec.VolumeName, err)
+	if pv, e := getPV(ns.client, m.Spec.VolumeName); e == nil {
+		ns.recorder.Eventf(pv, v1.EventTypeWarning, "MigrationFailed", "Migration %s to %s failed: %v", m.Name, m.Spec.TargetNode, err)
+	}
+	message := err.Error()
+	err = updateMigrationStatus(ns.client, m.Name, m.Status.Phase, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseFailed
+		s.Message = message
+		now := metav1.Now()
+		s.CompletionTime = &now
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+	}
+}
+
+// migrateVolumes carries out the steps of the migrations from and to the
+// node, and removes the leftovers of failed or deleted migrations.
+func (ns *nodeServer) migrateVolumes() {
+	migrations, err := listVolumeMigrations(ns.client)
+	if err != nil {
+		glog.V(3).Infof("migrateVolumes: failed to list LVMVolumeMigrations: %v", err)
+		return
+	}
+	active := map[string]bool{}
+	for i := range migrations {
+		m := &migrations[i]
+		phase := m.Status.Phase
+		if phase != MigrationPhaseCompleted && phase != MigrationPhaseFailed {
+			active[m.Name] = true
+		}
+		isTarget := m.Spec.TargetNode == ns.GetNodeID()
+		isSource := m.Status.SourceNode == ns.GetNodeID()
+		switch {
+		case (phase == "" || phase == MigrationPhasePending) && !isTarget:
+			if node, err := getVolumeNode(ns.client, m.Spec.VolumeName); err == nil && node == ns.GetNodeID() {
+				ns.startMigration(m)
+			}
+		case phase == MigrationPhaseCopying && isTarget:
+			ns.copyVolume(m)
+		case phase == MigrationPhaseCopying && isSource:
+			ns.checkMigrationSnapshot(m)
+		case (phase == MigrationPhaseSyncing || phase == MigrationPhaseRebinding) && isSource:
+			ns.removeMigrationSnapshot(m)
+		case phase == MigrationPhaseSyncing && isTarget:
+			ns.syncVolume(m)
+		case phase == MigrationPhaseRebinding && isTarget:
+			ns.rebindVolume(m)
+		case phase == MigrationPhaseCleaningUp && isSource:
+			ns.finishMigration(m)
+		case phase == MigrationPhaseFailed && isSource:
+			ns.deleteMigrationSecret(m.Name)
+		}
+	}
+	ns.removeMigrationLeftovers(active)
+}
+
+// startMigration validates a migration from the node, snapshots the LV
+// and starts serving it.
+func (ns *nodeServer) startMigration(m *LVMVolumeMigration) {
+	pv, err := getPV(ns.client, m.Spec.VolumeName)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	lvName := pv.Name
+	switch {
+	case m.Spec.TargetNode == "":
+		ns.failMigration(m, fmt.Errorf("no target node given"))
+		return
+	case getVolumeAttribute(pv, lvNameKey) != "":
+		ns.failMigration(m, fmt.Errorf("pv %s imports an existing LV, which cannot be migrated", pv.Name))
+		return
+	case ns.migrationAddress == "":
+		ns.failMigration(m, fmt.Errorf("node %s does not serve migrations, see --migration-address", ns.GetNodeID()))
+		return
+	}
+	if _, err := getNode(ns.client, m.Spec.TargetNode); err != nil {
+		ns.failMigration(m, fmt.Errorf("target node: %v", err))
+		return
+	}
+	lv, err := ns.getVolume(context.Background(), ns.vgName, lvName)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if getTagValue(lv.GetTags(), cacheTagPrefix) != "" {
+		ns.failMigration(m, fmt.Errorf("volume %s is cached, which is not supported by migrations", lvName))
+		return
+	}
+	endpoint, err := ns.getMigrationEndpoint()
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if _, err := ns.getOrCreateMigrationSecret(m); err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	snapshot := lvName + migrationSnapshotSuffix
+	if _, err := ns.getVolume(context.Background(), ns.vgName, snapshot); err != nil {
+		glog.Infof("Snapshotting %s/%s for migration %s", ns.vgName, lvName, m.Name)
+		_, err := runLVM("lvcreate", "-y", "-s", "-n", snapshot, "-l", migrationSnapshotSize,
+			"--addtag", migrationTagPrefix+m.Name, fmt.Sprintf("%s/%s", ns.vgName, lvName))
+		if err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+	}
+
+	var tags []string
+	for _, tag := range lv.GetTags() {
+		if !strings.HasPrefix(tag, migrationTagPrefix) && !strings.HasPrefix(tag, wipeTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	err = updateMigrationStatus(ns.client, m.Name, m.Status.Phase, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseCopying
+		s.SourceNode = ns.GetNodeID()
+		s.Endpoint = endpoint
+		s.SizeBytes = int64(lv.GetSize())
+		s.SourceTags = tags
+		s.Message = ""
+		now := metav1.Now()
+		s.StartTime = &now
+	})
+	if err != nil {
+		glog.Errorf("Failed to start migration %s: %v", m.Name, err)
+		return
+	}
+	ns.recorder.Eventf(pv, v1.EventTypeNormal, "MigrationStarted", "Migrating volume from %s to %s", ns.GetNodeID(), m.Spec.TargetNode)
+}
+
+// checkMigrationSnapshot fails a migration whose snapshot overflowed
+// while it is copied, the copy would be corrupt.
+func (ns *nodeServer) checkMigrationSnapshot(m *LVMVolumeMigration) {
+	snapshot := fmt.Sprintf("%s/%s", ns.vgName, m.Spec.VolumeName+migrationSnapshotSuffix)
+	lvs, err := lvsReport(snapshot, "lv_attr", "snap_percent")
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if len(lvs) == 0 {
+		ns.failMigration(m, fmt.Errorf("snapshot %s is gone", snapshot))
+		return
+	}
+	if isSnapshotInvalid(lvs[0]) {
+		ns.failMigration(m, fmt.Errorf("snapshot %s overflowed, the volume was written more than %s of its size while copying", snapshot, migrationSnapshotSize))
+	}
+}
+
+// isSnapshotInvalid tells from the lv_attr and snap_percent of a snapshot
+// whether it overflowed.
+func isSnapshotInvalid(lv map[string]string) bool {
+	if attr := lv["lv_attr"]; len(attr) > 4 && attr[4] == 'I' {
+		return true
+	}
+	percent, err := strconv.ParseFloat(lv["snap_percent"], 64)
+	return err == nil && percent >= 100
+}
+
+// removeMigrationSnapshot removes the snapshot of the source once it is
+// copied, the target resynchronizes from the source itself.
+func (ns *nodeServer) removeMigrationSnapshot(m *LVMVolumeMigration) {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("migrateVolumes: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	name := m.Spec.VolumeName + migrationSnapshotSuffix
+	lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", ns.vgName, name))
+	if err != nil || len(lvs) == 0 {
+		// lvmd fails to list volumes which do not exist
+		return
+	}
+	if lvs[0].GetAttributes().GetOpen() {
+		glog.V(3).Infof("Snapshot %s/%s of migration %s is still open", ns.vgName, name, m.Name)
+		return
+	}
+	glog.Infof("Removing %s/%s of migration %s", ns.vgName, name, m.Name)
+	if err := conn.RemoveLV(ctx, ns.vgName, name); err != nil {
+		glog.Errorf("Failed to remove snapshot of migration %s: %v", m.Name, err)
+	}
+}
+
+// copyVolume creates the LV on the target and copies the snapshot of the
+// source into it.
+func (ns *nodeServer) copyVolume(m *LVMVolumeMigration) {
+	pv, err := getPV(ns.client, m.Spec.VolumeName)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if err := ns.createMigrationVolume(m, pv); err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	client, err := ns.newMigrationClient(m)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+
+	devicePath := filepath.Join("/dev/", ns.vgName, pv.Name)
+	glog.Infof("Copying %s from %s for migration %s", devicePath, m.Status.SourceNode, m.Name)
+	body, err := client.get("data")
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	defer body.Close()
+	device, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	defer device.Close()
+	progress := &migrationProgress{ns: ns, m: m, w: device, last: time.Now()}
+	n, err := io.Copy(progress, body)
+	if err == nil && n != m.Status.SizeBytes {
+		err = fmt.Errorf("copied %d of %d bytes", n, m.Status.SizeBytes)
+	}
+	if err == nil {
+		err = device.Sync()
+	}
+	if err != nil {
+		ns.setMigrationMessage(m, fmt.Errorf("failed to copy %s: %v", devicePath, err))
+		return
+	}
+
+	err = updateMigrationStatus(ns.client, m.Name, MigrationPhaseCopying, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseSyncing
+		s.BytesCopied = n
+		s.Message = fmt.Sprintf("waiting for the volume to be no longer used on %s", m.Status.SourceNode)
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+	}
+}
+
+// createMigrationVolume creates the LV receiving the copy unless it was
+// created by an earlier attempt.
+func (ns *nodeServer) createMigrationVolume(m *LVMVolumeMigration, pv *v1.PersistentVolume) error {
+	if lv, err := ns.getVolume(context.Background(), ns.vgName, pv.Name); err == nil {
+		if getTagValue(lv.GetTags(), migrationTagPrefix) != m.Name {
+			return fmt.Errorf("volume %s/%s already exists on %s", ns.vgName, pv.Name, ns.GetNodeID())
+		}
+		return nil
+	}
+	placement, err := ns.getVolumePlacement(pv)
+	if err != nil {
+		return err
+	}
+	ns.createMutex.Lock()
+	defer ns.createMutex.Unlock()
+	size := uint64(m.Status.SizeBytes)
+	pvs, err := placement.selectPVs(ns.vgName, size)
+	if err != nil {
+		return err
+	}
+	opt := &lvmd.LVMOptions{
+		VolumeGroup: ns.vgName,
+		Name:        pv.Name,
+		Size:        size,
+		Tags:        append(append([]string{}, m.Status.SourceTags...), migrationTagPrefix+m.Name),
+		PVs:         pvs,
+	}
+	glog.Infof("Creating %s/%s for migration %s", ns.vgName, pv.Name, m.Name)
+	if len(pvs) > 0 {
+		return lvCreate(opt)
+	}
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.CreateLV(context.Background(), opt)
+	return err
+}
+
+// migrationProgress reports the bytes copied every 30 seconds.
+type migrationProgress struct {
+	ns     *nodeServer
+	m      *LVMVolumeMigration
+	w      io.Writer
+	copied int64
+	last   time.Time
+}
+
+func (p *migrationProgress) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.copied += int64(n)
+	if err == nil && time.Since(p.last) > 30*time.Second {
+		p.last = time.Now()
+		err = updateMigrationStatus(p.ns.client, p.m.Name, MigrationPhaseCopying, func(s *LVMVolumeMigrationStatus) {
+			s.BytesCopied = p.copied
+			s.Message = ""
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			// keep copying unless the migration is gone, the progress
+			// is only informational
+			glog.Errorf("Failed to update status of migration %s: %v", p.m.Name, err)
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// syncVolume copies the chunks which differ from the source once it is no
+// longer in use, then verifies the copy and rebinds the PV.
+func (ns *nodeServer) syncVolume(m *LVMVolumeMigration) {
+	client, err := ns.newMigrationClient(m)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	var source []string
+	if err := client.getJSON("checksums", &source); err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+
+	devicePath := filepath.Join("/dev/", ns.vgName, m.Spec.VolumeName)
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	defer device.Close()
+	local, err := chunkChecksums(device)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if len(local) != len(source) {
+		ns.failMigration(m, fmt.Errorf("source has %d chunks, copy %d", len(source), len(local)))
+		return
+	}
+	resynced := 0
+	for i := range source {
+		if local[i] == source[i] {
+			continue
+		}
+		if err := client.copyChunk(i, device); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		resynced++
+	}
+	if err := device.Sync(); err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+
+	// Verify the whole copy, not only the chunks written last.
+	if local, err = chunkChecksums(device); err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	for i := range source {
+		if local[i] != source[i] {
+			ns.setMigrationMessage(m, fmt.Errorf("verification failed: chunk %d differs from the source, retrying", i))
+			return
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(source, "")))
+	glog.Infof("Verified copy of %s for migration %s, %d chunks resynchronized", devicePath, m.Name, resynced)
+
+	err = updateMigrationStatus(ns.client, m.Name, MigrationPhaseSyncing, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseRebinding
+		s.ChunksResynced = resynced
+		s.Checksum = hex.EncodeToString(sum[:])
+		s.Message = ""
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+		return
+	}
+	m.Status.Phase = MigrationPhaseRebinding
+	ns.rebindVolume(m)
+}
+
+// chunkChecksums returns the SHA-256 of each chunk of device.
+func chunkChecksums(device io.ReaderAt) ([]string, error) {
+	var sums []string
+	buf := make([]byte, migrationChunkSize)
+	for offset := int64(0); ; offset += migrationChunkSize {
+		n, err := device.ReadAt(buf, offset)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			sums = append(sums, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rebindVolume points the PV to the target. The node affinity of PVs
+// cannot be changed, so the PV is deleted and created again with the same
+// claim, keeping a copy in the secret of the migration in between.
+func (ns *nodeServer) rebindVolume(m *LVMVolumeMigration) {
+	node, err := getNode(ns.client, ns.GetNodeID())
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	nodeAffinity, err := generateNodeAffinity(node)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	pv, err := getPV(ns.client, m.Spec.VolumeName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if err == nil && pv.Annotations[lvmNodeAnnKey] != ns.GetNodeID() {
+		if pv.DeletionTimestamp != nil {
+			ns.setMigrationMessage(m, fmt.Errorf("waiting for pv %s to be deleted", pv.Name))
+			return
+		}
+		if err := ns.savePV(m, pv); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		// Keep the volume when the PV goes and let it go right away.
+		pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+		pv.Finalizers = nil
+		if pv, err = updatePV(ns.client, pv); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		glog.Infof("Recreating pv %s on %s for migration %s", pv.Name, ns.GetNodeID(), m.Name)
+		uid := pv.UID
+		err := ns.client.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !apierrors.IsNotFound(err) {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		pv = nil
+	} else if err != nil {
+		pv = nil
+	}
+	if pv == nil {
+		saved, err := ns.loadPV(m)
+		if err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		saved.Annotations[lvmNodeAnnKey] = ns.GetNodeID()
+		saved.Spec.NodeAffinity = nodeAffinity
+		if pv, err = ns.client.CoreV1().PersistentVolumes().Create(saved); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+	}
+
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	defer conn.Close()
+	err = conn.RemoveTagLV(context.Background(), ns.vgName, pv.Name, []string{migrationTagPrefix + m.Name})
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	err = updateMigrationStatus(ns.client, m.Name, MigrationPhaseRebinding, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseCleaningUp
+		s.Message = ""
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+	}
+}
+
+// finishMigration removes the LV on the source, and the snapshot if still
+// there, once the PV is bound to the target.
+func (ns *nodeServer) finishMigration(m *LVMVolumeMigration) {
+	pv, err := getPV(ns.client, m.Spec.VolumeName)
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	if pv.Annotations[lvmNodeAnnKey] != m.Spec.TargetNode {
+		ns.setMigrationMessage(m, fmt.Errorf("pv %s is not bound to %s", pv.Name, m.Spec.TargetNode))
+		return
+	}
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		ns.setMigrationMessage(m, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	for _, name := range []string{pv.Name + migrationSnapshotSuffix, pv.Name} {
+		lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", ns.vgName, name))
+		if err != nil || len(lvs) == 0 {
+			// lvmd fails to list volumes which do not exist
+			continue
+		}
+		if lvs[0].GetAttributes().GetOpen() {
+			ns.setMigrationMessage(m, fmt.Errorf("volume %s/%s is still open on %s", ns.vgName, name, ns.GetNodeID()))
+			return
+		}
+		if name == pv.Name {
+			if policy := getVolumeAttribute(pv, wipePolicyKey); policy != "" && policy != wipePolicyNone {
+				if err := wipeDevice(filepath.Join("/dev/", ns.vgName, name), policy); err != nil {
+					ns.setMigrationMessage(m, err)
+					return
+				}
+			}
+		}
+		// the volume lives on on the target node, which carries its tags
+		if err := unprotectCopy(ctx, conn, ns.vgName, lvs[0]); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+		glog.Infof("Removing %s/%s of migration %s", ns.vgName, name, m.Name)
+		if err := conn.RemoveLV(ctx, ns.vgName, name); err != nil {
+			ns.setMigrationMessage(m, err)
+			return
+		}
+	}
+	ns.deleteMigrationSecret(m.Name)
+
+	err = updateMigrationStatus(ns.client, m.Name, MigrationPhaseCleaningUp, func(s *LVMVolumeMigrationStatus) {
+		s.Phase = MigrationPhaseCompleted
+		s.Message = ""
+		now := metav1.Now()
+		s.CompletionTime = &now
+	})
+	if err != nil {
+		glog.Errorf("Failed to update status of migration %s: %v", m.Name, err)
+		return
+	}
+	message := fmt.Sprintf("Migrated volume from %s to %s", ns.GetNodeID(), m.Spec.TargetNode)
+	ns.recorder.Event(pv, v1.EventTypeNormal, "VolumeMigrated", message)
+	if pv.Spec.ClaimRef != nil {
+		ns.recorder.Event(pv.Spec.ClaimRef, v1.EventTypeNormal, "VolumeMigrated", message)
+	}
+}
+
+// removeMigrationLeftovers removes the snapshots and partial copies of the
+// node whose migration failed or was deleted.
+func (ns *nodeServer) removeMigrationLeftovers(active map[string]bool) {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("migrateVolumes: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lvs, err := conn.ListLV(ctx, ns.vgName)
+	if err != nil {
+		glog.Errorf("migrateVolumes: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	for _, lv := range lvs {
+		name := getTagValue(lv.GetTags(), migrationTagPrefix)
+		if name == "" || active[name] {
+			continue
+		}
+		if err := ns.removeMigrationLeftover(ctx, conn, lv, name); err != nil {
+			glog.Errorf("migrateVolumes: %v", err)
+		}
+	}
+}
+
+func (ns *nodeServer) removeMigrationLeftover(ctx context.Context, conn lvmd.LVMConnection, lv *lvmdproto.LogicalVolume, migration string) error {
+	if !strings.HasSuffix(lv.GetName(), migrationSnapshotSuffix) {
+		node, err := getVolumeNode(ns.client, lv.GetName())
+		if err != nil {
+			return err
+		}
+		if node == ns.GetNodeID() {
+			// the PV was rebound before the migration went away
+			return conn.RemoveTagLV(ctx, ns.vgName, lv.GetName(), []string{migrationTagPrefix + migration})
+		}
+	}
+	if lv.GetAttributes().GetOpen() {
+		return fmt.Errorf("volume %s/%s of migration %s is still open", ns.vgName, lv.GetName(), migration)
+	}
+	if err := unprotectCopy(ctx, conn, ns.vgName, lv); err != nil {
+		return err
+	}
+	glog.Infof("Removing %s/%s left over by migration %s", ns.vgName, lv.GetName(), migration)
+	return conn.RemoveLV(ctx, ns.vgName, lv.GetName())
+}
+
+// checkMigration refuses to publish a volume whose migration from the
+// node is resynchronizing or rebinding it, the copy would miss the writes.
+func (ns *nodeServer) checkMigration(volumeId string) error {
+	migrations, err := listVolumeMigrations(ns.client)
+	if err != nil {
+		// the resource may not be defined
+		glog.V(5).Infof("Failed to list LVMVolumeMigrations: %v", err)
+		return nil
+	}
+	for _, m := range migrations {
+		if m.Spec.VolumeName != volumeId || m.Status.SourceNode != ns.GetNodeID() {
+			continue
+		}
+		switch m.Status.Phase {
+		case MigrationPhaseSyncing, MigrationPhaseRebinding, MigrationPhaseCleaningUp:
+			return status.Errorf(codes.FailedPrecondition, "Volume %s is being migrated to %s by %s", volumeId, m.Spec.TargetNode, m.Name)
+		}
+	}
+	return nil
+}
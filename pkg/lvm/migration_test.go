@@ -0,0 +1,353 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+type failingReader struct {
+	failAt int64
+}
+
+func (r *failingReader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.failAt {
+		return 0, errors.New("input/output error")
+	}
+	return len(p), nil
+}
+
+func TestChunkChecksums(t *testing.T) {
+	sum := func(data []byte) string {
+		s := sha256.Sum256(data)
+		return hex.EncodeToString(s[:])
+	}
+	chunk := func(b byte, n int) []byte {
+		return bytes.Repeat([]byte{b}, n)
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []string
+	}{
+		{"empty", nil, nil},
+		{"partial chunk", chunk(1, 100), []string{sum(chunk(1, 100))}},
+		{"one chunk", chunk(1, migrationChunkSize), []string{sum(chunk(1, migrationChunkSize))}},
+		{
+			"last chunk partial",
+			append(chunk(1, migrationChunkSize), chunk(2, 10)...),
+			[]string{sum(chunk(1, migrationChunkSize)), sum(chunk(2, 10))},
+		},
+		{
+			"two chunks",
+			append(chunk(1, migrationChunkSize), chunk(2, migrationChunkSize)...),
+			[]string{sum(chunk(1, migrationChunkSize)), sum(chunk(2, migrationChunkSize))},
+		},
+	}
+	for _, test := range tests {
+		sums, err := chunkChecksums(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(sums, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, sums)
+		}
+	}
+
+	if _, err := chunkChecksums(&failingReader{failAt: migrationChunkSize}); err == nil || err == io.EOF {
+		t.Errorf("expected the read error, got %v", err)
+	}
+}
+
+func TestIsSnapshotInvalid(t *testing.T) {
+	tests := []struct {
+		lv       map[string]string
+		expected bool
+	}{
+		{map[string]string{"lv_attr": "swi-a-s---", "snap_percent": "12.50"}, false},
+		{map[string]string{"lv_attr": "swi-I-s---", "snap_percent": ""}, true},
+		{map[string]string{"lv_attr": "swi-a-s---", "snap_percent": "100.00"}, true},
+		{map[string]string{"lv_attr": "swi", "snap_percent": ""}, false},
+	}
+	for _, test := range tests {
+		if invalid := isSnapshotInvalid(test.lv); invalid != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.lv, test.expected, invalid)
+		}
+	}
+}
+
+// newMigrationTest returns the node server of node with a fake API server
+// holding the PV pvc-1 on node-1 and the nodes node-1 and node-2, and a
+// fake lvmd.
+func newMigrationTest(t *testing.T, node string) (*nodeServer, *fakeAPIServer, *fakeLVMD) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pvc-1",
+			Annotations: map[string]string{lvmNodeAnnKey: "node-1"},
+			Finalizers:  []string{"kubernetes.io/pv-protection"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			ClaimRef:                      &v1.ObjectReference{Namespace: "default", Name: "data", UID: "claim-uid"},
+		},
+	}
+	client, server := newFakeClient(t, pv, lvmdNode("node-1"), lvmdNode("node-2"))
+	ns := &nodeServer{
+		client:    client,
+		recorder:  record.NewFakeRecorder(100),
+		nodeID:    node,
+		vgName:    "k8s",
+		namespace: "kube-system",
+	}
+	return ns, server, newFakeLVMD(t)
+}
+
+// addMigration stores the migration name of pvc-1 from node-1 to node-2
+// in phase, with its secret.
+func addMigration(t *testing.T, ns *nodeServer, server *fakeAPIServer, name, phase string) *LVMVolumeMigration {
+	m := &LVMVolumeMigration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: LVMNodeGroupVersion, Kind: LVMVolumeMigrationKind},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       LVMVolumeMigrationSpec{VolumeName: "pvc-1", TargetNode: "node-2"},
+		Status:     LVMVolumeMigrationStatus{Phase: phase, SourceNode: "node-1"},
+	}
+	server.add(lvmVolumeMigrationsPath+"/"+name, m)
+	if _, err := ns.getOrCreateMigrationSecret(m); err != nil {
+		t.Fatal(err)
+	}
+	return getMigration(t, ns, name)
+}
+
+func getMigration(t *testing.T, ns *nodeServer, name string) *LVMVolumeMigration {
+	m, err := GetVolumeMigration(ns.client, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRebindVolume(t *testing.T) {
+	ns, server, fake := newMigrationTest(t, "node-2")
+	fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-1", Tags: []string{migrationTagPrefix + "move"}})
+	m := addMigration(t, ns, server, "move", MigrationPhaseRebinding)
+
+	// the PV is recreated, but the copy is still tagged
+	fake.failOnce("RemoveTagLV", status.Error(codes.Unavailable, "lvmd restarting"))
+	ns.rebindVolume(m)
+	m = getMigration(t, ns, "move")
+	if m.Status.Phase != MigrationPhaseRebinding || m.Status.Message == "" {
+		t.Fatalf("expected Rebinding with a message, got %s %q", m.Status.Phase, m.Status.Message)
+	}
+	pv, err := getPV(ns.client, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Annotations[lvmNodeAnnKey] != "node-2" || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.UID != "claim-uid" {
+		t.Errorf("expected pv bound to the claim on node-2, got %v %v", pv.Annotations, pv.Spec.ClaimRef)
+	}
+	if pv.Spec.NodeAffinity == nil {
+		t.Errorf("expected the node affinity of node-2")
+	}
+
+	// the next attempt resumes without recreating the PV again
+	ns.rebindVolume(m)
+	m = getMigration(t, ns, "move")
+	if m.Status.Phase != MigrationPhaseCleaningUp {
+		t.Errorf("expected CleaningUp, got %s %q", m.Status.Phase, m.Status.Message)
+	}
+	if again, _ := getPV(ns.client, "pvc-1"); again.UID != pv.UID {
+		t.Errorf("pv was recreated again")
+	}
+	if lv := fake.getLV("k8s", "pvc-1"); len(lv.Tags) != 0 {
+		t.Errorf("expected the migration tag to be removed, got %v", lv.Tags)
+	}
+}
+
+func TestRebindVolumeDeletedPV(t *testing.T) {
+	ns, server, fake := newMigrationTest(t, "node-2")
+	fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-1", Tags: []string{migrationTagPrefix + "move"}})
+	m := addMigration(t, ns, server, "move", MigrationPhaseRebinding)
+
+	// an earlier attempt saved and deleted the PV, then failed
+	pv, err := getPV(ns.client, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.savePV(m, pv); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.client.CoreV1().PersistentVolumes().Delete("pvc-1", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ns.rebindVolume(m)
+	if m = getMigration(t, ns, "move"); m.Status.Phase != MigrationPhaseCleaningUp {
+		t.Fatalf("expected CleaningUp, got %s %q", m.Status.Phase, m.Status.Message)
+	}
+	pv, err = getPV(ns.client, "pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Annotations[lvmNodeAnnKey] != "node-2" || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name != "data" {
+		t.Errorf("expected pv bound to the claim on node-2, got %v %v", pv.Annotations, pv.Spec.ClaimRef)
+	}
+}
+
+func TestMigrateVolumesSource(t *testing.T) {
+	ns, server, fake := newMigrationTest(t, "node-1")
+	fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-1", Attributes: &lvmdproto.LogicalVolume_Attributes{}})
+	fake.addLV("k8s", &lvmdproto.LogicalVolume{
+		Name:       "pvc-1" + migrationSnapshotSuffix,
+		Tags:       []string{migrationTagPrefix + "move"},
+		Attributes: &lvmdproto.LogicalVolume_Attributes{},
+	})
+	addMigration(t, ns, server, "move", MigrationPhaseSyncing)
+
+	// the snapshot goes once copied
+	ns.migrateVolumes()
+	if fake.getLV("k8s", "pvc-1"+migrationSnapshotSuffix) != nil {
+		t.Errorf("expected the snapshot to be removed while syncing")
+	}
+	if fake.getLV("k8s", "pvc-1") == nil {
+		t.Fatalf("expected the source to stay while syncing")
+	}
+
+	// the source stays until the PV is bound to the target
+	server.add(lvmVolumeMigrationsPath+"/move", getMigrationWithPhase(t, ns, "move", MigrationPhaseCleaningUp))
+	ns.migrateVolumes()
+	if m := getMigration(t, ns, "move"); m.Status.Phase != MigrationPhaseCleaningUp || fake.getLV("k8s", "pvc-1") == nil {
+		t.Fatalf("expected the source to stay, got %s", m.Status.Phase)
+	}
+	pv, _ := getPV(ns.client, "pvc-1")
+	pv.Annotations[lvmNodeAnnKey] = "node-2"
+	if _, err := updatePV(ns.client, pv); err != nil {
+		t.Fatal(err)
+	}
+	ns.migrateVolumes()
+	if m := getMigration(t, ns, "move"); m.Status.Phase != MigrationPhaseCompleted || m.Status.CompletionTime == nil {
+		t.Errorf("expected Completed, got %s %q", m.Status.Phase, m.Status.Message)
+	}
+	if fake.getLV("k8s", "pvc-1") != nil {
+		t.Errorf("expected the source to be removed")
+	}
+	if _, err := ns.getMigrationSecret("move"); err == nil {
+		t.Errorf("expected the secret to be deleted")
+	}
+}
+
+func TestMigrateVolumesFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		pv     func(*v1.PersistentVolume)
+	}{
+		{"no target", "", nil},
+		{"unknown target", "node-3", nil},
+		{"imported volume", "node-2", func(pv *v1.PersistentVolume) {
+			pv.Spec.CSI = &v1.CSIPersistentVolumeSource{VolumeAttributes: map[string]string{lvNameKey: "data"}}
+		}},
+	}
+	for _, test := range tests {
+		ns, server, fake := newMigrationTest(t, "node-1")
+		ns.migrationAddress = ":9154"
+		fake.addLV("k8s", &lvmdproto.LogicalVolume{Name: "pvc-1", Attributes: &lvmdproto.LogicalVolume_Attributes{}})
+		if test.pv != nil {
+			pv, _ := getPV(ns.client, "pvc-1")
+			test.pv(pv)
+			if _, err := updatePV(ns.client, pv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server.add(lvmVolumeMigrationsPath+"/move", &LVMVolumeMigration{
+			ObjectMeta: metav1.ObjectMeta{Name: "move"},
+			Spec:       LVMVolumeMigrationSpec{VolumeName: "pvc-1", TargetNode: test.target},
+		})
+		ns.migrateVolumes()
+		if m := getMigration(t, ns, "move"); m.Status.Phase != MigrationPhaseFailed || m.Status.Message == "" {
+			t.Errorf("%s: expected Failed with a message, got %s %q", test.name, m.Status.Phase, m.Status.Message)
+		}
+		if fake.getLV("k8s", "pvc-1") == nil {
+			t.Errorf("%s: expected the volume to stay", test.name)
+		}
+	}
+}
+
+// getMigrationWithPhase returns the migration name moved to phase.
+func getMigrationWithPhase(t *testing.T, ns *nodeServer, name, phase string) *LVMVolumeMigration {
+	m := getMigration(t, ns, name)
+	m.Status.Phase = phase
+	return m
+}
+
+func TestServeMigration(t *testing.T) {
+	ns, server, _ := newMigrationTest(t, "node-1")
+	addMigration(t, ns, server, "syncing", MigrationPhaseSyncing)
+	addMigration(t, ns, server, "copying", MigrationPhaseCopying)
+	other := addMigration(t, ns, server, "other", MigrationPhaseSyncing)
+	other.Status.SourceNode = "node-2"
+	server.add(lvmVolumeMigrationsPath+"/other", other)
+	token := func(name string) string {
+		secret, err := ns.getMigrationSecret(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(secret.Data[migrationTokenKey])
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"unknown migration", http.MethodGet, "/migrations/unknown/checksums", token("syncing"), http.StatusNotFound},
+		{"other source", http.MethodGet, "/migrations/other/checksums", token("other"), http.StatusNotFound},
+		{"no token", http.MethodGet, "/migrations/syncing/checksums", "", http.StatusUnauthorized},
+		{"token of another migration", http.MethodGet, "/migrations/syncing/checksums", token("copying"), http.StatusUnauthorized},
+		{"data while syncing", http.MethodGet, "/migrations/syncing/data", token("syncing"), http.StatusConflict},
+		{"checksums while copying", http.MethodGet, "/migrations/copying/checksums", token("copying"), http.StatusConflict},
+		{"chunk while copying", http.MethodGet, "/migrations/copying/chunks/0", token("copying"), http.StatusConflict},
+		{"invalid chunk", http.MethodGet, "/migrations/syncing/chunks/first", token("syncing"), http.StatusBadRequest},
+		{"unknown resource", http.MethodGet, "/migrations/syncing/volume", token("syncing"), http.StatusNotFound},
+		{"not a get", http.MethodPost, "/migrations/syncing/data", token("syncing"), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		ns.serveMigration(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d: %s", test.name, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,439 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	utilnode "k8s.io/kubernetes/pkg/util/node"
+)
+
+// The node plugins transfer volumes over HTTPS. The source creates a
+// self-signed certificate and a token for each migration and keeps them
+// in a secret of the driver namespace, owned by the migration. The target
+// trusts only that certificate and authenticates with the token.
+const (
+	migrationSecretPrefix = "csi-lvm-migration-"
+
+	migrationCertKey  = "tls.crt"
+	migrationKeyKey   = "tls.key"
+	migrationTokenKey = "token"
+	// migrationPVKey holds the PV while it is recreated for the target.
+	migrationPVKey = "pv"
+
+	migrationCertValidity = 30 * 24 * time.Hour
+)
+
+func migrationSecretName(migration string) string {
+	return migrationSecretPrefix + migration
+}
+
+func (ns *nodeServer) getMigrationSecret(migration string) (*v1.Secret, error) {
+	return ns.client.CoreV1().Secrets(ns.namespace).Get(migrationSecretName(migration), metav1.GetOptions{})
+}
+
+func (ns *nodeServer) getOrCreateMigrationSecret(m *LVMVolumeMigration) (*v1.Secret, error) {
+	secret, err := ns.getMigrationSecret(m.Name)
+	if !apierrors.IsNotFound(err) {
+		return secret, err
+	}
+	cert, key, err := generateMigrationCert(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	secret = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationSecretName(m.Name),
+			Namespace: ns.namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: LVMNodeGroupVersion,
+				Kind:       LVMVolumeMigrationKind,
+				Name:       m.Name,
+				UID:        m.UID,
+			}},
+		},
+		Data: map[string][]byte{
+			migrationCertKey:  cert,
+			migrationKeyKey:   key,
+			migrationTokenKey: []byte(hex.EncodeToString(token)),
+		},
+	}
+	return ns.client.CoreV1().Secrets(ns.namespace).Create(secret)
+}
+
+func (ns *nodeServer) deleteMigrationSecret(migration string) {
+	err := ns.client.CoreV1().Secrets(ns.namespace).Delete(migrationSecretName(migration), &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Errorf("Failed to delete secret of migration %s: %v", migration, err)
+	}
+}
+
+// generateMigrationCert returns a PEM encoded self-signed certificate for
+// the server name migration and its key.
+func generateMigrationCert(migration string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: migration},
+		DNSNames:     []string{migration},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(migrationCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+// savePV keeps pv in the secret of the migration before it is deleted,
+// unless an earlier attempt did so already.
+func (ns *nodeServer) savePV(m *LVMVolumeMigration, pv *v1.PersistentVolume) error {
+	saved := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pv.Name,
+			Labels:      pv.Labels,
+			Annotations: pv.Annotations,
+		},
+		Spec: pv.Spec,
+	}
+	if claim := saved.Spec.ClaimRef; claim != nil {
+		ref := *claim
+		ref.ResourceVersion = ""
+		saved.Spec.ClaimRef = &ref
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := ns.getMigrationSecret(m.Name)
+		if err != nil {
+			return err
+		}
+		if len(secret.Data[migrationPVKey]) > 0 {
+			return nil
+		}
+		secret.Data[migrationPVKey] = data
+		_, err = ns.client.CoreV1().Secrets(ns.namespace).Update(secret)
+		return err
+	})
+}
+
+func (ns *nodeServer) loadPV(m *LVMVolumeMigration) (*v1.PersistentVolume, error) {
+	secret, err := ns.getMigrationSecret(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	data := secret.Data[migrationPVKey]
+	if len(data) == 0 {
+		return nil, fmt.Errorf("pv %s is gone and was not saved by migration %s", m.Spec.VolumeName, m.Name)
+	}
+	pv := &v1.PersistentVolume{}
+	if err := json.Unmarshal(data, pv); err != nil {
+		return nil, err
+	}
+	if pv.Annotations == nil {
+		pv.Annotations = map[string]string{}
+	}
+	return pv, nil
+}
+
+// getMigrationEndpoint returns the URL of the migration server of the
+// node.
+func (ns *nodeServer) getMigrationEndpoint() (string, error) {
+	_, port, err := net.SplitHostPort(ns.migrationAddress)
+	if err != nil {
+		return "", err
+	}
+	node, err := getNode(ns.client, ns.GetNodeID())
+	if err != nil {
+		return "", err
+	}
+	ip, err := utilnode.GetNodeHostIP(node)
+	if err != nil {
+		return "", err
+	}
+	return "https://" + net.JoinHostPort(ip.String(), port), nil
+}
+
+// serveMigrations serves the volumes migrating from the node to the node
+// plugins of their targets.
+func (ns *nodeServer) serveMigrations(address string) {
+	server := &http.Server{
+		Addr:    address,
+		Handler: http.HandlerFunc(ns.serveMigration),
+		TLSConfig: &tls.Config{
+			GetCertificate: ns.getMigrationCertificate,
+		},
+	}
+	glog.Infof("Serving migrations on %s", address)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		glog.Fatalf("Failed to serve migrations: %v", err)
+	}
+}
+
+// getMigrationCertificate returns the certificate of the migration the
+// client asks for by server name.
+func (ns *nodeServer) getMigrationCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	secret, err := ns.getMigrationSecret(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(secret.Data[migrationCertKey], secret.Data[migrationKeyKey])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// serveMigration handles /migrations/<name>/data, the snapshot of the
+// source while copying, and /migrations/<name>/checksums and
+// /migrations/<name>/chunks/<index> of the source itself while syncing.
+func (ns *nodeServer) serveMigration(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) < 3 || parts[0] != "migrations" {
+		http.NotFound(w, r)
+		return
+	}
+	m, err := GetVolumeMigration(ns.client, parts[1])
+	if err != nil || m.Status.SourceNode != ns.GetNodeID() {
+		http.NotFound(w, r)
+		return
+	}
+	secret, err := ns.getMigrationSecret(m.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), secret.Data[migrationTokenKey]) != 1 {
+		glog.Warningf("Rejected unauthenticated request for migration %s from %s", m.Name, r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	devicePath := filepath.Join("/dev/", ns.vgName, m.Spec.VolumeName)
+	switch {
+	case parts[2] == "data" && m.Status.Phase != MigrationPhaseCopying,
+		parts[2] != "data" && m.Status.Phase != MigrationPhaseSyncing:
+		http.Error(w, fmt.Sprintf("migration %s is %s", m.Name, m.Status.Phase), http.StatusConflict)
+	case parts[2] == "data":
+		snapshot := fmt.Sprintf("%s/%s", ns.vgName, m.Spec.VolumeName+migrationSnapshotSuffix)
+		if lvs, err := lvsReport(snapshot, "lv_attr", "snap_percent"); err != nil || len(lvs) == 0 || isSnapshotInvalid(lvs[0]) {
+			http.Error(w, fmt.Sprintf("snapshot %s is not valid", snapshot), http.StatusGone)
+			return
+		}
+		ns.serveMigrationData(w, m, devicePath+migrationSnapshotSuffix)
+	case parts[2] == "checksums":
+		if ns.isVolumeClosed(w, m) {
+			serveChecksums(w, devicePath)
+		}
+	case parts[2] == "chunks" && len(parts) == 4:
+		index, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ns.isVolumeClosed(w, m) {
+			serveChunk(w, devicePath, index)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveChecksums(w http.ResponseWriter, devicePath string) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer device.Close()
+	sums, err := chunkChecksums(device)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sums)
+}
+
+func serveChunk(w http.ResponseWriter, devicePath string, index int64) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer device.Close()
+	buf := make([]byte, migrationChunkSize)
+	n, err := device.ReadAt(buf, index*migrationChunkSize)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf[:n])
+}
+
+func (ns *nodeServer) serveMigrationData(w http.ResponseWriter, m *LVMVolumeMigration, devicePath string) {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer device.Close()
+	glog.Infof("Sending %s for migration %s", devicePath, m.Name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(m.Status.SizeBytes, 10))
+	if _, err := io.CopyN(w, device, m.Status.SizeBytes); err != nil {
+		glog.Errorf("Failed to send %s for migration %s: %v", devicePath, m.Name, err)
+	}
+}
+
+// isVolumeClosed replies with a conflict if the source LV of m is still in
+// use and may change.
+func (ns *nodeServer) isVolumeClosed(w http.ResponseWriter, m *LVMVolumeMigration) bool {
+	lv, err := ns.getVolume(context.Background(), ns.vgName, m.Spec.VolumeName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if lv.GetAttributes().GetOpen() {
+		http.Error(w, fmt.Sprintf("waiting for the volume to be no longer used on %s", ns.GetNodeID()), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// migrationClient requests the volume of a migration from its source.
+type migrationClient struct {
+	m      *LVMVolumeMigration
+	token  string
+	client *http.Client
+}
+
+func (ns *nodeServer) newMigrationClient(m *LVMVolumeMigration) (*migrationClient, error) {
+	secret, err := ns.getMigrationSecret(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(secret.Data[migrationCertKey]) {
+		return nil, fmt.Errorf("invalid certificate in secret of migration %s", m.Name)
+	}
+	return &migrationClient{
+		m:     m,
+		token: string(secret.Data[migrationTokenKey]),
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:    roots,
+					ServerName: m.Name,
+				},
+				TLSHandshakeTimeout: connectTimeout,
+			},
+		},
+	}, nil
+}
+
+// get returns the body of the resource path of the migration.
+func (c *migrationClient) get(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/migrations/%s/%s", c.m.Status.Endpoint, c.m.Name, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("source %s: %s", c.m.Status.SourceNode, strings.TrimSpace(string(message)))
+	}
+	return resp.Body, nil
+}
+
+func (c *migrationClient) getJSON(path string, v interface{}) error {
+	body, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+// copyChunk copies the chunk index of the source to device.
+func (c *migrationClient) copyChunk(index int, device io.WriterAt) error {
+	body, err := c.get("chunks/" + strconv.Itoa(index))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, migrationChunkSize))
+	if err != nil {
+		return err
+	}
+	_, err = device.WriteAt(data, int64(index)*migrationChunkSize)
+	return err
+}
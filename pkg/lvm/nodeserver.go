@@ -21,10 +21,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/net/context"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume/util"
 
@@ -33,15 +36,28 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
-	client kubernetes.Interface
-	nodeID string
-	vgName string
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	nodeID   string
+	vgName   string
+
+	// namespace holds the secrets of migrations, migrationAddress is
+	// where the node serves volumes migrating away, if set.
+	namespace        string
+	migrationAddress string
+
+	reservations *reservationLedger
+	health       *healthMonitor
+
+	// createMutex serializes the creation of volumes on the node.
+	createMutex sync.Mutex
 }
 
 func (ns *nodeServer) GetNodeID() string {
@@ -51,43 +67,106 @@ func (ns *nodeServer) GetNodeID() string {
 func (ns *nodeServer) createVolume(ctx context.Context, volumeId string) (*v1.PersistentVolume, error) {
 	pv, err := getPV(ns.client, volumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Failed to get pv by volumeId %s: %s", volumeId, err))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Failed to get pv by volumeId %s: %s", volumeId, err))
 	}
 	node, err := getNode(ns.client, ns.GetNodeID())
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get node by nodeId %s: %s", ns.GetNodeID(), err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get node by nodeId %s: %s", ns.GetNodeID(), err))
 	}
 
 	nodeAffinityAnn, err := generateNodeAffinity(node)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to generate node affinity annotations for %v: %v", node.GetName(), err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to generate node affinity annotations for %v: %v", node.GetName(), err))
 	}
 	cap := pv.Spec.Capacity[v1.ResourceStorage]
 	size := cap.Value()
 
-	addr, err := getLVMDAddr(ns.client, ns.GetNodeID())
+	var attributes map[string]string
+	if pv.Spec.CSI != nil {
+		attributes = pv.Spec.CSI.VolumeAttributes
+	}
+	cache, err := getCacheOptions(attributes)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to getLVMDAddr for %v: %v", node, err))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	conn, err := lvmd.NewLVMConnection(addr, connectTimeout)
-	defer conn.Close()
+	placement, err := ns.getVolumePlacement(pv)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to connect to %v: %v", addr, err))
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := checkCachePlacement(cache, placement); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	resp, err := conn.CreateLV(ctx, &lvmd.LVMOptions{
-		VolumeGroup: ns.vgName,
-		Name:        volumeId,
-		Size:        uint64(size),
-	})
-	glog.V(3).Infof("CreateLV: %v", resp)
+	tags := append(placement.tags(), createWipeTags(attributes[createWipePolicyKey])...)
 
+	// volumes of an anti-affinity group must see each other's placement
+	ns.createMutex.Lock()
+	defer ns.createMutex.Unlock()
+	pvs, err := placement.selectPVs(ns.vgName, uint64(size))
 	if err != nil {
-		return nil, status.Errorf(
-			codes.Internal,
-			"Error in CreateLogicalVolume: err=%v",
-			err)
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err := ns.reserveVolume(ctx, volumeId, size); err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if len(cache.dataPVs) == 0 {
+			cache.dataPVs = pvs
+		}
+		if err := createCachedVolume(ns.vgName, volumeId, uint64(size), tags, cache); err != nil {
+			return nil, status.Errorf(codes.Internal, "Error in creating cached volume: err=%v", err)
+		}
+	} else if len(pvs) > 0 {
+		err := lvCreate(&lvmd.LVMOptions{
+			VolumeGroup: ns.vgName,
+			Name:        volumeId,
+			Size:        uint64(size),
+			Tags:        tags,
+			PVs:         pvs,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Error in CreateLogicalVolume: err=%v", err)
+		}
+	} else {
+		addr, err := getLVMDAddr(ns.client, ns.GetNodeID())
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to getLVMDAddr for %v: %v", node, err))
+		}
+
+		conn, err := lvmd.NewLVMConnection(addr, connectTimeout)
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, fmt.Sprintf("Failed to connect to %v: %v", addr, err))
+		}
+		defer conn.Close()
+
+		resp, err := conn.CreateLV(ctx, &lvmd.LVMOptions{
+			VolumeGroup: ns.vgName,
+			Name:        volumeId,
+			Size:        uint64(size),
+			Tags:        tags,
+		})
+		glog.V(3).Infof("CreateLV: %v", resp)
+
+		if err != nil {
+			return nil, status.Errorf(
+				lvmdCode(err),
+				"Error in CreateLogicalVolume: err=%v",
+				err)
+		}
+	}
+
+	// the space is allocated now
+	if err := ns.reservations.release(volumeId); err != nil {
+		glog.Warningf("Failed to release the reservation of volume %s: %v", volumeId, err)
+	}
+
+	// LVM rounds the size up to whole extents, report the real size
+	if lv, err := ns.getVolume(ctx, ns.vgName, volumeId); err != nil {
+		glog.Warningf("Failed to get size of volume %s: %v", volumeId, err)
+	} else if actual := int64(lv.GetSize()); actual != size {
+		glog.V(3).Infof("Volume %s has %d bytes instead of %d", volumeId, actual, size)
+		pv.Spec.Capacity[v1.ResourceStorage] = *resource.NewQuantity(actual, resource.BinarySI)
 	}
 
 	pv.Spec.NodeAffinity = nodeAffinityAnn
@@ -95,19 +174,94 @@ func (ns *nodeServer) createVolume(ctx context.Context, volumeId string) (*v1.Pe
 	return updatePV(ns.client, pv)
 }
 
+func (ns *nodeServer) getVolume(ctx context.Context, vgName, lvName string) (*lvmdproto.LogicalVolume, error) {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", vgName, lvName))
+	if err != nil {
+		return nil, err
+	}
+	if len(lvs) == 0 {
+		return nil, fmt.Errorf("volume %s/%s not found", vgName, lvName)
+	}
+	return lvs[0], nil
+}
+
+func (ns *nodeServer) addVolumeTag(ctx context.Context, vgName, lvName string, tag string) error {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.AddTagLV(ctx, vgName, lvName, []string{tag})
+}
+
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	targetPath := req.GetTargetPath()
 	// fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	// devicePath := req.GetPublishInfo()["DevicePath"]
 
 	volumeId := req.GetVolumeId()
-	devicePath := filepath.Join("/dev/", ns.vgName, volumeId)
+	attributes := req.GetVolumeAttributes()
+	vgName, lvName := ns.vgName, volumeId
+	imported := attributes[lvNameKey] != ""
+	if imported {
+		lvName = attributes[lvNameKey]
+		if attributes[vgNameKey] != "" {
+			vgName = attributes[vgNameKey]
+		}
+	}
+	devicePath := filepath.Join("/dev/", vgName, lvName)
+	pod := getPodRef(attributes)
 
+	if err := ns.checkMigration(volumeId); err != nil {
+		return nil, err
+	}
+
+	created := false
 	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
-		_, err := ns.createVolume(ctx, volumeId)
-		if err != nil {
+		if imported {
+			return nil, status.Errorf(codes.NotFound, "Imported volume %s/%s does not exist", vgName, lvName)
+		}
+		if err := ns.finishRestore(ctx, volumeId); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to restore volume %s from the trash: %v", volumeId, err)
+		}
+	}
+	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
+		if isEphemeral(attributes) {
+			if err := ns.createEphemeralVolume(ctx, volumeId, getPodUID(attributes, targetPath), attributes); err != nil {
+				ns.reportFailure(volumeId, pod, createFailureReason(err), err.Error())
+				return nil, err
+			}
+		} else if _, err := ns.createVolume(ctx, volumeId); err != nil {
+			ns.reportFailure(volumeId, pod, createFailureReason(err), err.Error())
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		created = true
+	}
+	lv, err := ns.getVolume(ctx, vgName, lvName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	tags := lv.GetTags()
+	if imported && !hasTag(tags, adoptedTag) {
+		// Adopted LVs are never removed by DeleteVolume.
+		glog.Infof("Adopting imported volume %s/%s", vgName, lvName)
+		if err := ns.addVolumeTag(ctx, vgName, lvName, adoptedTag); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to adopt volume %s/%s: %v", vgName, lvName, err)
+		}
+	}
+
+	if err := ns.wipeNewVolume(ctx, vgName, lv); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to wipe new volume %s: %v", devicePath, err)
 	}
 
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
@@ -125,24 +279,51 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	log.Printf("Determining filesystem type at %v", devicePath)
 	existingFstype, err := determineFilesystemType(devicePath)
 	if err != nil {
+		if _, ok := err.(*signatureError); ok {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
 		return nil, status.Errorf(
 			codes.Internal,
 			"Cannot determine filesystem type: err=%v",
 			err)
 	}
 	log.Printf("Existing filesystem type is '%v'", existingFstype)
+	formatted := false
+	// parse the ownership first, a failure after formatting would leave
+	// the filesystem without it
+	ownership, err := pendingOwnership(attributes, tags, imported, existingFstype == "")
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if existingFstype == "" {
+		if hasTag(tags, formattedTag) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s has been formatted before but no filesystem is found on it, refusing to format it again", devicePath)
+		}
+		if attributes[neverFormatKey] == "true" {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s has no filesystem and %s is set", devicePath, neverFormatKey)
+		}
 		// There is no existing filesystem on the
 		// device, format it with the requested
 		// filesystem.
-		log.Printf("The device %v has no existing filesystem, formatting with %v", devicePath, existingFstype)
+		log.Printf("The device %v has no existing filesystem, formatting with %v", devicePath, defaultFs)
 		if err := formatDevice(devicePath, defaultFs); err != nil {
+			ns.reportFailure(volumeId, pod, reasonFormatFailed, err.Error())
 			return nil, status.Errorf(
 				codes.Internal,
 				"formatDevice failed: err=%v",
 				err)
 		}
 		existingFstype = defaultFs
+		formatted = true
+	} else if notMnt && !lv.GetAttributes().GetOpen() {
+		if err := ns.checkFilesystem(volumeId, devicePath, existingFstype, attributes[fsckPolicyKey]); err != nil {
+			return nil, err
+		}
+	}
+	if !hasTag(tags, formattedTag) {
+		if err := ns.addVolumeTag(ctx, vgName, lvName, formattedTag); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to tag volume %s as formatted: %v", devicePath, err)
+		}
 	}
 
 	// Volume Mount
@@ -154,20 +335,71 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		} else {
 			options = append(options, "rw")
 		}
+		options = append(options, getMountOptions(attributes)...)
 		mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 		options = append(options, mountFlags...)
 
 		// Mount
 		mounter := mount.New("")
-		err = mounter.Mount(devicePath, targetPath, defaultFs, options)
+		err = mounter.Mount(devicePath, targetPath, existingFstype, options)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
+	// Until ownedTag records it, set the ownership on every writable
+	// publish, so that a failure or a read-only first publish is retried.
+	if ownership != nil && !req.GetReadonly() {
+		if err := ownership.apply(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to set ownership of %s: %v", targetPath, err)
+		}
+		if err := ns.addVolumeTag(ctx, vgName, lvName, ownedTag); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to tag volume %s as owned: %v", devicePath, err)
+		}
+	}
+
+	if created || formatted {
+		clearFailure(ns.client, volumeId)
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// reportFailure reports a failure to provision volumeId on the node, see
+// reportFailure.
+func (ns *nodeServer) reportFailure(volumeId string, pod *v1.ObjectReference, reason, message string) {
+	reportFailure(ns.client, ns.recorder, ns.GetNodeID(), volumeId, pod, reason, message)
+}
+
+// checkFilesystem checks the filesystem of a volume before it is mounted
+// and reports the result as event of its PVC. It returns an error if the
+// filesystem must not be mounted.
+func (ns *nodeServer) checkFilesystem(volumeId, devicePath, fstype, policy string) error {
+	result, output, err := checkFilesystem(devicePath, fstype, policy)
+	claim := getClaimRef(ns.client, volumeId)
+	event := func(eventtype, reason, messageFmt string, args ...interface{}) {
+		if claim != nil {
+			ns.recorder.Eventf(claim, eventtype, reason, messageFmt, args...)
+		}
+	}
+	if err != nil {
+		event(v1.EventTypeWarning, "FilesystemCheckFailed", "Checking %s on %s failed: %v: %s", fstype, ns.GetNodeID(), err, output)
+		return status.Errorf(codes.Internal, "Failed to check filesystem of %s: %v: %s", devicePath, err, output)
+	}
+	switch result {
+	case fsckClean:
+		event(v1.EventTypeNormal, "FilesystemChecked", "Filesystem %s on %s is clean", fstype, ns.GetNodeID())
+	case fsckRepaired:
+		event(v1.EventTypeWarning, "FilesystemRepaired", "Repaired filesystem %s on %s: %s", fstype, ns.GetNodeID(), output)
+	case fsckSkipped:
+		glog.V(3).Infof("Skipped checking %s: %s", devicePath, output)
+	case fsckCorrupted:
+		event(v1.EventTypeWarning, "FilesystemCorrupted", "Filesystem %s on %s has errors, refusing to mount it: %s", fstype, ns.GetNodeID(), output)
+		return status.Errorf(codes.FailedPrecondition, "Filesystem of %s has uncorrected errors: %s", devicePath, output)
+	}
+	return nil
+}
+
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	targetPath := req.GetTargetPath()
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
@@ -180,6 +412,11 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		}
 	}
 	if notMnt {
+		// Retry removing the ephemeral volume, in case that failed
+		// after unmounting it.
+		if err := ns.removeEphemeralVolume(ctx, req.GetVolumeId()); err != nil {
+			glog.Errorf("Failed to remove ephemeral volume %s: %v", req.GetVolumeId(), err)
+		}
 		return nil, status.Error(codes.NotFound, "Volume not mounted")
 	}
 
@@ -188,6 +425,10 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := ns.removeEphemeralVolume(ctx, req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to remove ephemeral volume %s: %v", req.GetVolumeId(), err)
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fsTypeKey = "fsType"
+
+	// Thin volumes and mirrors are not supported, StorageClasses asking
+	// for them are rejected rather than provisioning plain volumes.
+	thinPoolKey = "thinPool"
+	mirrorsKey  = "mirrors"
+)
+
+// lvmNameRegexp matches the names LVM allows for VGs and LVs.
+var lvmNameRegexp = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.\-]*$`)
+
+// storageClassParameters is the schema of the StorageClass parameters of
+// the driver, mapping each of them to a check of its value. Parameters
+// depending on each other are checked by validateParameters.
+var storageClassParameters = map[string]func(string) error{
+	fsTypeKey:            checkFsType,
+	vgNameKey:            checkVGName,
+	thinPoolKey:          unsupportedParameter(thinPoolKey),
+	mirrorsKey:           unsupportedParameter(mirrorsKey),
+	wipePolicyKey:        checkWipePolicy,
+	createWipePolicyKey:  checkCreateWipePolicy,
+	fsckPolicyKey:        checkFsckPolicy,
+	mountOptionsKey:      nil,
+	rootUIDKey:           checkRootOwnership(rootUIDKey),
+	rootGIDKey:           checkRootOwnership(rootGIDKey),
+	rootModeKey:          checkRootOwnership(rootModeKey),
+	trashTTLKey:          checkTrashTTL,
+	pvTagsKey:            nil,
+	antiAffinityGroupKey: nil,
+	cacheTypeKey:         nil,
+	cacheSizeKey:         nil,
+	cacheModeKey:         nil,
+	cachePVsKey:          nil,
+	dataPVsKey:           nil,
+	minSizeKey:           nil,
+	maxSizeKey:           nil,
+	sizeGranularityKey:   nil,
+}
+
+// reservedParameterPrefixes are the prefixes of parameters interpreted by
+// Kubernetes and the external provisioner rather than by the driver.
+var reservedParameterPrefixes = []string{
+	"csi.storage.k8s.io/",
+	"csiProvisionerSecret",
+	"csiControllerPublishSecret",
+	"csiNodeStageSecret",
+	"csiNodePublishSecret",
+}
+
+// validateParameters returns an error naming the first unknown or invalid
+// parameter of params.
+func validateParameters(params map[string]string) error {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isReservedParameter(key) {
+			continue
+		}
+		check, ok := storageClassParameters[key]
+		if !ok {
+			return unknownParameterError(key)
+		}
+		if check != nil {
+			if err := check(params[key]); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := getRootOwnership(params); err != nil {
+		return err
+	}
+	cache, err := getCacheOptions(params)
+	if err != nil {
+		return err
+	}
+	placement, err := getPlacement(params, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkCachePlacement(cache, placement); err != nil {
+		return err
+	}
+	if _, err := getSizeOptions(params); err != nil {
+		return err
+	}
+	return nil
+}
+
+func isReservedParameter(key string) bool {
+	for _, prefix := range reservedParameterPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func unknownParameterError(key string) error {
+	for known := range storageClassParameters {
+		if strings.EqualFold(key, known) {
+			return fmt.Errorf("unknown parameter %q, did you mean %q?", key, known)
+		}
+	}
+	return fmt.Errorf("unknown parameter %q", key)
+}
+
+// unsupportedParameter returns a check rejecting any value of key.
+func unsupportedParameter(key string) func(string) error {
+	return func(string) error {
+		return fmt.Errorf("%s is not supported by the driver", key)
+	}
+}
+
+func checkVGName(vgName string) error {
+	if vgName != "" && !lvmNameRegexp.MatchString(vgName) {
+		return fmt.Errorf("invalid %s %q", vgNameKey, vgName)
+	}
+	return nil
+}
+
+func checkFsType(fsType string) error {
+	// nodes format new volumes with defaultFs only
+	if fsType != "" && fsType != defaultFs {
+		return fmt.Errorf("invalid %s %q, only %s is supported", fsTypeKey, fsType, defaultFs)
+	}
+	return nil
+}
+
+func checkWipePolicy(policy string) error {
+	if !validWipePolicy(policy) {
+		return fmt.Errorf("invalid %s %q", wipePolicyKey, policy)
+	}
+	return nil
+}
+
+func checkCreateWipePolicy(policy string) error {
+	if !validCreateWipePolicy(policy) {
+		return fmt.Errorf("invalid %s %q", createWipePolicyKey, policy)
+	}
+	return nil
+}
+
+func checkFsckPolicy(policy string) error {
+	if !validFsckPolicy(policy) {
+		return fmt.Errorf("invalid %s %q", fsckPolicyKey, policy)
+	}
+	return nil
+}
+
+// checkRootOwnership returns the check of the root ownership parameter
+// key, which nodes parse before formatting a new volume.
+func checkRootOwnership(key string) func(string) error {
+	return func(value string) error {
+		_, err := getRootOwnership(map[string]string{key: value})
+		return err
+	}
+}
+
+func checkTrashTTL(ttl string) error {
+	if ttl == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(ttl); err != nil {
+		return fmt.Errorf("invalid %s %q: %v", trashTTLKey, ttl, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		err    string
+	}{
+		{name: "none"},
+		{
+			name: "valid",
+			params: map[string]string{fsTypeKey: "ext4", vgNameKey: "k8s", wipePolicyKey: "zero", fsckPolicyKey: "check",
+				rootGIDKey: "1000", rootModeKey: "0770", trashTTLKey: "72h", minSizeKey: "1Gi", sizeGranularityKey: "1Gi"},
+		},
+		{
+			name:   "reserved prefixes",
+			params: map[string]string{"csi.storage.k8s.io/fstype": "ext4", "csiProvisionerSecretName": "secret"},
+		},
+		{name: "unknown", params: map[string]string{"size": "1Gi"}, err: `unknown parameter "size"`},
+		{name: "wrong case", params: map[string]string{"fstype": "ext4"}, err: `did you mean "fsType"?`},
+		{name: "unsupported fs", params: map[string]string{fsTypeKey: "xfs"}, err: "only ext4 is supported"},
+		{name: "invalid vg name", params: map[string]string{vgNameKey: "-k8s"}, err: "invalid vgName"},
+		{name: "invalid wipe policy", params: map[string]string{wipePolicyKey: "shred"}, err: "invalid wipePolicy"},
+		{name: "invalid root mode", params: map[string]string{rootModeKey: "rwx"}, err: rootModeKey},
+		{name: "invalid trash ttl", params: map[string]string{trashTTLKey: "3 days"}, err: "invalid trashTTL"},
+		{name: "thin pool", params: map[string]string{thinPoolKey: "pool0"}, err: "thinPool is not supported"},
+		{name: "mirrors", params: map[string]string{mirrorsKey: "1"}, err: "mirrors is not supported"},
+		{name: "cache without size", params: map[string]string{cacheTypeKey: "cache", cachePVsKey: "@ssd"}, err: "invalid cacheSize"},
+		{name: "invalid pv tag", params: map[string]string{pvTagsKey: "a b"}, err: "invalid pvTags"},
+		{name: "min above max", params: map[string]string{minSizeKey: "2Gi", maxSizeKey: "1Gi"}, err: "is larger than"},
+		{
+			name:   "data PVs with anti-affinity",
+			params: map[string]string{cacheTypeKey: "cache", cacheSizeKey: "1Gi", cachePVsKey: "@ssd", dataPVsKey: "@hdd", antiAffinityGroupKey: "db"},
+			err:    "dataPVs cannot be combined with antiAffinityGroup",
+		},
+	}
+	for _, test := range tests {
+		err := validateParameters(test.params)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// pvTagsKey pins a volume to the physical volumes carrying one of the
+	// comma separated tags. Volumes of the same antiAffinityGroupKey are
+	// put on distinct physical volumes of a node. Both can be set as
+	// StorageClass parameter or overridden by the PVC annotations.
+	pvTagsKey            = "pvTags"
+	antiAffinityGroupKey = "antiAffinityGroup"
+
+	pvTagsAnnKey            = "lvm/pv-tags"
+	antiAffinityGroupAnnKey = "lvm/anti-affinity-group"
+
+	groupTagPrefix = "csi-lvm.group="
+)
+
+// lvmTagRegexp matches the characters LVM allows in tags.
+var lvmTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_+.\-/=!:&#]+$`)
+
+// placement restricts the physical volumes a volume is allocated from.
+type placement struct {
+	pvTags []string
+	group  string
+}
+
+func getPlacement(attributes, annotations map[string]string) (*placement, error) {
+	p := &placement{
+		pvTags: splitList(attributes[pvTagsKey]),
+		group:  attributes[antiAffinityGroupKey],
+	}
+	if value, ok := annotations[pvTagsAnnKey]; ok {
+		p.pvTags = splitList(value)
+	}
+	if value, ok := annotations[antiAffinityGroupAnnKey]; ok {
+		p.group = value
+	}
+	for _, tag := range p.pvTags {
+		if !lvmTagRegexp.MatchString(tag) {
+			return nil, fmt.Errorf("invalid %s %q", pvTagsKey, tag)
+		}
+	}
+	if p.group != "" && !lvmTagRegexp.MatchString(p.group) {
+		return nil, fmt.Errorf("invalid %s %q", antiAffinityGroupKey, p.group)
+	}
+	return p, nil
+}
+
+// getVolumePlacement returns the placement of the volume of pv, taking
+// the annotations of its PVC into account.
+func (ns *nodeServer) getVolumePlacement(pv *v1.PersistentVolume) (*placement, error) {
+	var annotations map[string]string
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		pvc, err := ns.client.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get pvc %s/%s: %v", ref.Namespace, ref.Name, err)
+		}
+		annotations = pvc.Annotations
+	}
+	var attributes map[string]string
+	if pv.Spec.CSI != nil {
+		attributes = pv.Spec.CSI.VolumeAttributes
+	}
+	return getPlacement(attributes, annotations)
+}
+
+func (p *placement) tags() []string {
+	if p.group == "" {
+		return nil
+	}
+	return []string{groupTagPrefix + p.group}
+}
+
+// selectPVs returns the physical volumes of vgName to allocate a volume of
+// size bytes from, or nil if LVM may choose freely. With an anti-affinity
+// group, it picks the physical volume with the most free space which holds
+// no other volume of the group.
+func (p *placement) selectPVs(vgName string, size uint64) ([]string, error) {
+	if p.group == "" {
+		var pvs []string
+		for _, tag := range p.pvTags {
+			pvs = append(pvs, "@"+tag)
+		}
+		return pvs, nil
+	}
+
+	lvs, err := lvsReport(vgName, "lv_name", "lv_tags", "devices")
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, lv := range lvs {
+		if !hasTag(splitList(lv["lv_tags"]), groupTagPrefix+p.group) {
+			continue
+		}
+		for _, device := range lvDevices(lv["devices"]) {
+			used[device] = true
+		}
+	}
+
+	pvs, err := pvsReport(vgName, "pv_name", "pv_tags", "pv_free")
+	if err != nil {
+		return nil, err
+	}
+	best, bestFree := "", uint64(0)
+	for _, pv := range pvs {
+		if used[pv["pv_name"]] || !p.matchesPV(splitList(pv["pv_tags"])) {
+			continue
+		}
+		free, err := strconv.ParseUint(pv["pv_free"], 10, 64)
+		if err != nil || free < size || free <= bestFree {
+			continue
+		}
+		best, bestFree = pv["pv_name"], free
+	}
+	if best == "" {
+		return nil, fmt.Errorf("no physical volume of %s has %d bytes free and no volume of anti-affinity group %s", vgName, size, p.group)
+	}
+	return []string{best}, nil
+}
+
+// lvDevices returns the physical volumes of the devices field of lvs,
+// which lists the extents of the LV, e.g. /dev/sdb(0),/dev/sdc(0).
+func lvDevices(devices string) []string {
+	var pvs []string
+	for _, device := range splitList(devices) {
+		if i := strings.Index(device, "("); i >= 0 {
+			device = device[:i]
+		}
+		pvs = append(pvs, device)
+	}
+	return pvs
+}
+
+func (p *placement) matchesPV(tags []string) bool {
+	if len(p.pvTags) == 0 {
+		return true
+	}
+	for _, tag := range p.pvTags {
+		if hasTag(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
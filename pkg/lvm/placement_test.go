@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetPlacement(t *testing.T) {
+	tests := []struct {
+		name        string
+		attributes  map[string]string
+		annotations map[string]string
+		expected    *placement
+		fail        bool
+	}{
+		{
+			name:     "anywhere",
+			expected: &placement{},
+		},
+		{
+			name:       "storage class",
+			attributes: map[string]string{pvTagsKey: "ssd, nvme", antiAffinityGroupKey: "db"},
+			expected:   &placement{pvTags: []string{"ssd", "nvme"}, group: "db"},
+		},
+		{
+			name:        "pvc overrides storage class",
+			attributes:  map[string]string{pvTagsKey: "ssd", antiAffinityGroupKey: "db"},
+			annotations: map[string]string{pvTagsAnnKey: "hdd", antiAffinityGroupAnnKey: "kafka"},
+			expected:    &placement{pvTags: []string{"hdd"}, group: "kafka"},
+		},
+		{
+			name:        "pvc clears storage class",
+			attributes:  map[string]string{pvTagsKey: "ssd", antiAffinityGroupKey: "db"},
+			annotations: map[string]string{pvTagsAnnKey: "", antiAffinityGroupAnnKey: ""},
+			expected:    &placement{},
+		},
+		{
+			name:       "invalid tag",
+			attributes: map[string]string{pvTagsKey: "fast disk"},
+			fail:       true,
+		},
+		{
+			name:        "invalid group",
+			annotations: map[string]string{antiAffinityGroupAnnKey: "db*"},
+			fail:        true,
+		},
+	}
+	for _, test := range tests {
+		p, err := getPlacement(test.attributes, test.annotations)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, p)
+		}
+	}
+}
+
+func TestSelectPVsByTags(t *testing.T) {
+	tests := []struct {
+		pvTags   []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{"ssd"}, []string{"@ssd"}},
+		{[]string{"ssd", "nvme"}, []string{"@ssd", "@nvme"}},
+	}
+	for _, test := range tests {
+		p := &placement{pvTags: test.pvTags}
+		pvs, err := p.selectPVs("vg", 1<<30)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.pvTags, err)
+		} else if !reflect.DeepEqual(pvs, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.pvTags, test.expected, pvs)
+		}
+	}
+}
+
+func TestLVDevices(t *testing.T) {
+	tests := []struct {
+		devices  string
+		expected []string
+	}{
+		{"", nil},
+		{"/dev/sdb(0)", []string{"/dev/sdb"}},
+		{"/dev/sdb(0),/dev/sdc(2560)", []string{"/dev/sdb", "/dev/sdc"}},
+		{"vol_cdata(0)", []string{"vol_cdata"}},
+	}
+	for _, test := range tests {
+		if pvs := lvDevices(test.devices); !reflect.DeepEqual(pvs, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.devices, test.expected, pvs)
+		}
+	}
+}
+
+func TestMatchesPV(t *testing.T) {
+	tests := []struct {
+		pvTags  []string
+		tags    []string
+		matches bool
+	}{
+		{nil, nil, true},
+		{nil, []string{"hdd"}, true},
+		{[]string{"ssd"}, nil, false},
+		{[]string{"ssd"}, []string{"hdd"}, false},
+		{[]string{"ssd", "nvme"}, []string{"hdd", "nvme"}, true},
+	}
+	for _, test := range tests {
+		p := &placement{pvTags: test.pvTags}
+		if matches := p.matchesPV(test.tags); matches != test.matches {
+			t.Errorf("%v on %v: matchesPV = %v, want %v", test.pvTags, test.tags, matches, test.matches)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	lvmdproto "github.com/google/lvmd/proto"
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	reconcileProtectionInterval = time.Minute
+
+	// protectedAnnKey set to "true" on a PV or its PVC protects the
+	// volume from deletion. Protected PVCs get protectionFinalizer so
+	// that deleting them, or their namespace, waits until the
+	// annotation is removed.
+	protectedAnnKey     = "lvm/protected"
+	protectionFinalizer = "lvm.paas.com/protection"
+
+	reasonVolumeProtected = "VolumeProtected"
+)
+
+func isProtected(annotations map[string]string) bool {
+	return annotations[protectedAnnKey] == "true"
+}
+
+// isVolumeProtected returns whether pv or its PVC is annotated protected.
+func (cs *controllerServer) isVolumeProtected(pv *v1.PersistentVolume) (bool, error) {
+	if isProtected(pv.Annotations) {
+		return true, nil
+	}
+	claim := pv.Spec.ClaimRef
+	if claim == nil {
+		return false, nil
+	}
+	pvc, err := cs.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && pvc.UID != claim.UID) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return isProtected(pvc.Annotations), nil
+}
+
+// reconcileProtection keeps protectionFinalizer on the protected PVCs of
+// the driver and the tag lvmd.ProtectedTag on the LVs of protected
+// volumes, so that lvmd clients refuse to remove them as well.
+func (cs *controllerServer) reconcileProtection() {
+	pvs, err := listDriverPVs(cs.client, cs.driverName)
+	if err != nil {
+		glog.Errorf("reconcileProtection: %v", err)
+		return
+	}
+	tags, err := cs.getLVTags()
+	if err != nil {
+		glog.Errorf("reconcileProtection: %v", err)
+		return
+	}
+	for i := range pvs {
+		pv := &pvs[i]
+		protected := isProtected(pv.Annotations)
+		if claim := pv.Spec.ClaimRef; claim != nil {
+			claimProtected, err := cs.reconcileClaimProtection(claim)
+			if err != nil {
+				glog.Errorf("reconcileProtection: pvc %s/%s: %v", claim.Namespace, claim.Name, err)
+				continue
+			}
+			protected = protected || claimProtected
+		}
+
+		node := pv.Annotations[lvmNodeAnnKey]
+		if node == "" {
+			continue
+		}
+		vgName, lvName := getVolumeLV(pv, cs.vgName)
+		lvTags, found := tags[node+"/"+vgName+"/"+lvName]
+		if !found || hasTag(lvTags, lvmd.ProtectedTag) == protected {
+			continue
+		}
+		if err := setLVProtection(cs.client, node, vgName, lvName, lvTags, protected); err != nil {
+			glog.Errorf("reconcileProtection: %v", err)
+			continue
+		}
+		if protected {
+			glog.Infof("reconcileProtection: protected %s/%s of %s on node %s", vgName, lvName, pv.Name, node)
+			cs.recorder.Event(pv, v1.EventTypeNormal, reasonVolumeProtected, "the volume is protected from deletion")
+		} else {
+			glog.Infof("reconcileProtection: unprotected %s/%s of %s on node %s", vgName, lvName, pv.Name, node)
+			cs.recorder.Event(pv, v1.EventTypeNormal, reasonVolumeProtected, "the volume is no longer protected from deletion")
+		}
+	}
+}
+
+// reconcileClaimProtection adds protectionFinalizer to the PVC if it is
+// protected and removes it otherwise. It returns whether it is protected.
+func (cs *controllerServer) reconcileClaimProtection(claim *v1.ObjectReference) (bool, error) {
+	protected := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvc, err := cs.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && pvc.UID != claim.UID) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		protected = isProtected(pvc.Annotations)
+		var finalizers []string
+		found := false
+		for _, f := range pvc.Finalizers {
+			if f == protectionFinalizer {
+				found = true
+			} else {
+				finalizers = append(finalizers, f)
+			}
+		}
+		if found == protected {
+			return nil
+		}
+		if protected {
+			finalizers = append(finalizers, protectionFinalizer)
+		}
+		pvc.Finalizers = finalizers
+		_, err = cs.client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(pvc)
+		return err
+	})
+	return protected, err
+}
+
+// getLVTags returns the tags of the LVs reported by the LVMNodes by
+// node/vg/lv, avoiding calls to the lvmd of every node.
+func (cs *controllerServer) getLVTags() (map[string][]string, error) {
+	nodes, err := ListLVMNodes(cs.client)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string][]string{}
+	for _, node := range nodes {
+		for _, lv := range node.Status.LogicalVolumes {
+			tags[node.Name+"/"+lv.VolumeGroup+"/"+lv.Name] = lv.Tags
+		}
+	}
+	return tags, nil
+}
+
+// setLVProtection adds or removes lvmd.ProtectedTag on an LV of node with
+// tags. Protecting an LV also withdraws a pending request to wipe it.
+func setLVProtection(client kubernetes.Interface, node, vgName, lvName string, tags []string, protected bool) error {
+	conn, err := connectLVMD(client, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	if protected {
+		err = conn.AddTagLV(ctx, vgName, lvName, []string{lvmd.ProtectedTag})
+		if requests := wipeRequestTags(tags); err == nil && len(requests) > 0 {
+			err = conn.RemoveTagLV(ctx, vgName, lvName, requests)
+		}
+	} else {
+		err = conn.RemoveTagLV(ctx, vgName, lvName, []string{lvmd.ProtectedTag})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to tag %s/%s on node %s: %v", vgName, lvName, node, err)
+	}
+	return nil
+}
+
+// unprotectCopy removes lvmd.ProtectedTag from a copy of a volume which is
+// about to be removed while the volume lives on elsewhere, e.g. the source
+// of a completed migration.
+func unprotectCopy(ctx context.Context, conn lvmd.LVMConnection, vgName string, lv *lvmdproto.LogicalVolume) error {
+	if !hasTag(lv.GetTags(), lvmd.ProtectedTag) {
+		return nil
+	}
+	return conn.RemoveTagLV(ctx, vgName, lv.GetName(), []string{lvmd.ProtectedTag})
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// quotasConfigMap holds the quota of each namespace as JSON keyed by
+	// the namespace, the quota of defaultQuotaKey applies to namespaces
+	// without one. Namespace names cannot start with "_".
+	quotasConfigMap = "csi-lvm-quotas"
+	defaultQuotaKey = "_default"
+
+	// Parameters of CreateVolume naming the PVC, passed by external
+	// provisioners run with --extra-create-metadata.
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+
+	claimUIDIndex = "uid"
+
+	// pendingQuotaTTL is how long a volume accepted by CreateVolume is
+	// counted before its PV shows up.
+	pendingQuotaTTL = 5 * time.Minute
+)
+
+// quotaLimits limits the volumes of a namespace. Zero values are
+// unlimited.
+type quotaLimits struct {
+	MaxBytes   *resource.Quantity `json:"maxBytes,omitempty"`
+	MaxVolumes int                `json:"maxVolumes,omitempty"`
+}
+
+// quota is the quota of a namespace as a whole, and optionally per VG and
+// per StorageClass, i.e. per device class.
+type quota struct {
+	quotaLimits
+	VGs            map[string]quotaLimits `json:"vgs,omitempty"`
+	StorageClasses map[string]quotaLimits `json:"storageClasses,omitempty"`
+}
+
+// quotaUsage is the usage of a namespace as a whole or of one VG or
+// StorageClass of it.
+type quotaUsage struct {
+	bytes   int64
+	volumes int
+}
+
+// volumeUsage is what a volume counts against the quota of its namespace.
+type volumeUsage struct {
+	namespace    string
+	vgName       string
+	storageClass string
+	bytes        int64
+}
+
+// quotaChecker enforces the quotas of the ConfigMap quotasConfigMap on
+// CreateVolume. Usage is computed from the PVs of the driver plus the
+// volumes which have been accepted but have no PV yet.
+type quotaChecker struct {
+	client     kubernetes.Interface
+	namespace  string
+	driverName string
+	vgName     string
+
+	checkMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[string]pendingUsage
+
+	// claims caches the PVCs indexed by UID, started on the first check.
+	startClaims  sync.Once
+	claims       cache.Indexer
+	claimsSynced cache.InformerSynced
+}
+
+type pendingUsage struct {
+	volumeUsage
+	since time.Time
+}
+
+func newQuotaChecker(client kubernetes.Interface, namespace, driverName, vgName string) *quotaChecker {
+	return &quotaChecker{
+		client:     client,
+		namespace:  namespace,
+		driverName: driverName,
+		vgName:     vgName,
+		pending:    map[string]pendingUsage{},
+	}
+}
+
+// getQuotas returns the quotas by namespace, none if the ConfigMap does
+// not exist.
+func (q *quotaChecker) getQuotas() (map[string]*quota, error) {
+	cm, err := q.client.CoreV1().ConfigMaps(q.namespace).Get(quotasConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	quotas := map[string]*quota{}
+	for namespace, data := range cm.Data {
+		qt := &quota{}
+		if err := json.Unmarshal([]byte(data), qt); err != nil {
+			return nil, fmt.Errorf("invalid quota of %s in %s/%s: %v", namespace, q.namespace, quotasConfigMap, err)
+		}
+		quotas[namespace] = qt
+	}
+	return quotas, nil
+}
+
+func quotaOf(quotas map[string]*quota, namespace string) *quota {
+	if qt, found := quotas[namespace]; found {
+		return qt
+	}
+	return quotas[defaultQuotaKey]
+}
+
+// volumeNameRegexp matches the names the external provisioner gives
+// volumes, <prefix>-<pvc uid>.
+var volumeNameRegexp = regexp.MustCompile(`-([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// claimUID returns the UID of the PVC of the volume named name, or "" if
+// the name has another shape.
+func claimUID(name string) string {
+	match := volumeNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// findClaim returns the PVC a CreateVolume request named name provisions
+// a volume for, from the parameters naming it if any and from the UID in
+// the name otherwise.
+func (q *quotaChecker) findClaim(name string, params map[string]string) (*v1.PersistentVolumeClaim, error) {
+	if params[pvcNameKey] != "" && params[pvcNamespaceKey] != "" {
+		return q.client.CoreV1().PersistentVolumeClaims(params[pvcNamespaceKey]).Get(params[pvcNameKey], metav1.GetOptions{})
+	}
+	uid := claimUID(name)
+	if uid == "" {
+		return nil, fmt.Errorf("cannot derive the pvc of volume %s", name)
+	}
+	q.startClaims.Do(q.runClaimsInformer)
+	if !cache.WaitForCacheSync(wait.NeverStop, q.claimsSynced) {
+		return nil, fmt.Errorf("failed to sync the pvc cache")
+	}
+	claims, err := q.claims.ByIndex(claimUIDIndex, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims) == 0 {
+		return nil, fmt.Errorf("no pvc with uid %s found for volume %s", uid, name)
+	}
+	return claims[0].(*v1.PersistentVolumeClaim), nil
+}
+
+func (q *quotaChecker) runClaimsInformer() {
+	listWatch := cache.NewListWatchFromClient(q.client.CoreV1().RESTClient(), "persistentvolumeclaims", v1.NamespaceAll, fields.Everything())
+	indexers := cache.Indexers{claimUIDIndex: func(obj interface{}) ([]string, error) {
+		return []string{string(obj.(*v1.PersistentVolumeClaim).UID)}, nil
+	}}
+	claims, informer := cache.NewIndexerInformer(listWatch, &v1.PersistentVolumeClaim{}, 0, cache.ResourceEventHandlerFuncs{}, indexers)
+	q.claims = claims
+	q.claimsSynced = informer.HasSynced
+	go informer.Run(wait.NeverStop)
+}
+
+// usage returns the volumes of the driver counting against quotas, by
+// volume id.
+func (q *quotaChecker) usage() (map[string]volumeUsage, error) {
+	pvs, err := q.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]volumeUsage{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != q.driverName || pv.Spec.ClaimRef == nil {
+			continue
+		}
+		vgName := getVolumeAttribute(pv, vgNameKey)
+		if vgName == "" {
+			vgName = q.vgName
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		volumes[pv.Name] = volumeUsage{
+			namespace:    pv.Spec.ClaimRef.Namespace,
+			vgName:       vgName,
+			storageClass: pv.Spec.StorageClassName,
+			bytes:        capacity.Value(),
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for volumeId, p := range q.pending {
+		if _, found := volumes[volumeId]; found || time.Since(p.since) > pendingQuotaTTL {
+			delete(q.pending, volumeId)
+			continue
+		}
+		volumes[volumeId] = p.volumeUsage
+	}
+	return volumes, nil
+}
+
+// check returns an error if creating the volume named name of size bytes
+// with params exceeds the quota of the namespace of its PVC.
+func (q *quotaChecker) check(name string, params map[string]string, size int64) error {
+	quotas, err := q.getQuotas()
+	if err != nil || len(quotas) == 0 {
+		return err
+	}
+	pvc, err := q.findClaim(name, params)
+	if err != nil {
+		return err
+	}
+	qt := quotaOf(quotas, pvc.Namespace)
+	if qt == nil {
+		return nil
+	}
+	storageClass := ""
+	if pvc.Spec.StorageClassName != nil {
+		storageClass = *pvc.Spec.StorageClassName
+	}
+
+	// Serialize checks so that concurrent requests see each other.
+	q.checkMutex.Lock()
+	defer q.checkMutex.Unlock()
+	volumes, err := q.usage()
+	if err != nil {
+		return err
+	}
+	vgName := params[vgNameKey]
+	if vgName == "" {
+		vgName = q.vgName
+	}
+	request := volumeUsage{
+		namespace:    pvc.Namespace,
+		vgName:       vgName,
+		storageClass: storageClass,
+		bytes:        size,
+	}
+	if err := qt.check(volumes, name, request); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	q.pending[name] = pendingUsage{volumeUsage: request, since: time.Now()}
+	q.mutex.Unlock()
+	return nil
+}
+
+// check returns an error if the volume named name of request exceeds qt,
+// given the volumes counting against quotas.
+func (qt *quota) check(volumes map[string]volumeUsage, name string, request volumeUsage) error {
+	var total, vg, sc quotaUsage
+	for volumeId, u := range volumes {
+		if u.namespace != request.namespace || volumeId == name {
+			continue
+		}
+		total.add(u.bytes)
+		if u.vgName == request.vgName {
+			vg.add(u.bytes)
+		}
+		if u.storageClass == request.storageClass {
+			sc.add(u.bytes)
+		}
+	}
+	if err := qt.quotaLimits.check(total, request.bytes, fmt.Sprintf("namespace %s", request.namespace)); err != nil {
+		return err
+	}
+	if limits, found := qt.VGs[request.vgName]; found {
+		if err := limits.check(vg, request.bytes, fmt.Sprintf("VG %s of namespace %s", request.vgName, request.namespace)); err != nil {
+			return err
+		}
+	}
+	if limits, found := qt.StorageClasses[request.storageClass]; found {
+		if err := limits.check(sc, request.bytes, fmt.Sprintf("StorageClass %s of namespace %s", request.storageClass, request.namespace)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *quotaUsage) add(bytes int64) {
+	u.bytes += bytes
+	u.volumes++
+}
+
+// quotaExceededError is returned by check if a volume exceeds a quota,
+// as opposed to failures to check it.
+type quotaExceededError struct {
+	message string
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.message
+}
+
+func (l quotaLimits) check(used quotaUsage, size int64, scope string) error {
+	if l.MaxVolumes > 0 && used.volumes+1 > l.MaxVolumes {
+		return &quotaExceededError{fmt.Sprintf("LVM quota of %s exceeded: %d of %d volumes in use", scope, used.volumes, l.MaxVolumes)}
+	}
+	if l.MaxBytes != nil && used.bytes+size > l.MaxBytes.Value() {
+		return &quotaExceededError{fmt.Sprintf("LVM quota of %s exceeded: requested %d bytes, %d of %s in use",
+			scope, size, used.bytes, l.MaxBytes.String())}
+	}
+	return nil
+}
+
+var (
+	quotaUsedBytesDesc   = prometheus.NewDesc("csi_lvm_quota_used_bytes", "Bytes of LVM volumes of the namespace.", []string{"namespace"}, nil)
+	quotaUsedVolumesDesc = prometheus.NewDesc("csi_lvm_quota_used_volumes", "Number of LVM volumes of the namespace.", []string{"namespace"}, nil)
+	quotaMaxBytesDesc    = prometheus.NewDesc("csi_lvm_quota_max_bytes", "Maximum bytes of LVM volumes of the namespace.", []string{"namespace"}, nil)
+	quotaMaxVolumesDesc  = prometheus.NewDesc("csi_lvm_quota_max_volumes", "Maximum number of LVM volumes of the namespace.", []string{"namespace"}, nil)
+)
+
+func (q *quotaChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaUsedBytesDesc
+	ch <- quotaUsedVolumesDesc
+	ch <- quotaMaxBytesDesc
+	ch <- quotaMaxVolumesDesc
+}
+
+// Collect exports the usage of every namespace with LVM volumes and the
+// limits of its quota.
+func (q *quotaChecker) Collect(ch chan<- prometheus.Metric) {
+	volumes, err := q.usage()
+	if err != nil {
+		glog.Errorf("Failed to collect quota usage: %v", err)
+		return
+	}
+	quotas, err := q.getQuotas()
+	if err != nil {
+		glog.Errorf("Failed to collect quotas: %v", err)
+	}
+	used := map[string]*quotaUsage{}
+	for _, u := range volumes {
+		if used[u.namespace] == nil {
+			used[u.namespace] = &quotaUsage{}
+		}
+		used[u.namespace].add(u.bytes)
+	}
+	for namespace, u := range used {
+		ch <- prometheus.MustNewConstMetric(quotaUsedBytesDesc, prometheus.GaugeValue, float64(u.bytes), namespace)
+		ch <- prometheus.MustNewConstMetric(quotaUsedVolumesDesc, prometheus.GaugeValue, float64(u.volumes), namespace)
+		qt := quotaOf(quotas, namespace)
+		if qt == nil {
+			continue
+		}
+		if qt.MaxBytes != nil {
+			ch <- prometheus.MustNewConstMetric(quotaMaxBytesDesc, prometheus.GaugeValue, float64(qt.MaxBytes.Value()), namespace)
+		}
+		if qt.MaxVolumes > 0 {
+			ch <- prometheus.MustNewConstMetric(quotaMaxVolumesDesc, prometheus.GaugeValue, float64(qt.MaxVolumes), namespace)
+		}
+	}
+}
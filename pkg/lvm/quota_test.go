@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestClaimUID(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"pvc-0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1", "0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1"},
+		{"csi-lvm-pvc-0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1", "0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1"},
+		{"pvc-0c4fd6a4", ""},
+		{"0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1", ""},
+		{"pvc-0c4fd6a4-d5f6-11e8-9f8b-f2801f1b9fd1-copy", ""},
+	}
+	for _, test := range tests {
+		if uid := claimUID(test.name); uid != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, uid)
+		}
+	}
+}
+
+func TestQuotaOf(t *testing.T) {
+	teamA, fallback := &quota{}, &quota{}
+	quotas := map[string]*quota{"team-a": teamA, defaultQuotaKey: fallback}
+	if qt := quotaOf(quotas, "team-a"); qt != teamA {
+		t.Errorf("expected the quota of team-a")
+	}
+	if qt := quotaOf(quotas, "team-b"); qt != fallback {
+		t.Errorf("expected the default quota for team-b")
+	}
+	if qt := quotaOf(map[string]*quota{"team-a": teamA}, "team-b"); qt != nil {
+		t.Errorf("expected no quota for team-b")
+	}
+}
+
+func TestQuotaCheck(t *testing.T) {
+	gi := func(n int64) int64 { return n << 30 }
+	maxBytes := func(s string) *resource.Quantity {
+		q := resource.MustParse(s)
+		return &q
+	}
+	volumes := map[string]volumeUsage{
+		"pvc-1": {namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(10)},
+		"pvc-2": {namespace: "team-a", vgName: "k8s", storageClass: "slow", bytes: gi(20)},
+		"pvc-3": {namespace: "team-a", vgName: "hdd", storageClass: "slow", bytes: gi(30)},
+		"pvc-4": {namespace: "team-b", vgName: "k8s", storageClass: "fast", bytes: gi(100)},
+	}
+	tests := []struct {
+		name     string
+		quota    quota
+		volume   string
+		request  volumeUsage
+		exceeded bool
+	}{
+		{
+			name:    "unlimited",
+			volume:  "pvc-5",
+			request: volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(1000)},
+		},
+		{
+			name:    "within bytes of namespace",
+			quota:   quota{quotaLimits: quotaLimits{MaxBytes: maxBytes("100Gi")}},
+			volume:  "pvc-5",
+			request: volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(40)},
+		},
+		{
+			name:     "bytes of namespace exceeded",
+			quota:    quota{quotaLimits: quotaLimits{MaxBytes: maxBytes("100Gi")}},
+			volume:   "pvc-5",
+			request:  volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(41)},
+			exceeded: true,
+		},
+		{
+			name:     "volumes of namespace exceeded",
+			quota:    quota{quotaLimits: quotaLimits{MaxVolumes: 3}},
+			volume:   "pvc-5",
+			request:  volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(1)},
+			exceeded: true,
+		},
+		{
+			name:    "retried request is not counted twice",
+			quota:   quota{quotaLimits: quotaLimits{MaxVolumes: 3}},
+			volume:  "pvc-3",
+			request: volumeUsage{namespace: "team-a", vgName: "hdd", storageClass: "slow", bytes: gi(30)},
+		},
+		{
+			name:     "bytes of VG exceeded",
+			quota:    quota{VGs: map[string]quotaLimits{"k8s": {MaxBytes: maxBytes("40Gi")}}},
+			volume:   "pvc-5",
+			request:  volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "fast", bytes: gi(11)},
+			exceeded: true,
+		},
+		{
+			name:    "other VG unlimited",
+			quota:   quota{VGs: map[string]quotaLimits{"k8s": {MaxBytes: maxBytes("40Gi")}}},
+			volume:  "pvc-5",
+			request: volumeUsage{namespace: "team-a", vgName: "hdd", storageClass: "fast", bytes: gi(11)},
+		},
+		{
+			name:     "volumes of StorageClass exceeded",
+			quota:    quota{StorageClasses: map[string]quotaLimits{"slow": {MaxVolumes: 2}}},
+			volume:   "pvc-5",
+			request:  volumeUsage{namespace: "team-a", vgName: "k8s", storageClass: "slow", bytes: gi(1)},
+			exceeded: true,
+		},
+		{
+			name:    "other namespaces are not counted",
+			quota:   quota{quotaLimits: quotaLimits{MaxBytes: maxBytes("100Gi")}},
+			volume:  "pvc-5",
+			request: volumeUsage{namespace: "team-c", vgName: "k8s", storageClass: "fast", bytes: gi(100)},
+		},
+	}
+	for _, test := range tests {
+		err := test.quota.check(volumes, test.volume, test.request)
+		if _, exceeded := err.(*quotaExceededError); exceeded != test.exceeded || (err != nil && !exceeded) {
+			t.Errorf("%s: check = %v, want exceeded %v", test.name, err, test.exceeded)
+		}
+	}
+}
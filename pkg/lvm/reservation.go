@@ -0,0 +1,443 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	reservationsConfigMap         = "csi-lvm-reservations"
+	reconcileReservationsInterval = 10 * time.Second
+	updateCapacityInterval        = 30 * time.Second
+
+	// lvmResourceName is the extended resource of nodes holding the free
+	// space of the VG net of reservations.
+	lvmResourceName = v1.ResourceName("paas.com/lvm")
+
+	// selectedNodeAnnKey is set on PVCs by the scheduler with delayed
+	// volume binding.
+	selectedNodeAnnKey = "volume.kubernetes.io/selected-node"
+)
+
+// reservation is space of a node's VG promised to a volume whose LV has
+// not been created yet, because it is created lazily by NodePublishVolume.
+type reservation struct {
+	Node   string    `json:"node"`
+	VGName string    `json:"vgName"`
+	Bytes  int64     `json:"bytes"`
+	Since  time.Time `json:"since"`
+}
+
+// reservationLedger stores the reservations in a ConfigMap keyed by volume
+// id. It is rebuilt by the leading controller and read by GetCapacity and
+// the node plugins.
+type reservationLedger struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+func newReservationLedger(client kubernetes.Interface, namespace string) *reservationLedger {
+	return &reservationLedger{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+func (l *reservationLedger) list() (map[string]*reservation, error) {
+	reservations := map[string]*reservation{}
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(reservationsConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return reservations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for volumeId, data := range cm.Data {
+		r := &reservation{}
+		if err := json.Unmarshal([]byte(data), r); err != nil {
+			return nil, err
+		}
+		reservations[volumeId] = r
+	}
+	return reservations, nil
+}
+
+// reserved returns the bytes reserved in vgName of node.
+func (l *reservationLedger) reserved(node, vgName string) (int64, error) {
+	reservations, err := l.list()
+	if err != nil {
+		return 0, err
+	}
+	return reservedBytes(reservations, node, vgName, ""), nil
+}
+
+// reservedBytes returns the bytes of reservations in vgName of node, but
+// for the one of volume except.
+func reservedBytes(reservations map[string]*reservation, node, vgName, except string) int64 {
+	var bytes int64
+	for volumeId, r := range reservations {
+		if r.Node == node && r.VGName == vgName && volumeId != except {
+			bytes += r.Bytes
+		}
+	}
+	return bytes
+}
+
+// reserve stores the reservation r of volumeId.
+func (l *reservationLedger) reserve(volumeId string, r *reservation) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getOrCreateConfigMap(l.client, l.namespace, reservationsConfigMap)
+		if err != nil {
+			return err
+		}
+		if cm.Data[volumeId] == string(value) {
+			return nil
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[volumeId] = string(value)
+		_, err = l.client.CoreV1().ConfigMaps(l.namespace).Update(cm)
+		return err
+	})
+}
+
+// release removes the reservation of volumeId.
+func (l *reservationLedger) release(volumeId string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(reservationsConfigMap, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, found := cm.Data[volumeId]; !found {
+			return nil
+		}
+		delete(cm.Data, volumeId)
+		_, err = l.client.CoreV1().ConfigMaps(l.namespace).Update(cm)
+		return err
+	})
+}
+
+// snapshot returns the raw content of the ledger, to be passed to replace.
+func (l *reservationLedger) snapshot() (map[string]string, error) {
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(reservationsConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// replace stores reservations, computed from the cluster state seen after
+// the ledger held before, as the ledger. The nodes write to the ledger
+// concurrently, see mergeReservations.
+func (l *reservationLedger) replace(before map[string]string, reservations map[string]*reservation) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getOrCreateConfigMap(l.client, l.namespace, reservationsConfigMap)
+		if err != nil {
+			return err
+		}
+		data, err := mergeReservations(before, cm.Data, reservations)
+		if err != nil {
+			return err
+		}
+		if reflect.DeepEqual(data, cm.Data) || (len(data) == 0 && len(cm.Data) == 0) {
+			return nil
+		}
+		cm.Data = data
+		_, err = l.client.CoreV1().ConfigMaps(l.namespace).Update(cm)
+		return err
+	})
+}
+
+// mergeReservations returns the ledger data for the desired reservations,
+// given the data the ledger held before they were computed and the data it
+// holds now. Entries added or changed in between were reserved by a node
+// and are kept, entries removed in between were released by a node and
+// stay removed. Desired reservations already in the ledger keep their time.
+func mergeReservations(before, current map[string]string, desired map[string]*reservation) (map[string]string, error) {
+	data := map[string]string{}
+	for volumeId, r := range desired {
+		old, found := current[volumeId]
+		if _, existed := before[volumeId]; existed && !found {
+			continue
+		}
+		if found {
+			o := &reservation{}
+			if err := json.Unmarshal([]byte(old), o); err == nil && o.Node == r.Node {
+				r.Since = o.Since
+			}
+		}
+		value, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		data[volumeId] = string(value)
+	}
+	for volumeId, value := range current {
+		if old, existed := before[volumeId]; !existed || old != value {
+			data[volumeId] = value
+		}
+	}
+	return data, nil
+}
+
+// reconcileReservations reserves space for the volumes which are bound to
+// a node, by a scheduled pod or the scheduler's selected node, but whose
+// LV has not been created yet. Reservations are released once the PV is
+// annotated with the node of its LV or the claim is gone.
+func (cs *controllerServer) reconcileReservations() {
+	before, err := cs.reservations.snapshot()
+	if err != nil {
+		glog.Errorf("reconcileReservations: failed to get %s: %v", reservationsConfigMap, err)
+		return
+	}
+	pvs, err := cs.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("reconcileReservations: failed to list pvs: %v", err)
+		return
+	}
+	pods, err := cs.client.CoreV1().Pods("").List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("reconcileReservations: failed to list pods: %v", err)
+		return
+	}
+	claimNodes := map[string]string{}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				claimNodes[pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName] = pod.Spec.NodeName
+			}
+		}
+	}
+
+	reservations := map[string]*reservation{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != cs.driverName || pv.Spec.ClaimRef == nil {
+			continue
+		}
+		if pv.Annotations[lvmNodeAnnKey] != "" || getVolumeAttribute(pv, lvNameKey) != "" {
+			// created or imported
+			continue
+		}
+		claim := pv.Spec.ClaimRef
+		node := claimNodes[claim.Namespace+"/"+claim.Name]
+		if node == "" {
+			pvc, err := cs.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+			if err != nil || pvc.UID != claim.UID {
+				continue
+			}
+			node = pvc.Annotations[selectedNodeAnnKey]
+		}
+		if node == "" {
+			continue
+		}
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		reservations[pv.Name] = &reservation{
+			Node:   node,
+			VGName: cs.vgName,
+			Bytes:  capacity.Value(),
+			Since:  time.Now(),
+		}
+	}
+	if err := cs.reservations.replace(before, reservations); err != nil {
+		glog.Errorf("reconcileReservations: failed to update %s: %v", reservationsConfigMap, err)
+	}
+}
+
+// reserveVolume reserves size bytes of the VG of the node for volumeId
+// before its LV is created. It fails with ResourceExhausted if the free
+// space of the VG net of the reservations of other volumes is smaller.
+// The caller holds createMutex.
+func (ns *nodeServer) reserveVolume(ctx context.Context, volumeId string, size int64) error {
+	node := ns.GetNodeID()
+	free, err := getFreeBytes(ctx, ns.client, node, ns.vgName)
+	if err != nil {
+		return status.Errorf(lvmdCode(err), "Failed to get free space of %s: %v", ns.vgName, err)
+	}
+	reservations, err := ns.reservations.list()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to list reservations: %v", err)
+	}
+	reserved := reservedBytes(reservations, node, ns.vgName, volumeId)
+	if free-reserved < size {
+		return status.Errorf(codes.ResourceExhausted, "insufficient free space in %s for volume %s: %s free, %s reserved for other volumes, %s required",
+			ns.vgName, volumeId, formatSize(free), formatSize(reserved), formatSize(size))
+	}
+	if r, found := reservations[volumeId]; found && r.Node == node && r.VGName == ns.vgName && r.Bytes == size {
+		return nil
+	}
+	err = ns.reservations.reserve(volumeId, &reservation{
+		Node:   node,
+		VGName: ns.vgName,
+		Bytes:  size,
+		Since:  time.Now(),
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to reserve space for volume %s: %v", volumeId, err)
+	}
+	return nil
+}
+
+// getFreeBytes returns the free space of vgName on node.
+func getFreeBytes(ctx context.Context, client kubernetes.Interface, node, vgName string) (int64, error) {
+	conn, err := connectLVMD(client, node)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	vgs, err := conn.ListVG(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, vg := range vgs {
+		if vg.GetName() == vgName {
+			return int64(vg.GetFreeSize()), nil
+		}
+	}
+	return 0, fmt.Errorf("volume group %s not found on %s", vgName, node)
+}
+
+// getAvailableBytes returns the free space of vgName on node net of
+// reservations.
+func getAvailableBytes(ctx context.Context, client kubernetes.Interface, ledger *reservationLedger, node, vgName string) (int64, error) {
+	free, err := getFreeBytes(ctx, client, node, vgName)
+	if err != nil {
+		return 0, err
+	}
+	reserved, err := ledger.reserved(node, vgName)
+	if err != nil {
+		return 0, err
+	}
+	if free < reserved {
+		return 0, nil
+	}
+	return free - reserved, nil
+}
+
+// GetCapacity reports the free space net of reservations of the node in
+// the accessible topology, or of all nodes if none is given.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	var nodes []string
+	if node := req.GetAccessibleTopology().GetSegments()[NodeLabelKey]; node != "" {
+		nodes = []string{node}
+	} else {
+		list, err := cs.client.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for _, node := range list.Items {
+			nodes = append(nodes, node.Name)
+		}
+	}
+	var available int64
+	for _, node := range nodes {
+		bytes, err := getAvailableBytes(ctx, cs.client, cs.reservations, node, cs.vgName)
+		if err != nil {
+			glog.V(3).Infof("GetCapacity: skipping %s: %v", node, err)
+			continue
+		}
+		available += bytes
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
+// updateCapacity sets the extended resource of the node so that the
+// scheduler sees the free space of its VG net of reservations. The
+// scheduler subtracts the requests of the pods on the node from the
+// capacity, while the space of their volumes is already either allocated
+// or reserved, so these requests are added back.
+func (ns *nodeServer) updateCapacity() {
+	available, err := getAvailableBytes(context.Background(), ns.client, ns.reservations, ns.GetNodeID(), ns.vgName)
+	if err != nil {
+		glog.Errorf("updateCapacity: %v", err)
+		return
+	}
+	requested, err := getRequestedBytes(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("updateCapacity: %v", err)
+		return
+	}
+	node, err := getNode(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("updateCapacity: %v", err)
+		return
+	}
+	quantity := resource.NewQuantity(available+requested, resource.BinarySI)
+	if current, found := node.Status.Capacity[lvmResourceName]; found && current.Cmp(*quantity) == 0 {
+		return
+	}
+	patch := fmt.Sprintf(`{"status":{"capacity":{%q:%q}}}`, lvmResourceName, quantity.String())
+	if _, err := ns.client.CoreV1().Nodes().Patch(node.Name, types.StrategicMergePatchType, []byte(patch), "status"); err != nil {
+		glog.Errorf("updateCapacity: failed to patch %s: %v", node.Name, err)
+	}
+}
+
+// getRequestedBytes returns the sum of the requests of the extended
+// resource of the pods running on node.
+func getRequestedBytes(client kubernetes.Interface, node string) (int64, error) {
+	pods, err := client.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pods of %s: %v", node, err)
+	}
+	var requested int64
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if quantity, found := container.Resources.Requests[lvmResourceName]; found {
+				requested += quantity.Value()
+			}
+		}
+	}
+	return requested, nil
+}
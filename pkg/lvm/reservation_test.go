@@ -0,0 +1,157 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReservedBytes(t *testing.T) {
+	reservations := map[string]*reservation{
+		"pvc-1": {Node: "node-1", VGName: "k8s", Bytes: 1 << 30},
+		"pvc-2": {Node: "node-1", VGName: "k8s", Bytes: 2 << 30},
+		"pvc-3": {Node: "node-1", VGName: "hdd", Bytes: 4 << 30},
+		"pvc-4": {Node: "node-2", VGName: "k8s", Bytes: 8 << 30},
+	}
+	tests := []struct {
+		node     string
+		vgName   string
+		except   string
+		expected int64
+	}{
+		{"node-1", "k8s", "", 3 << 30},
+		{"node-1", "k8s", "pvc-2", 1 << 30},
+		{"node-1", "k8s", "pvc-4", 3 << 30},
+		{"node-1", "hdd", "", 4 << 30},
+		{"node-2", "k8s", "", 8 << 30},
+		{"node-3", "k8s", "", 0},
+	}
+	for _, test := range tests {
+		if bytes := reservedBytes(reservations, test.node, test.vgName, test.except); bytes != test.expected {
+			t.Errorf("%s/%s except %q: expected %d, got %d", test.node, test.vgName, test.except, test.expected, bytes)
+		}
+	}
+}
+
+func TestMergeReservations(t *testing.T) {
+	value := func(node string, bytes int64) string {
+		data, _ := json.Marshal(&reservation{Node: node, VGName: "k8s", Bytes: bytes})
+		return string(data)
+	}
+	tests := []struct {
+		name     string
+		before   map[string]string
+		current  map[string]string
+		desired  map[string]*reservation
+		expected map[string]string
+	}{
+		{
+			name:     "desired wins over unchanged entries",
+			before:   map[string]string{"pvc-1": value("node-1", 1), "pvc-2": value("node-1", 2)},
+			current:  map[string]string{"pvc-1": value("node-1", 1), "pvc-2": value("node-1", 2)},
+			desired:  map[string]*reservation{"pvc-3": {Node: "node-2", VGName: "k8s", Bytes: 3}},
+			expected: map[string]string{"pvc-3": value("node-2", 3)},
+		},
+		{
+			name:     "reserved by a node in between",
+			before:   map[string]string{},
+			current:  map[string]string{"pvc-1": value("node-1", 1)},
+			desired:  map[string]*reservation{},
+			expected: map[string]string{"pvc-1": value("node-1", 1)},
+		},
+		{
+			name:     "changed by a node in between",
+			before:   map[string]string{"pvc-1": value("node-1", 1)},
+			current:  map[string]string{"pvc-1": value("node-1", 2)},
+			desired:  map[string]*reservation{"pvc-1": {Node: "node-1", VGName: "k8s", Bytes: 1}},
+			expected: map[string]string{"pvc-1": value("node-1", 2)},
+		},
+		{
+			name:     "released by a node in between",
+			before:   map[string]string{"pvc-1": value("node-1", 1)},
+			current:  map[string]string{},
+			desired:  map[string]*reservation{"pvc-1": {Node: "node-1", VGName: "k8s", Bytes: 1}},
+			expected: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		data, err := mergeReservations(test.before, test.current, test.desired)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(data, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, data)
+		}
+	}
+}
+
+func TestReservationLedger(t *testing.T) {
+	client, _ := newFakeClient(t)
+	ledger := newReservationLedger(client, "kube-system")
+	if err := ledger.release("pvc-1"); err != nil {
+		t.Fatalf("release without ledger: %v", err)
+	}
+	for _, volumeId := range []string{"pvc-1", "pvc-2"} {
+		if err := ledger.reserve(volumeId, &reservation{Node: "node-1", VGName: "k8s", Bytes: 1 << 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.release("pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if reserved, err := ledger.reserved("node-1", "k8s"); err != nil || reserved != 1<<30 {
+		t.Errorf("expected %d reserved, got %d, %v", 1<<30, reserved, err)
+	}
+}
+
+func TestGetRequestedBytes(t *testing.T) {
+	pod := func(name, node string, phase v1.PodPhase, requests ...string) *v1.Pod {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: node},
+			Status:     v1.PodStatus{Phase: phase},
+		}
+		for _, request := range requests {
+			pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{lvmResourceName: resource.MustParse(request)},
+				},
+			})
+		}
+		return pod
+	}
+	client, _ := newFakeClient(t,
+		pod("running", "node-1", v1.PodRunning, "1Gi", "2Gi"),
+		pod("pending", "node-1", v1.PodPending, "4Gi"),
+		pod("succeeded", "node-1", v1.PodSucceeded, "8Gi"),
+		pod("other", "node-2", v1.PodRunning, "16Gi"),
+	)
+	requested, err := getRequestedBytes(client, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != 7<<30 {
+		t.Errorf("expected %d, got %d", 7<<30, requested)
+	}
+}
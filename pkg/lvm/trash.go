@@ -0,0 +1,327 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	trashTTLKey = "trashTTL"
+
+	// LVs in the trash carry the times they were trashed and are purged
+	// at as unix timestamps, the wipe policy to apply when purging and the
+	// storage class of their PV for restoring.
+	trashedTagPrefix      = "csi-lvm.trashed="
+	purgeAfterTagPrefix   = "csi-lvm.purge-after="
+	purgeWipeTagPrefix    = "csi-lvm.purge-wipe="
+	storageClassTagPrefix = "csi-lvm.storageclass="
+
+	// The node renames trashed LVs by appending trashLVSuffix, and back
+	// once restoreTag asks it to.
+	trashLVSuffix = "_trash"
+	restoreTag    = "csi-lvm.restore"
+
+	purgeInterval = time.Minute
+
+	provisionedByAnnKey = "pv.kubernetes.io/provisioned-by"
+)
+
+// trashVolume tags lv as trashed instead of removing it. The node renames
+// it to its trash name and purges it once ttl has passed.
+func trashVolume(ctx context.Context, conn lvmd.LVMConnection, vgName string, lv *lvmdproto.LogicalVolume, d *pendingDeletion) error {
+	if getTagValue(lv.GetTags(), trashedTagPrefix) != "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(d.TrashTTL)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tags := []string{
+		trashedTagPrefix + strconv.FormatInt(now.Unix(), 10),
+		purgeAfterTagPrefix + strconv.FormatInt(now.Add(ttl).Unix(), 10),
+	}
+	if d.WipePolicy != "" && d.WipePolicy != wipePolicyNone {
+		tags = append(tags, purgeWipeTagPrefix+d.WipePolicy)
+	}
+	if d.StorageClass != "" {
+		tags = append(tags, storageClassTagPrefix+d.StorageClass)
+	}
+	glog.Infof("Moving %s/%s to the trash for %v", vgName, lv.GetName(), ttl)
+	return conn.AddTagLV(ctx, vgName, lv.GetName(), tags)
+}
+
+func trashTags(tags []string) []string {
+	var trash []string
+	for _, tag := range tags {
+		for _, prefix := range []string{trashedTagPrefix, purgeAfterTagPrefix, purgeWipeTagPrefix, storageClassTagPrefix} {
+			if strings.HasPrefix(tag, prefix) {
+				trash = append(trash, tag)
+			}
+		}
+	}
+	return trash
+}
+
+// purgeTrash removes the trashed LVs of the node whose ttl has passed,
+// wiping them first according to their wipe policy.
+func (ns *nodeServer) purgeTrash() {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("purgeTrash: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lvs, err := conn.ListLV(ctx, ns.vgName)
+	if err != nil {
+		glog.Errorf("purgeTrash: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, lv := range lvs {
+		if renamed, err := ns.renameTrash(ctx, conn, lv); err != nil {
+			glog.Errorf("purgeTrash: %v", err)
+			continue
+		} else if renamed {
+			continue
+		}
+		value := getTagValue(lv.GetTags(), purgeAfterTagPrefix)
+		if value == "" {
+			continue
+		}
+		purgeAfter, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			glog.Errorf("purgeTrash: invalid purge time of %s/%s: %v", ns.vgName, lv.GetName(), err)
+			continue
+		}
+		if purgeAfter > now {
+			continue
+		}
+		if lv.GetAttributes().GetOpen() {
+			glog.Warningf("purgeTrash: %s/%s is still open, skip purging", ns.vgName, lv.GetName())
+			continue
+		}
+		if getTagValue(lv.GetTags(), cacheTagPrefix) != "" {
+			if err := uncacheVolume(ns.vgName, lv.GetName()); err != nil {
+				glog.Errorf("purgeTrash: %v", err)
+				continue
+			}
+		}
+		if policy := getTagValue(lv.GetTags(), purgeWipeTagPrefix); policy != "" {
+			devicePath := filepath.Join("/dev/", ns.vgName, lv.GetName())
+			if err := wipeDevice(devicePath, policy); err != nil {
+				glog.Errorf("purgeTrash: %v", err)
+				continue
+			}
+		}
+		if err := conn.RemoveLV(ctx, ns.vgName, lv.GetName()); err != nil {
+			glog.Errorf("purgeTrash: failed to remove %s/%s: %v", ns.vgName, lv.GetName(), err)
+			continue
+		}
+		glog.Infof("Purged %s/%s from the trash", ns.vgName, lv.GetName())
+	}
+}
+
+// renameTrash renames a trashed LV to its trash name, or a restored one
+// back to the name of its volume. It returns whether it renamed lv.
+func (ns *nodeServer) renameTrash(ctx context.Context, conn lvmd.LVMConnection, lv *lvmdproto.LogicalVolume) (bool, error) {
+	name := lv.GetName()
+	if hasTag(lv.GetTags(), restoreTag) {
+		return true, ns.restoreLV(ctx, conn, lv)
+	}
+	if getTagValue(lv.GetTags(), trashedTagPrefix) == "" || strings.HasSuffix(name, trashLVSuffix) {
+		return false, nil
+	}
+	if lv.GetAttributes().GetOpen() {
+		return false, fmt.Errorf("%s/%s is still open, not moving it to the trash", ns.vgName, name)
+	}
+	glog.Infof("Renaming trashed %s/%s to %s", ns.vgName, name, name+trashLVSuffix)
+	return true, lvRename(ns.vgName, name, name+trashLVSuffix)
+}
+
+// restoreLV renames an LV tagged with restoreTag back to the name of its
+// volume and removes its trash tags.
+func (ns *nodeServer) restoreLV(ctx context.Context, conn lvmd.LVMConnection, lv *lvmdproto.LogicalVolume) error {
+	name := lv.GetName()
+	if strings.HasSuffix(name, trashLVSuffix) {
+		restored := strings.TrimSuffix(name, trashLVSuffix)
+		glog.Infof("Restoring %s/%s as %s", ns.vgName, name, restored)
+		if err := lvRename(ns.vgName, name, restored); err != nil {
+			return err
+		}
+		name = restored
+	}
+	return conn.RemoveTagLV(ctx, ns.vgName, name, append(trashTags(lv.GetTags()), restoreTag))
+}
+
+// finishRestore restores the trashed LV of volumeId right away if it is
+// tagged with restoreTag, so that the volume is not created anew when the
+// PV is published before the node got to it.
+func (ns *nodeServer) finishRestore(ctx context.Context, volumeId string) error {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", ns.vgName, volumeId+trashLVSuffix))
+	if err != nil || len(lvs) == 0 || !hasTag(lvs[0].GetTags(), restoreTag) {
+		// lvmd fails to list volumes which do not exist
+		return nil
+	}
+	return ns.restoreLV(ctx, conn, lvs[0])
+}
+
+// findTrashedLV returns the trashed LV of volumeId, which has its trash
+// name unless the node did not rename it yet.
+func findTrashedLV(ctx context.Context, conn lvmd.LVMConnection, vgName, volumeId string) (*lvmdproto.LogicalVolume, error) {
+	for _, name := range []string{volumeId + trashLVSuffix, volumeId} {
+		lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", vgName, name))
+		if err != nil || len(lvs) == 0 {
+			continue
+		}
+		if getTagValue(lvs[0].GetTags(), trashedTagPrefix) == "" {
+			return nil, fmt.Errorf("volume %s/%s is not in the trash", vgName, name)
+		}
+		return lvs[0], nil
+	}
+	return nil, fmt.Errorf("volume %s/%s not found in the trash", vgName, volumeId)
+}
+
+// RestoreVolume takes a trashed LV out of the trash and recreates a PV
+// named after it, bound to its original node. If claim is given as
+// namespace/name, the PV is reserved for that PVC through its claimRef.
+func RestoreVolume(client kubernetes.Interface, driverName, node, vgName, volumeId, claim string) (*v1.PersistentVolume, error) {
+	var claimRef *v1.ObjectReference
+	if claim != "" {
+		parts := strings.Split(claim, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid claim %q, expected namespace/name", claim)
+		}
+		claimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: parts[0], Name: parts[1]}
+	}
+	if _, err := getPV(client, volumeId); err == nil {
+		return nil, fmt.Errorf("pv %s already exists", volumeId)
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	n, err := getNode(client, node)
+	if err != nil {
+		return nil, err
+	}
+	nodeAffinity, err := generateNodeAffinity(n)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := connectLVMD(client, node)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lv, err := findTrashedLV(ctx, conn, vgName, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("%v on node %s", err, node)
+	}
+	storageClass := getTagValue(lv.GetTags(), storageClassTagPrefix)
+	var attributes map[string]string
+	if storageClass != "" {
+		sc, err := client.StorageV1().StorageClasses().Get(storageClass, metav1.GetOptions{})
+		if err == nil {
+			attributes = sc.Parameters
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	// The node renames the LV back and removes its trash tags, which
+	// also keeps it from purging the LV under the PV.
+	if err := conn.AddTagLV(ctx, vgName, lv.GetName(), []string{restoreTag}); err != nil {
+		return nil, err
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: volumeId,
+			Annotations: map[string]string{
+				lvmNodeAnnKey:       node,
+				provisionedByAnnKey: driverName,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(int64(lv.GetSize()), resource.BinarySI),
+			},
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			StorageClassName:              storageClass,
+			ClaimRef:                      claimRef,
+			NodeAffinity:                  nodeAffinity,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           driverName,
+					VolumeHandle:     volumeId,
+					VolumeAttributes: attributes,
+				},
+			},
+		},
+	}
+	created, err := client.CoreV1().PersistentVolumes().Create(pv)
+	if err != nil {
+		if err := retrash(ctx, conn, vgName, volumeId, lv.GetTags()); err != nil {
+			glog.Errorf("Failed to move %s/%s back to the trash: %v", vgName, volumeId, err)
+		}
+		return nil, err
+	}
+	return created, nil
+}
+
+// retrash undoes a restore whose PV could not be created, the node may
+// have renamed the LV already.
+func retrash(ctx context.Context, conn lvmd.LVMConnection, vgName, volumeId string, tags []string) error {
+	for _, name := range []string{volumeId + trashLVSuffix, volumeId} {
+		lvs, err := conn.ListLV(ctx, fmt.Sprintf("%s/%s", vgName, name))
+		if err != nil || len(lvs) == 0 {
+			continue
+		}
+		if err := conn.AddTagLV(ctx, vgName, name, trashTags(tags)); err != nil {
+			return err
+		}
+		return conn.RemoveTagLV(ctx, vgName, name, []string{restoreTag})
+	}
+	return fmt.Errorf("volume %s/%s not found", vgName, volumeId)
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrashTags(t *testing.T) {
+	tags := []string{
+		wipedTag,
+		trashedTagPrefix + "100",
+		purgeAfterTagPrefix + "200",
+		"owner=db",
+		purgeWipeTagPrefix + wipePolicyZero,
+		storageClassTagPrefix + "lvm",
+	}
+	expected := []string{
+		trashedTagPrefix + "100",
+		purgeAfterTagPrefix + "200",
+		purgeWipeTagPrefix + wipePolicyZero,
+		storageClassTagPrefix + "lvm",
+	}
+	if trash := trashTags(tags); !reflect.DeepEqual(trash, expected) {
+		t.Errorf("trashTags = %v, want %v", trash, expected)
+	}
+	if trash := trashTags([]string{wipedTag}); len(trash) != 0 {
+		t.Errorf("trashTags = %v, want none", trash)
+	}
+}
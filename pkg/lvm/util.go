@@ -3,12 +3,23 @@ package lvm
 import (
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/golang/glog"
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/kubelet/apis"
 	utilnode "k8s.io/kubernetes/pkg/util/node"
 )
@@ -16,9 +27,34 @@ import (
 const (
 	lvmNodeAnnKey = "lvm/node"
 	NodeLabelKey  = apis.LabelHostname
-	lvmdPort      = "1736"
+
+	// Volume attributes of statically provisioned volumes importing an
+	// existing LV. Imported LVs are tagged with adoptedTag and never
+	// created nor removed by the driver.
+	vgNameKey      = "vgName"
+	lvNameKey      = "lvName"
+	neverFormatKey = "neverFormat"
+	adoptedTag     = "csi-lvm.adopted"
+
+	// formattedTag is added once a volume has a filesystem, volumes
+	// carrying it are never formatted again.
+	formattedTag = "csi-lvm.formatted"
+	// ownedTag is added once the root* ownership of a volume formatted
+	// by the driver is set.
+	ownedTag = "csi-lvm.owned"
+
+	// mountOptionsKey holds comma separated options for mounting the
+	// volume, the root* keys the owner and mode of the root directory of
+	// a newly formatted filesystem.
+	mountOptionsKey = "mountOptions"
+	rootUIDKey      = "rootUID"
+	rootGIDKey      = "rootGID"
+	rootModeKey     = "rootMode"
 )
 
+// lvmdPort is the port lvmd listens on on the nodes.
+var lvmdPort = "1736"
+
 func getLVMDAddr(client kubernetes.Interface, node string) (string, error) {
 	n, err := getNode(client, node)
 	if err != nil {
@@ -31,6 +67,44 @@ func getLVMDAddr(client kubernetes.Interface, node string) (string, error) {
 	return ip.String() + ":" + lvmdPort, nil
 }
 
+func connectLVMD(client kubernetes.Interface, node string) (lvmd.LVMConnection, error) {
+	addr, err := getLVMDAddr(client, node)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to getLVMDAddr for %v: %v", node, err)
+	}
+	conn, err := lvmd.NewLVMConnection(addr, connectTimeout)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "Failed to connect to %v: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// lvmdCode returns the gRPC code of an error of lvmd, e.g. Unavailable if
+// it could not be reached, or Internal if the error has none.
+func lvmdCode(err error) codes.Code {
+	if code := status.Code(err); code != codes.OK && code != codes.Unknown {
+		return code
+	}
+	return codes.Internal
+}
+
+func newEventRecorder(client kubernetes.Interface, component, host string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component, Host: host})
+}
+
+// getClaimRef returns the PVC bound to the PV of volumeId, or nil if there
+// is none.
+func getClaimRef(client kubernetes.Interface, volumeId string) *v1.ObjectReference {
+	pv, err := getPV(client, volumeId)
+	if err != nil {
+		return nil
+	}
+	return pv.Spec.ClaimRef
+}
+
 func updatePV(client kubernetes.Interface, pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
 	return client.CoreV1().PersistentVolumes().Update(pv)
 }
@@ -39,6 +113,13 @@ func getPV(client kubernetes.Interface, volumeId string) (*v1.PersistentVolume,
 	return client.CoreV1().PersistentVolumes().Get(volumeId, metav1.GetOptions{})
 }
 
+func getVolumeAttribute(pv *v1.PersistentVolume, key string) string {
+	if pv.Spec.CSI == nil {
+		return ""
+	}
+	return pv.Spec.CSI.VolumeAttributes[key]
+}
+
 func getNode(client kubernetes.Interface, nodeId string) (*v1.Node, error) {
 	return client.CoreV1().Nodes().Get(nodeId, metav1.GetOptions{})
 }
@@ -77,6 +158,97 @@ func generateNodeAffinity(node *v1.Node) (*v1.VolumeNodeAffinity, error) {
 	}, nil
 }
 
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// getTagValue returns the value of the first tag of the form prefix+value.
+func getTagValue(tags []string, prefix string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+func getMountOptions(attributes map[string]string) []string {
+	return splitList(attributes[mountOptionsKey])
+}
+
+// rootOwnership is the owner and mode of the root directory of a newly
+// formatted filesystem. An id of -1 keeps the owner or group unchanged.
+type rootOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+func getRootOwnership(attributes map[string]string) (*rootOwnership, error) {
+	if attributes[rootUIDKey] == "" && attributes[rootGIDKey] == "" && attributes[rootModeKey] == "" {
+		return nil, nil
+	}
+	o := &rootOwnership{uid: -1, gid: -1}
+	var err error
+	if value := attributes[rootUIDKey]; value != "" {
+		if o.uid, err = strconv.Atoi(value); err != nil || o.uid < 0 {
+			return nil, fmt.Errorf("invalid %s %q", rootUIDKey, value)
+		}
+	}
+	if value := attributes[rootGIDKey]; value != "" {
+		if o.gid, err = strconv.Atoi(value); err != nil || o.gid < 0 {
+			return nil, fmt.Errorf("invalid %s %q", rootGIDKey, value)
+		}
+		// Like kubelet does for fsGroup, let files created in the root
+		// directory inherit its group.
+		o.mode = 0775 | os.ModeSetgid
+	}
+	if value := attributes[rootModeKey]; value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("invalid %s %q", rootModeKey, value)
+		}
+		o.mode = os.FileMode(mode & 0777)
+		if mode&01000 != 0 {
+			o.mode |= os.ModeSticky
+		}
+		if mode&02000 != 0 || o.gid >= 0 {
+			o.mode |= os.ModeSetgid
+		}
+		if mode&04000 != 0 {
+			o.mode |= os.ModeSetuid
+		}
+	}
+	return o, nil
+}
+
+// pendingOwnership returns the ownership to set on the root directory of
+// a volume with attributes and tags, or nil if there is none or it has
+// been set already. formatting tells whether the volume is about to be
+// formatted, the filesystems of imported volumes are only given an
+// ownership if the driver formats them.
+func pendingOwnership(attributes map[string]string, tags []string, imported, formatting bool) (*rootOwnership, error) {
+	if hasTag(tags, ownedTag) || (imported && !formatting) {
+		return nil, nil
+	}
+	return getRootOwnership(attributes)
+}
+
+func (o *rootOwnership) apply(path string) error {
+	if err := os.Lchown(path, o.uid, o.gid); err != nil {
+		return err
+	}
+	if o.mode != 0 {
+		return os.Chmod(path, o.mode)
+	}
+	return nil
+}
+
 func formatDevice(devicePath, fstype string) error {
 	output, err := exec.Command("mkfs", "-t", fstype, devicePath).CombinedOutput()
 	if err != nil {
@@ -85,36 +257,84 @@ func formatDevice(devicePath, fstype string) error {
 	return nil
 }
 
+// signatureError is returned for devices holding signatures other than
+// a filesystem, e.g. partition tables or LUKS headers.
+type signatureError struct {
+	devicePath string
+	signatures map[string]string
+}
+
+func (e *signatureError) Error() string {
+	var found []string
+	for key, value := range e.signatures {
+		found = append(found, key+"="+value)
+	}
+	sort.Strings(found)
+	return fmt.Sprintf("device %s holds signatures %s, refusing to format or mount it", e.devicePath, strings.Join(found, " "))
+}
+
 func determineFilesystemType(devicePath string) (string, error) {
-	// We use `file -bsL` to determine whether any filesystem type is detected.
-	// If a filesystem is detected (ie., the output is not "data", we use
-	// `blkid` to determine what the filesystem is. We use `blkid` as `file`
-	// has inconvenient output.
-	// We do *not* use `lsblk` as that requires udev to be up-to-date which
-	// is often not the case when a device is erased using `dd`.
-	output, err := exec.Command("file", "-bsL", devicePath).CombinedOutput()
+	signatures, err := probeDevice(devicePath)
 	if err != nil {
 		return "", err
 	}
-	if strings.TrimSpace(string(output)) == "data" {
-		// No filesystem detected.
+	return filesystemType(devicePath, signatures)
+}
+
+// filesystemType returns the filesystem of the signatures of devicePath,
+// "" if there are none, or a signatureError for any other signature.
+func filesystemType(devicePath string, signatures map[string]string) (string, error) {
+	if len(signatures) == 0 {
+		// No signature detected.
 		return "", nil
 	}
-	// Some filesystem was detected, we use blkid to figure out what it is.
-	output, err = exec.Command("blkid", "-c", "/dev/null", "-o", "export", devicePath).CombinedOutput()
-	if err != nil {
-		return "", err
+	if signatures["USAGE"] != "filesystem" || signatures["TYPE"] == "" {
+		return "", &signatureError{devicePath: devicePath, signatures: signatures}
 	}
-	parseErr := errors.New("Cannot parse output of blkid.")
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		fields := strings.Split(strings.TrimSpace(line), "=")
-		if len(fields) != 2 {
-			return "", parseErr
+	return signatures["TYPE"], nil
+}
+
+// probeDevice returns the signatures found on devicePath by a low-level
+// probe of blkid, e.g. TYPE and USAGE of a filesystem or PTTYPE of a
+// partition table.
+// We do *not* use `lsblk` as that requires udev to be up-to-date which
+// is often not the case when a device is erased using `dd`, nor the blkid
+// cache which may be stale.
+func probeDevice(devicePath string) (map[string]string, error) {
+	output, err := exec.Command("blkid", "-p", "-o", "export", devicePath).CombinedOutput()
+	exitStatus := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("csi-lvm: probeDevice: %v", err)
+		}
+		ws, ok := exitErr.Sys().(syscall.WaitStatus)
+		if !ok {
+			return nil, fmt.Errorf("csi-lvm: probeDevice: %v: %s", err, output)
 		}
-		if fields[0] == "TYPE" {
-			return fields[1], nil
+		exitStatus = ws.ExitStatus()
+	}
+	return parseSignatures(string(output), exitStatus)
+}
+
+// parseSignatures parses the output of `blkid -p -o export` exiting with
+// exitStatus.
+func parseSignatures(output string, exitStatus int) (map[string]string, error) {
+	switch exitStatus {
+	case 0:
+	case 2:
+		// blkid exits with 2 if no signature is found.
+		return map[string]string{}, nil
+	default:
+		return nil, fmt.Errorf("csi-lvm: probeDevice: blkid exited with status %d: %s", exitStatus, output)
+	}
+	signatures := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(fields) != 2 || fields[0] == "DEVNAME" {
+			continue
 		}
+		signatures[fields[0]] = fields[1]
 	}
-	return "", parseErr
+	return signatures, nil
 }
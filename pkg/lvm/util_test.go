@@ -0,0 +1,141 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGetRootOwnership(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		ownership  *rootOwnership
+		invalid    bool
+	}{
+		{"none", map[string]string{}, nil, false},
+		{"uid", map[string]string{rootUIDKey: "1000"}, &rootOwnership{uid: 1000, gid: -1}, false},
+		{"gid sets setgid", map[string]string{rootGIDKey: "2000"}, &rootOwnership{uid: -1, gid: 2000, mode: 0775 | os.ModeSetgid}, false},
+		{"mode", map[string]string{rootModeKey: "0750"}, &rootOwnership{uid: -1, gid: -1, mode: 0750}, false},
+		{"mode with gid keeps setgid", map[string]string{rootGIDKey: "2000", rootModeKey: "0770"}, &rootOwnership{uid: -1, gid: 2000, mode: 0770 | os.ModeSetgid}, false},
+		{"special bits", map[string]string{rootModeKey: "7777"}, &rootOwnership{uid: -1, gid: -1, mode: 0777 | os.ModeSticky | os.ModeSetgid | os.ModeSetuid}, false},
+		{"negative uid", map[string]string{rootUIDKey: "-1"}, nil, true},
+		{"non numeric gid", map[string]string{rootGIDKey: "users"}, nil, true},
+		{"non octal mode", map[string]string{rootModeKey: "0789"}, nil, true},
+		{"mode too large", map[string]string{rootModeKey: "17777"}, nil, true},
+	}
+	for _, test := range tests {
+		ownership, err := getRootOwnership(test.attributes)
+		if (err != nil) != test.invalid {
+			t.Errorf("%s: getRootOwnership error = %v, want invalid %v", test.name, err, test.invalid)
+			continue
+		}
+		if !reflect.DeepEqual(ownership, test.ownership) {
+			t.Errorf("%s: getRootOwnership = %+v, want %+v", test.name, ownership, test.ownership)
+		}
+	}
+}
+
+func TestPendingOwnership(t *testing.T) {
+	attributes := map[string]string{rootUIDKey: "1000"}
+	owner := &rootOwnership{uid: 1000, gid: -1}
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		tags       []string
+		imported   bool
+		formatting bool
+		ownership  *rootOwnership
+	}{
+		{"formatting", attributes, nil, false, true, owner},
+		{"not yet set", attributes, []string{formattedTag}, false, false, owner},
+		{"set", attributes, []string{formattedTag, ownedTag}, false, false, nil},
+		{"no ownership", map[string]string{}, []string{formattedTag}, false, false, nil},
+		{"imported and formatting", attributes, []string{adoptedTag}, true, true, owner},
+		{"imported filesystem", attributes, []string{adoptedTag, formattedTag}, true, false, nil},
+	}
+	for _, test := range tests {
+		ownership, err := pendingOwnership(test.attributes, test.tags, test.imported, test.formatting)
+		if err != nil {
+			t.Errorf("%s: pendingOwnership error = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(ownership, test.ownership) {
+			t.Errorf("%s: pendingOwnership = %+v, want %+v", test.name, ownership, test.ownership)
+		}
+	}
+}
+
+func TestDetermineFilesystemType(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		exitStatus int
+		fstype     string
+		signature  bool
+		failed     bool
+	}{
+		{
+			name:       "empty device",
+			exitStatus: 2,
+		},
+		{
+			name:   "ext4",
+			output: "DEVNAME=/dev/k8s/pvc-1\nUUID=0b0d6a6c-2c7e-4f4d-9c8a-5d6f0e6c1a7b\nVERSION=1.0\nBLOCK_SIZE=4096\nTYPE=ext4\nUSAGE=filesystem\n",
+			fstype: "ext4",
+		},
+		{
+			name:      "LUKS",
+			output:    "DEVNAME=/dev/k8s/pvc-1\nUUID=4d9b1c3e-7f0a-4b5e-8d2c-1a6e9f3b7c5d\nVERSION=2\nTYPE=crypto_LUKS\nUSAGE=crypto\n",
+			signature: true,
+		},
+		{
+			name:      "partition table",
+			output:    "DEVNAME=/dev/k8s/pvc-1\nPTUUID=6a1f3c2e-9b4d-4e7a-8c5f-2d1b0e9a7c3f\nPTTYPE=gpt\n",
+			signature: true,
+		},
+		{
+			name:      "LVM physical volume",
+			output:    "DEVNAME=/dev/k8s/pvc-1\nUUID=Xw3c5e-0d1f-2g3h-4i5j-6k7l-8m9n-0o1p2q\nVERSION=LVM2 001\nTYPE=LVM2_member\nUSAGE=raid\n",
+			signature: true,
+		},
+		{
+			name:       "ambivalent probe",
+			output:     "DEVNAME=/dev/k8s/pvc-1\nambivalent result (probably more filesystems on the device, use wipefs(8) to see more details)\n",
+			exitStatus: 8,
+			failed:     true,
+		},
+	}
+	for _, test := range tests {
+		signatures, err := parseSignatures(test.output, test.exitStatus)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: parseSignatures error = %v, want failure %v", test.name, err, test.failed)
+			continue
+		} else if err != nil {
+			continue
+		}
+		fstype, err := filesystemType("/dev/k8s/pvc-1", signatures)
+		if _, ok := err.(*signatureError); ok != test.signature {
+			t.Errorf("%s: filesystemType error = %v, want signature error %v", test.name, err, test.signature)
+		}
+		if fstype != test.fstype {
+			t.Errorf("%s: filesystemType = %q, want %q", test.name, fstype, test.fstype)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// LVMVolumeGroupKind is the cluster scoped resource declaring the VGs
+	// of nodes, defined by deploy/kubernetes/lvmvolumegroup-crd.yaml.
+	LVMVolumeGroupKind  = "LVMVolumeGroup"
+	lvmVolumeGroupsPath = "/apis/" + LVMNodeGroupVersion + "/lvmvolumegroups"
+
+	provisionVolumeGroupsInterval = time.Minute
+
+	VolumeGroupPhaseReady   = "Ready"
+	VolumeGroupPhasePending = "Pending"
+	VolumeGroupPhaseFailed  = "Failed"
+)
+
+// LVMVolumeGroup declares a VG to be created on the matching nodes from
+// the matching devices. The node plugins report their progress in the
+// status.
+type LVMVolumeGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LVMVolumeGroupSpec   `json:"spec"`
+	Status LVMVolumeGroupStatus `json:"status,omitempty"`
+}
+
+type LVMVolumeGroupSpec struct {
+	// VGName is the name of the VG, defaults to the name of the object.
+	VGName string   `json:"vgName,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	// Devices are globs of the devices to use, e.g. /dev/sd[b-z] or
+	// /dev/disk/by-id/nvme-*.
+	Devices []string `json:"devices"`
+	// NodeName or NodeSelector select the nodes, all nodes if neither is
+	// set.
+	NodeName     string            `json:"nodeName,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Force allows using devices which hold signatures, e.g. filesystems
+	// or partition tables, wiping them.
+	Force bool `json:"force,omitempty"`
+}
+
+type LVMVolumeGroupStatus struct {
+	// Nodes holds the status of the VG on each selected node.
+	Nodes map[string]VolumeGroupNodeStatus `json:"nodes,omitempty"`
+}
+
+type VolumeGroupNodeStatus struct {
+	Phase           string   `json:"phase"`
+	PhysicalVolumes []string `json:"physicalVolumes,omitempty"`
+	// SkippedDevices are matching devices which were not used, with the
+	// reason.
+	SkippedDevices map[string]string `json:"skippedDevices,omitempty"`
+	Message        string            `json:"message,omitempty"`
+	UpdateTime     metav1.Time       `json:"updateTime"`
+}
+
+type lvmVolumeGroupList struct {
+	Items []LVMVolumeGroup `json:"items"`
+}
+
+func (ns *nodeServer) listVolumeGroupSpecs() ([]LVMVolumeGroup, error) {
+	data, err := ns.client.Discovery().RESTClient().Get().AbsPath(lvmVolumeGroupsPath).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := &lvmVolumeGroupList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (vg *LVMVolumeGroup) matches(node *v1.Node) bool {
+	if vg.Spec.NodeName != "" && vg.Spec.NodeName != node.Name {
+		return false
+	}
+	return labels.SelectorFromSet(vg.Spec.NodeSelector).Matches(labels.Set(node.Labels))
+}
+
+func (vg *LVMVolumeGroup) vgName() string {
+	if vg.Spec.VGName != "" {
+		return vg.Spec.VGName
+	}
+	return vg.Name
+}
+
+// provisionVolumeGroups creates and extends the VGs declared for the node.
+func (ns *nodeServer) provisionVolumeGroups() {
+	specs, err := ns.listVolumeGroupSpecs()
+	if err != nil {
+		glog.V(3).Infof("provisionVolumeGroups: failed to list LVMVolumeGroups: %v", err)
+		return
+	}
+	if len(specs) == 0 {
+		return
+	}
+	node, err := getNode(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("provisionVolumeGroups: %v", err)
+		return
+	}
+	for i := range specs {
+		vg := &specs[i]
+		if !vg.matches(node) {
+			continue
+		}
+		status := ns.provisionVolumeGroup(vg)
+		if err := ns.setVolumeGroupStatus(vg.Name, status); err != nil {
+			glog.Errorf("provisionVolumeGroups: failed to update status of %s: %v", vg.Name, err)
+		}
+	}
+}
+
+func (ns *nodeServer) provisionVolumeGroup(vg *LVMVolumeGroup) VolumeGroupNodeStatus {
+	vgName := vg.vgName()
+	status := VolumeGroupNodeStatus{
+		Phase:          VolumeGroupPhaseReady,
+		SkippedDevices: map[string]string{},
+		UpdateTime:     metav1.Now(),
+	}
+	fail := func(err error) VolumeGroupNodeStatus {
+		glog.Errorf("Failed to provision VG %s: %v", vgName, err)
+		status.Phase = VolumeGroupPhaseFailed
+		status.Message = err.Error()
+		return status
+	}
+
+	// pvs maps the devices which are PVs to their VG, "" for orphan PVs.
+	// pvs reports e.g. /dev/mapper names, which findDevices resolves.
+	reports, err := report("pvs", "pv", "-o", "pv_name,vg_name")
+	if err != nil {
+		return fail(err)
+	}
+	pvs := map[string]string{}
+	for _, pv := range reports {
+		device := resolveDevice(pv["pv_name"])
+		pvs[device] = pv["vg_name"]
+		if pv["vg_name"] == vgName {
+			status.PhysicalVolumes = append(status.PhysicalVolumes, device)
+		}
+	}
+
+	var devices []string
+	for _, device := range findDevices(vg.Spec.Devices) {
+		if owner, found := pvs[device]; found {
+			if owner == "" {
+				// an orphan PV, e.g. left by vgreduce, can be added
+				// without wiping its LVM label
+				devices = append(devices, device)
+			} else if owner != vgName {
+				status.SkippedDevices[device] = fmt.Sprintf("physical volume of VG %s", owner)
+			}
+			continue
+		}
+		signatures, err := probeDevice(device)
+		if err != nil {
+			status.SkippedDevices[device] = err.Error()
+			continue
+		}
+		if len(signatures) > 0 {
+			if !vg.Spec.Force {
+				status.SkippedDevices[device] = (&signatureError{devicePath: device, signatures: signatures}).Error()
+				continue
+			}
+			glog.Warningf("Wiping signatures of %s for VG %s", device, vgName)
+			if _, err := runLVM("wipefs", "-a", device); err != nil {
+				status.SkippedDevices[device] = err.Error()
+				continue
+			}
+		}
+		devices = append(devices, device)
+	}
+
+	if len(status.PhysicalVolumes) == 0 {
+		if len(devices) == 0 {
+			status.Phase = VolumeGroupPhasePending
+			status.Message = "no usable device found"
+			return status
+		}
+		conn, err := connectLVMD(ns.client, ns.GetNodeID())
+		if err != nil {
+			return fail(err)
+		}
+		defer conn.Close()
+		glog.Infof("Creating VG %s on %s", vgName, devices[0])
+		if err := conn.CreateVG(context.Background(), vgName, devices[0], vg.Spec.Tags); err != nil {
+			return fail(err)
+		}
+		status.PhysicalVolumes = append(status.PhysicalVolumes, devices[0])
+		devices = devices[1:]
+	}
+	for _, device := range devices {
+		glog.Infof("Extending VG %s with %s", vgName, device)
+		if _, err := runLVM("vgextend", "-y", vgName, device); err != nil {
+			return fail(err)
+		}
+		status.PhysicalVolumes = append(status.PhysicalVolumes, device)
+	}
+	sort.Strings(status.PhysicalVolumes)
+	if len(status.SkippedDevices) > 0 {
+		status.Message = fmt.Sprintf("%d matching devices skipped", len(status.SkippedDevices))
+	}
+	return status
+}
+
+// findDevices returns the devices matching the globs, with symlinks such
+// as /dev/disk/by-id resolved.
+func findDevices(globs []string) []string {
+	found := map[string]bool{}
+	for _, glob := range globs {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			glog.Errorf("Invalid device glob %q: %v", glob, err)
+			continue
+		}
+		for _, match := range matches {
+			if device := resolveDevice(match); strings.HasPrefix(device, "/dev/") {
+				found[device] = true
+			}
+		}
+	}
+	var devices []string
+	for device := range found {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// resolveDevice returns the device path resolves to, or path if it
+// cannot be resolved.
+func resolveDevice(path string) string {
+	device, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return device
+}
+
+// volumeGroupStatusChanged returns whether the status of a node differs
+// from the one reported before, apart from the time of the update.
+func volumeGroupStatusChanged(old, new VolumeGroupNodeStatus) bool {
+	normalize := func(s VolumeGroupNodeStatus) VolumeGroupNodeStatus {
+		s.UpdateTime = metav1.Time{}
+		if len(s.PhysicalVolumes) == 0 {
+			s.PhysicalVolumes = nil
+		}
+		if len(s.SkippedDevices) == 0 {
+			s.SkippedDevices = nil
+		}
+		return s
+	}
+	return !reflect.DeepEqual(normalize(old), normalize(new))
+}
+
+// setVolumeGroupStatus sets the status of the node in the LVMVolumeGroup
+// name if it changed, other nodes update theirs concurrently.
+func (ns *nodeServer) setVolumeGroupStatus(name string, status VolumeGroupNodeStatus) error {
+	rest := ns.client.Discovery().RESTClient()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		data, err := rest.Get().AbsPath(lvmVolumeGroupsPath, name).Do().Raw()
+		if err != nil {
+			return err
+		}
+		vg := &LVMVolumeGroup{}
+		if err := json.Unmarshal(data, vg); err != nil {
+			return err
+		}
+		if old, found := vg.Status.Nodes[ns.GetNodeID()]; found && !volumeGroupStatusChanged(old, status) {
+			return nil
+		}
+		if vg.Status.Nodes == nil {
+			vg.Status.Nodes = map[string]VolumeGroupNodeStatus{}
+		}
+		vg.Status.Nodes[ns.GetNodeID()] = status
+		if data, err = json.Marshal(vg); err != nil {
+			return err
+		}
+		return rest.Put().AbsPath(lvmVolumeGroupsPath, name).Body(data).Do().Error()
+	})
+}
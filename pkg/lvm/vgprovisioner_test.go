@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolve-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// /dev/mapper/<vg>-<lv> and /dev/disk/by-id/* are symlinks to dm-*
+	// and sd* devices
+	device := filepath.Join(dir, "dm-3")
+	if err := ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "mpatha")
+	if err := os.Symlink("dm-3", link); err != nil {
+		t.Fatal(err)
+	}
+	device, _ = filepath.EvalSymlinks(device)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{link, device},
+		{device, device},
+		{filepath.Join(dir, "missing"), filepath.Join(dir, "missing")},
+	}
+	for _, test := range tests {
+		if resolved := resolveDevice(test.path); resolved != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.path, test.expected, resolved)
+		}
+	}
+}
+
+func TestVolumeGroupStatusChanged(t *testing.T) {
+	ready := VolumeGroupNodeStatus{
+		Phase:           VolumeGroupPhaseReady,
+		PhysicalVolumes: []string{"/dev/sdb"},
+		SkippedDevices:  map[string]string{},
+		UpdateTime:      metav1.NewTime(time.Unix(1000, 0)),
+	}
+	withPV := ready
+	withPV.PhysicalVolumes = []string{"/dev/sdb", "/dev/sdc"}
+	withSkipped := ready
+	withSkipped.SkippedDevices = map[string]string{"/dev/sdd": "physical volume of VG other"}
+	reported := ready
+	reported.SkippedDevices = nil
+	reported.UpdateTime = metav1.NewTime(time.Unix(0, 0))
+	failed := ready
+	failed.Phase = VolumeGroupPhaseFailed
+	failed.Message = "vgextend failed"
+
+	tests := []struct {
+		name    string
+		old     VolumeGroupNodeStatus
+		changed bool
+	}{
+		{"same", ready, false},
+		{"only the time differs", reported, false},
+		{"phase", failed, true},
+		{"physical volume added", withPV, true},
+		{"device skipped", withSkipped, true},
+	}
+	for _, test := range tests {
+		if changed := volumeGroupStatusChanged(test.old, ready); changed != test.changed {
+			t.Errorf("%s: volumeGroupStatusChanged = %v, want %v", test.name, changed, test.changed)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The admission.k8s.io/v1beta1 types are not vendored, these are the
+// fields the webhook uses.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID                   `json:"uid"`
+	Kind      metav1.GroupVersionKind     `json:"kind"`
+	Resource  metav1.GroupVersionResource `json:"resource"`
+	Name      string                      `json:"name,omitempty"`
+	Namespace string                      `json:"namespace,omitempty"`
+	Operation string                      `json:"operation"`
+	Object    json.RawMessage             `json:"object,omitempty"`
+	OldObject json.RawMessage             `json:"oldObject,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       types.UID      `json:"uid"`
+	Allowed   bool           `json:"allowed"`
+	Result    *metav1.Status `json:"status,omitempty"`
+	Patch     []byte         `json:"patch,omitempty"`
+	PatchType *string        `json:"patchType,omitempty"`
+}
+
+var jsonPatchType = "JSONPatch"
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// AdmissionWebhook is an HTTPS admission webhook. It sets the request of
+// the extended resource paas.com/lvm of pods to the size of their volumes
+// of the driver which have no LV yet, and rejects pods whose volumes of
+// the driver cannot fit into the VG of any node. It adds
+// protectionFinalizer to PVCs of the driver as soon as they are annotated
+// protected. It also rejects StorageClasses of the driver with unknown or
+// invalid parameters.
+type AdmissionWebhook struct {
+	client     kubernetes.Interface
+	driverName string
+	vgName     string
+}
+
+func NewAdmissionWebhook(client kubernetes.Interface, driverName, vgName string) *AdmissionWebhook {
+	return &AdmissionWebhook{
+		client:     client,
+		driverName: driverName,
+		vgName:     vgName,
+	}
+}
+
+// Handler returns the handler of the mutating webhook on /mutate and of
+// the validating webhook on /validate.
+func (a *AdmissionWebhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", func(w http.ResponseWriter, r *http.Request) {
+		serveAdmission(w, r, a.mutate)
+	})
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		serveAdmission(w, r, a.validate)
+	})
+	return mux
+}
+
+func serveAdmission(w http.ResponseWriter, r *http.Request, admit func(*admissionRequest) *admissionResponse) {
+	review := &admissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	response := admit(review.Request)
+	response.UID = review.Request.UID
+	writeJSON(w, &admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   response,
+	})
+}
+
+func allow() *admissionResponse {
+	return &admissionResponse{Allowed: true}
+}
+
+func deny(reason metav1.StatusReason, format string, args ...interface{}) *admissionResponse {
+	return &admissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  reason,
+			Message: fmt.Sprintf(format, args...),
+			Code:    http.StatusForbidden,
+		},
+	}
+}
+
+func (a *AdmissionWebhook) mutate(req *admissionRequest) *admissionResponse {
+	if req.Kind.Kind == "PersistentVolumeClaim" && (req.Operation == "CREATE" || req.Operation == "UPDATE") {
+		return a.mutateClaim(req)
+	}
+	if req.Kind.Kind != "Pod" || req.Operation != "CREATE" {
+		return allow()
+	}
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object, pod); err != nil {
+		return deny(metav1.StatusReasonBadRequest, "cannot decode pod: %v", err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	demand, err := getPodDemand(a.client, a.driverName, pod)
+	if err != nil {
+		// e.g. a claim created after the pod, let the scheduler wait
+		// for it without a request
+		glog.Warningf("Not setting %s of pod %s/%s: %v", lvmResourceName, pod.Namespace, pod.GenerateName+pod.Name, err)
+		return allow()
+	}
+
+	if demand.total > 0 {
+		largest, err := a.getLargestVG()
+		if err != nil {
+			glog.Warningf("Not checking the volumes of pod %s/%s: %v", pod.Namespace, pod.GenerateName+pod.Name, err)
+		} else if largest > 0 && demand.total > largest {
+			return deny(metav1.StatusReasonForbidden, "the %s volumes of the pod need %s, more than the largest volume group %s of any node (%s)",
+				a.driverName, resource.NewQuantity(demand.total, resource.BinarySI), a.vgName, resource.NewQuantity(largest, resource.BinarySI))
+		}
+	}
+
+	patch := resourcePatch(pod, demand.bytes)
+	if len(patch) == 0 {
+		return allow()
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(metav1.StatusReasonInternalError, "cannot encode patch: %v", err)
+	}
+	glog.V(3).Infof("Raising %s of pod %s/%s to at least %d", lvmResourceName, pod.Namespace, pod.GenerateName+pod.Name, demand.bytes)
+	return &admissionResponse{
+		Allowed:   true,
+		Patch:     data,
+		PatchType: &jsonPatchType,
+	}
+}
+
+// mutateClaim adds protectionFinalizer to a protected PVC of the driver
+// and removes it once the PVC is no longer protected, like the leading
+// controller does, but without leaving a window in which a PVC annotated
+// protected can be deleted before the controller notices.
+func (a *AdmissionWebhook) mutateClaim(req *admissionRequest) *admissionResponse {
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(req.Object, pvc); err != nil {
+		return deny(metav1.StatusReasonBadRequest, "cannot decode persistent volume claim: %v", err)
+	}
+	if pvc.Namespace == "" {
+		pvc.Namespace = req.Namespace
+	}
+	patch := finalizerPatch(pvc.Finalizers, isProtected(pvc.Annotations))
+	if len(patch) == 0 {
+		return allow()
+	}
+	ours, err := isDriverClaim(a.client, a.driverName, pvc)
+	if err != nil {
+		// the controller still reconciles the finalizer within a minute
+		glog.Warningf("Not checking the protection of pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return allow()
+	} else if !ours {
+		return allow()
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return deny(metav1.StatusReasonInternalError, "cannot encode patch: %v", err)
+	}
+	glog.V(3).Infof("Setting finalizer %s of pvc %s/%s to %t", protectionFinalizer, pvc.Namespace, pvc.Name, isProtected(pvc.Annotations))
+	return &admissionResponse{
+		Allowed:   true,
+		Patch:     data,
+		PatchType: &jsonPatchType,
+	}
+}
+
+// finalizerPatch returns the patch adding protectionFinalizer to
+// finalizers if protected and removing it otherwise.
+func finalizerPatch(finalizers []string, protected bool) []jsonPatchOperation {
+	var others []string
+	found := false
+	for _, f := range finalizers {
+		if f == protectionFinalizer {
+			found = true
+		} else {
+			others = append(others, f)
+		}
+	}
+	switch {
+	case found == protected:
+		return nil
+	case protected && len(finalizers) == 0:
+		return []jsonPatchOperation{{Op: "add", Path: "/metadata/finalizers", Value: []string{protectionFinalizer}}}
+	case protected:
+		return []jsonPatchOperation{{Op: "add", Path: "/metadata/finalizers/-", Value: protectionFinalizer}}
+	case len(others) == 0:
+		return []jsonPatchOperation{{Op: "remove", Path: "/metadata/finalizers"}}
+	}
+	return []jsonPatchOperation{{Op: "replace", Path: "/metadata/finalizers", Value: others}}
+}
+
+// isDriverClaim returns whether pvc is bound to a PV of the driver or,
+// while unbound, asks for a StorageClass of the driver.
+func isDriverClaim(client kubernetes.Interface, driverName string, pvc *v1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.VolumeName != "" {
+		pv, err := getPV(client, pvc.Spec.VolumeName)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName, nil
+	}
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+	sc, err := client.StorageV1().StorageClasses().Get(*pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return sc.Provisioner == driverName, nil
+}
+
+func (a *AdmissionWebhook) validate(req *admissionRequest) *admissionResponse {
+	if req.Kind.Kind != "StorageClass" || req.Operation != "CREATE" {
+		return allow()
+	}
+	class := &storagev1.StorageClass{}
+	if err := json.Unmarshal(req.Object, class); err != nil {
+		return deny(metav1.StatusReasonBadRequest, "cannot decode storage class: %v", err)
+	}
+	if class.Provisioner != a.driverName {
+		return allow()
+	}
+	if err := validateParameters(class.Parameters); err != nil {
+		glog.V(3).Infof("Rejecting storage class %s: %v", class.Name, err)
+		return deny(metav1.StatusReasonInvalid, "storage class %s: %v", class.Name, err)
+	}
+	return allow()
+}
+
+// resourcePatch returns the patch making the requests of paas.com/lvm of
+// the containers of pod add up to at least bytes. Requests set by the user
+// are kept, the missing bytes are added to the first container. As
+// extended resources cannot be overcommitted, its limit is set to its
+// request.
+func resourcePatch(pod *v1.Pod, bytes int64) []jsonPatchOperation {
+	if bytes <= 0 || len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+	var requested int64
+	for i := range pod.Spec.Containers {
+		requested += containerRequest(&pod.Spec.Containers[i])
+	}
+	if requested >= bytes {
+		return nil
+	}
+	resources := *pod.Spec.Containers[0].Resources.DeepCopy()
+	quantity := resource.NewQuantity(containerRequest(&pod.Spec.Containers[0])+bytes-requested, resource.BinarySI)
+	for _, list := range []*v1.ResourceList{&resources.Requests, &resources.Limits} {
+		if *list == nil {
+			*list = v1.ResourceList{}
+		}
+		(*list)[lvmResourceName] = *quantity
+	}
+	return []jsonPatchOperation{{
+		Op:    "add",
+		Path:  "/spec/containers/0/resources",
+		Value: resources,
+	}}
+}
+
+// containerRequest returns the request of paas.com/lvm of container, which
+// defaults to its limit.
+func containerRequest(container *v1.Container) int64 {
+	if request, found := container.Resources.Requests[lvmResourceName]; found {
+		return request.Value()
+	}
+	limit := container.Resources.Limits[lvmResourceName]
+	return limit.Value()
+}
+
+// getLargestVG returns the size of the largest VG of the driver reported
+// by the LVMNodes, or 0 if there is none.
+func (a *AdmissionWebhook) getLargestVG() (int64, error) {
+	nodes, err := ListLVMNodes(a.client)
+	if err != nil {
+		return 0, err
+	}
+	var largest int64
+	for _, node := range nodes {
+		for _, vg := range node.Status.VolumeGroups {
+			if vg.Name == a.vgName && vg.Size > largest {
+				largest = vg.Size
+			}
+		}
+	}
+	return largest, nil
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionPatch runs the mutating webhook on object and returns the
+// decoded patch of an allowed request.
+func admissionPatch(t *testing.T, a *AdmissionWebhook, kind, operation string, object interface{}) []jsonPatchOperation {
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := a.mutate(&admissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Namespace: "default",
+		Operation: operation,
+		Object:    data,
+	})
+	if !response.Allowed {
+		t.Fatalf("%s %s denied: %+v", operation, kind, response.Result)
+	}
+	var patch []jsonPatchOperation
+	if len(response.Patch) > 0 {
+		if err := json.Unmarshal(response.Patch, &patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return patch
+}
+
+func TestFinalizerPatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		finalizers []string
+		protected  bool
+		expected   []jsonPatchOperation
+	}{
+		{"unprotected", nil, false, nil},
+		{"already protected", []string{"kubernetes.io/pvc-protection", protectionFinalizer}, true, nil},
+		{"first finalizer", nil, true, []jsonPatchOperation{
+			{Op: "add", Path: "/metadata/finalizers", Value: []string{protectionFinalizer}}}},
+		{"other finalizers", []string{"kubernetes.io/pvc-protection"}, true, []jsonPatchOperation{
+			{Op: "add", Path: "/metadata/finalizers/-", Value: protectionFinalizer}}},
+		{"last finalizer", []string{protectionFinalizer}, false, []jsonPatchOperation{
+			{Op: "remove", Path: "/metadata/finalizers"}}},
+		{"keep other finalizers", []string{"kubernetes.io/pvc-protection", protectionFinalizer}, false, []jsonPatchOperation{
+			{Op: "replace", Path: "/metadata/finalizers", Value: []string{"kubernetes.io/pvc-protection"}}}},
+	}
+	for _, test := range tests {
+		if patch := finalizerPatch(test.finalizers, test.protected); !reflect.DeepEqual(patch, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, patch)
+		}
+	}
+}
+
+func TestMutateClaimProtection(t *testing.T) {
+	lvm, other := "lvm", "other"
+	client, _ := newFakeClient(t,
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: lvm}, Provisioner: "csi-lvmplugin"},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: other}, Provisioner: "kubernetes.io/no-provisioner"},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "csi-lvmplugin", VolumeHandle: "pvc-1"},
+			}},
+		},
+	)
+	a := NewAdmissionWebhook(client, "csi-lvmplugin", "k8s")
+	protected := map[string]string{protectedAnnKey: "true"}
+	add := []jsonPatchOperation{{Op: "add", Path: "/metadata/finalizers", Value: []interface{}{protectionFinalizer}}}
+	tests := []struct {
+		name      string
+		operation string
+		pvc       *v1.PersistentVolumeClaim
+		expected  []jsonPatchOperation
+	}{
+		{
+			name:      "created protected",
+			operation: "CREATE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: protected},
+				Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &lvm},
+			},
+			expected: add,
+		},
+		{
+			name:      "bound and annotated",
+			operation: "UPDATE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: protected},
+				Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &other, VolumeName: "pvc-1"},
+			},
+			expected: add,
+		},
+		{
+			name:      "annotation removed",
+			operation: "UPDATE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Finalizers: []string{protectionFinalizer}},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pvc-1"},
+			},
+			expected: []jsonPatchOperation{{Op: "remove", Path: "/metadata/finalizers"}},
+		},
+		{
+			name:      "other provisioner",
+			operation: "CREATE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: protected},
+				Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &other},
+			},
+		},
+		{
+			name:      "unknown volume",
+			operation: "UPDATE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: protected},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-gone"},
+			},
+		},
+		{
+			name:      "deleted",
+			operation: "DELETE",
+			pvc: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: protected},
+				Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &lvm},
+			},
+		},
+	}
+	for _, test := range tests {
+		if patch := admissionPatch(t, a, "PersistentVolumeClaim", test.operation, test.pvc); !reflect.DeepEqual(patch, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, patch)
+		}
+	}
+}
+
+// lvmContainer returns a container requesting request and limiting limit
+// of paas.com/lvm, if set.
+func lvmContainer(request, limit string) v1.Container {
+	container := v1.Container{
+		Name: "c",
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+		},
+	}
+	if request != "" {
+		container.Resources.Requests[lvmResourceName] = resource.MustParse(request)
+	}
+	if limit != "" {
+		container.Resources.Limits = v1.ResourceList{lvmResourceName: resource.MustParse(limit)}
+	}
+	return container
+}
+
+func TestResourcePatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []v1.Container
+		bytes      int64
+		expected   string
+	}{
+		{"no demand", []v1.Container{lvmContainer("", "")}, 0, ""},
+		{"no containers", nil, gib(1), ""},
+		{"first container", []v1.Container{lvmContainer("", ""), lvmContainer("", "")}, gib(1), "1Gi"},
+		{"user request kept", []v1.Container{lvmContainer("2Gi", "2Gi")}, gib(1), ""},
+		{"user request raised", []v1.Container{lvmContainer("1Gi", "1Gi")}, gib(3), "3Gi"},
+		{"limit as request", []v1.Container{lvmContainer("", "1Gi")}, gib(3), "3Gi"},
+		{"other containers kept", []v1.Container{lvmContainer("", ""), lvmContainer("1Gi", "1Gi")}, gib(3), "2Gi"},
+		{"other containers cover it", []v1.Container{lvmContainer("", ""), lvmContainer("4Gi", "4Gi")}, gib(3), ""},
+	}
+	for _, test := range tests {
+		pod := &v1.Pod{Spec: v1.PodSpec{Containers: test.containers}}
+		patch := resourcePatch(pod, test.bytes)
+		if test.expected == "" {
+			if len(patch) != 0 {
+				t.Errorf("%s: expected no patch, got %+v", test.name, patch)
+			}
+			continue
+		}
+		if len(patch) != 1 || patch[0].Path != "/spec/containers/0/resources" {
+			t.Errorf("%s: expected a patch of the first container, got %+v", test.name, patch)
+			continue
+		}
+		resources := patch[0].Value.(v1.ResourceRequirements)
+		expected := resource.MustParse(test.expected)
+		request, limit := resources.Requests[lvmResourceName], resources.Limits[lvmResourceName]
+		if request.Cmp(expected) != 0 || limit.Cmp(expected) != 0 {
+			t.Errorf("%s: expected request and limit %s, got %s and %s", test.name, test.expected, request.String(), limit.String())
+		}
+		if cpu := resources.Requests[v1.ResourceCPU]; cpu.String() != "1" {
+			t.Errorf("%s: expected the cpu request to be kept, got %s", test.name, cpu.String())
+		}
+	}
+}
+
+func TestMutatePod(t *testing.T) {
+	client, server := newFakeClient(t, demandObjects()...)
+	server.add(lvmNodesPath+"/node-1", &LVMNode{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status:     LVMNodeStatus{VolumeGroups: []VolumeGroupStatus{{Name: "k8s", Size: gib(12)}, {Name: "hdd", Size: gib(100)}}},
+	})
+	a := NewAdmissionWebhook(client, "csi-lvmplugin", "k8s")
+
+	pod := demandPod("unbound", "pending")
+	pod.Spec.Containers = []v1.Container{lvmContainer("", ""), lvmContainer("1Gi", "1Gi")}
+	patch := admissionPatch(t, a, "Pod", "CREATE", pod)
+	if len(patch) != 1 || patch[0].Path != "/spec/containers/0/resources" {
+		t.Fatalf("expected a patch of the first container, got %+v", patch)
+	}
+	data, _ := json.Marshal(patch[0].Value)
+	resources := v1.ResourceRequirements{}
+	if err := json.Unmarshal(data, &resources); err != nil {
+		t.Fatal(err)
+	}
+	// 2Gi unbound and 8Gi without LV, of which the second container
+	// already requests 1Gi
+	if request := resources.Requests[lvmResourceName]; request.Value() != gib(9) {
+		t.Errorf("expected a request of 9Gi, got %s", request.String())
+	}
+
+	for _, operation := range []string{"UPDATE", "DELETE"} {
+		if patch := admissionPatch(t, a, "Pod", operation, pod); len(patch) != 0 {
+			t.Errorf("%s: expected no patch, got %+v", operation, patch)
+		}
+	}
+	// a claim which does not exist yet leaves the pod to the scheduler
+	if patch := admissionPatch(t, a, "Pod", "CREATE", demandPod("unbound", "missing")); len(patch) != 0 {
+		t.Errorf("expected no patch for a missing claim, got %+v", patch)
+	}
+
+	// 2Gi + 8Gi + 4Gi with LV exceed the largest VG k8s of 12Gi
+	data, _ = json.Marshal(demandPod("unbound", "pending", "created"))
+	response := a.mutate(&admissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: "CREATE",
+		Object:    data,
+	})
+	if response.Allowed || response.Result.Reason != metav1.StatusReasonForbidden {
+		t.Errorf("expected the pod to be rejected, got %+v", response)
+	}
+}
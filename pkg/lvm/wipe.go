@@ -0,0 +1,221 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	lvmdproto "github.com/google/lvmd/proto"
+	"golang.org/x/net/context"
+
+	"github.com/wavezhang/k8s-csi-lvm/pkg/lvmd"
+)
+
+const (
+	wipePolicyKey = "wipePolicy"
+
+	wipePolicyNone    = "none"
+	wipePolicyDiscard = "discard"
+	wipePolicyZero    = "zero"
+	wipePolicyFull    = "full"
+
+	// wipeTagPrefix is followed by the policy the node has to apply,
+	// e.g. "csi-lvm.wipe=zero".
+	wipeTagPrefix = "csi-lvm.wipe="
+	wipedTag      = "csi-lvm.wiped"
+
+	wipeInterval = 10 * time.Second
+
+	// createWipePolicyKey is how the node wipes a new LV before its first
+	// use, so that signatures left on its extents by an earlier volume are
+	// not mistaken for its filesystem.
+	createWipePolicyKey = "createWipePolicy"
+
+	createWipePolicyNone       = "none"
+	createWipePolicySignatures = "signatures"
+	createWipePolicyHeader     = "header"
+	createWipePolicyFull       = "full"
+
+	// createWipeTagPrefix is added on creation, followed by the policy,
+	// and createWipedTag once the LV has been wiped.
+	createWipeTagPrefix = "csi-lvm.create-wipe="
+	createWipedTag      = "csi-lvm.create-wiped"
+)
+
+func validWipePolicy(policy string) bool {
+	switch policy {
+	case "", wipePolicyNone, wipePolicyDiscard, wipePolicyZero, wipePolicyFull:
+		return true
+	}
+	return false
+}
+
+// requestWipe asks the node hosting lv to wipe it according to policy.
+// It returns true once the LV has been wiped and may be removed.
+func requestWipe(ctx context.Context, conn lvmd.LVMConnection, vgName string, lv *lvmdproto.LogicalVolume, policy string) (bool, error) {
+	if policy == "" || policy == wipePolicyNone || hasTag(lv.GetTags(), wipedTag) {
+		return true, nil
+	}
+	if getTagValue(lv.GetTags(), wipeTagPrefix) == "" {
+		glog.V(3).Infof("requesting %s wipe of %s/%s", policy, vgName, lv.GetName())
+		if err := conn.AddTagLV(ctx, vgName, lv.GetName(), []string{wipeTagPrefix + policy}); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// wipeVolumes wipes every LV of the node which has been tagged for wiping
+// by DeleteVolume, then marks it as wiped so that it can be removed.
+func (ns *nodeServer) wipeVolumes() {
+	conn, err := connectLVMD(ns.client, ns.GetNodeID())
+	if err != nil {
+		glog.Errorf("wipeVolumes: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	lvs, err := conn.ListLV(ctx, ns.vgName)
+	if err != nil {
+		glog.Errorf("wipeVolumes: failed to list volumes of %s: %v", ns.vgName, err)
+		return
+	}
+	for _, lv := range lvs {
+		policy := getTagValue(lv.GetTags(), wipeTagPrefix)
+		if policy == "" || hasTag(lv.GetTags(), wipedTag) {
+			continue
+		}
+		if hasTag(lv.GetTags(), lvmd.ProtectedTag) {
+			glog.Warningf("wipeVolumes: %s/%s is protected, skip wiping", ns.vgName, lv.GetName())
+			continue
+		}
+		if lv.GetAttributes().GetOpen() {
+			glog.Warningf("wipeVolumes: %s/%s is still open, skip wiping", ns.vgName, lv.GetName())
+			continue
+		}
+		devicePath := filepath.Join("/dev/", ns.vgName, lv.GetName())
+		glog.Infof("Wiping %s with policy %s", devicePath, policy)
+		if err := wipeDevice(devicePath, policy); err != nil {
+			glog.Errorf("wipeVolumes: %v", err)
+			continue
+		}
+		if err := conn.AddTagLV(ctx, ns.vgName, lv.GetName(), []string{wipedTag}); err != nil {
+			glog.Errorf("wipeVolumes: failed to tag %s/%s as wiped: %v", ns.vgName, lv.GetName(), err)
+			continue
+		}
+		glog.Infof("Wiped %s", devicePath)
+	}
+}
+
+// wipeRequestTags returns the tags of tags asking the node to wipe the LV.
+func wipeRequestTags(tags []string) []string {
+	var requests []string
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, wipeTagPrefix) {
+			requests = append(requests, tag)
+		}
+	}
+	return requests
+}
+
+func wipeDevice(devicePath, policy string) error {
+	var cmd *exec.Cmd
+	switch policy {
+	case wipePolicyDiscard:
+		cmd = exec.Command("blkdiscard", devicePath)
+	case wipePolicyZero:
+		cmd = exec.Command("shred", "-n", "0", "-z", devicePath)
+	case wipePolicyFull:
+		cmd = exec.Command("shred", "-n", "1", "-z", devicePath)
+	default:
+		return fmt.Errorf("unknown wipe policy %q", policy)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New("csi-lvm: wipeDevice: " + string(output))
+	}
+	return nil
+}
+
+func validCreateWipePolicy(policy string) bool {
+	switch policy {
+	case "", createWipePolicyNone, createWipePolicySignatures, createWipePolicyHeader, createWipePolicyFull:
+		return true
+	}
+	return false
+}
+
+// createWipeTags returns the tags of a new LV requesting the wipe of
+// policy before its first use.
+func createWipeTags(policy string) []string {
+	if policy == "" {
+		policy = createWipePolicySignatures
+	}
+	if policy == createWipePolicyNone {
+		return nil
+	}
+	return []string{createWipeTagPrefix + policy}
+}
+
+// wipeNewVolume wipes a new LV according to the policy it was tagged with
+// on creation, then tags it as wiped so that it is never wiped again. LVs
+// created without the tag, including all LVs which existed before, are
+// left alone.
+func (ns *nodeServer) wipeNewVolume(ctx context.Context, vgName string, lv *lvmdproto.LogicalVolume) error {
+	policy := getTagValue(lv.GetTags(), createWipeTagPrefix)
+	if policy == "" || hasTag(lv.GetTags(), createWipedTag) {
+		return nil
+	}
+	if lv.GetAttributes().GetOpen() {
+		return fmt.Errorf("volume %s/%s is open before its first use", vgName, lv.GetName())
+	}
+	devicePath := filepath.Join("/dev/", vgName, lv.GetName())
+	glog.Infof("Wiping new volume %s with policy %s", devicePath, policy)
+	if err := wipeNewDevice(devicePath, policy); err != nil {
+		return err
+	}
+	return ns.addVolumeTag(ctx, vgName, lv.GetName(), createWipedTag)
+}
+
+func wipeNewDevice(devicePath, policy string) error {
+	var cmds []*exec.Cmd
+	switch policy {
+	case createWipePolicySignatures:
+		cmds = append(cmds, exec.Command("wipefs", "-a", devicePath))
+	case createWipePolicyHeader:
+		cmds = append(cmds, exec.Command("wipefs", "-a", devicePath),
+			exec.Command("dd", "if=/dev/zero", "of="+devicePath, "bs=1M", "count=1", "oflag=direct", "conv=fsync"))
+	case createWipePolicyFull:
+		cmds = append(cmds, exec.Command("shred", "-n", "0", "-z", devicePath))
+	default:
+		return fmt.Errorf("unknown %s %q", createWipePolicyKey, policy)
+	}
+	for _, cmd := range cmds {
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.New("csi-lvm: wipeNewDevice: " + string(output))
+		}
+	}
+	return nil
+}
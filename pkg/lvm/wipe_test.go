@@ -0,0 +1,39 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWipeRequestTags(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{"csi-lvm.protected", "csi-lvm.create-wipe=signatures"}, nil},
+		{[]string{"csi-lvm.wipe=zero", "csi-lvm.protected"}, []string{"csi-lvm.wipe=zero"}},
+		{[]string{"csi-lvm.wipe=zero", "csi-lvm.wiped", "csi-lvm.wipe=full"}, []string{"csi-lvm.wipe=zero", "csi-lvm.wipe=full"}},
+	}
+	for _, test := range tests {
+		if requests := wipeRequestTags(test.tags); !reflect.DeepEqual(requests, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.tags, test.expected, requests)
+		}
+	}
+}
@@ -14,10 +14,29 @@ import (
 	"google.golang.org/grpc/connectivity"
 )
 
+// ProtectedTag marks LVs protected from deletion, RemoveLV refuses to
+// remove them.
+const ProtectedTag = "csi-lvm.protected"
+
+// ProtectedError is returned by RemoveLV for LVs carrying ProtectedTag.
+type ProtectedError struct {
+	VolumeGroup string
+	Name        string
+}
+
+func (e *ProtectedError) Error() string {
+	return fmt.Sprintf("volume %s/%s is protected from deletion", e.VolumeGroup, e.Name)
+}
+
 type LVMConnection interface {
 	GetLV(ctx context.Context, volGroup string, volumeId string) (string, error)
+	ListLV(ctx context.Context, listspec string) ([]*lvmd.LogicalVolume, error)
 	CreateLV(ctx context.Context, opt *LVMOptions) (string, error)
 	RemoveLV(ctx context.Context, volGroup string, volumeId string) error
+	AddTagLV(ctx context.Context, volGroup string, volumeId string, tags []string) error
+	RemoveTagLV(ctx context.Context, volGroup string, volumeId string, tags []string) error
+	ListVG(ctx context.Context) ([]*lvmd.VolumeGroup, error)
+	CreateVG(ctx context.Context, name string, physicalVolume string, tags []string) error
 
 	Close() error
 }
@@ -81,9 +100,16 @@ type LVMOptions struct {
 	Name        string
 	Size        uint64
 	Tags        []string
+	// PVs restricts the allocation of the LV to these physical volumes,
+	// given as devices or @tag. lvmd cannot do this, so CreateLV refuses
+	// options with PVs and lvcreate has to be run on the node instead.
+	PVs []string
 }
 
 func (c *lvmConnection) CreateLV(ctx context.Context, opt *LVMOptions) (string, error) {
+	if len(opt.PVs) > 0 {
+		return "", fmt.Errorf("lvmd cannot allocate %s/%s from physical volumes %v", opt.VolumeGroup, opt.Name, opt.PVs)
+	}
 	client := lvmd.NewLVMClient(c.conn)
 
 	req := lvmd.CreateLVRequest{
@@ -118,9 +144,35 @@ func (c *lvmConnection) GetLV(ctx context.Context, volGroup string, volumeId str
 	return rsp.GetVolumes()[0].String(), nil
 }
 
+func (c *lvmConnection) ListLV(ctx context.Context, listspec string) ([]*lvmd.LogicalVolume, error) {
+	client := lvmd.NewLVMClient(c.conn)
+
+	req := lvmd.ListLVRequest{
+		VolumeGroup: listspec,
+	}
+
+	rsp, err := client.ListLV(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.GetVolumes(), nil
+}
+
 func (c *lvmConnection) RemoveLV(ctx context.Context, volGroup string, volumeId string) error {
 	client := lvmd.NewLVMClient(c.conn)
 
+	lvs, err := c.ListLV(ctx, fmt.Sprintf("%s/%s", volGroup, volumeId))
+	if err != nil {
+		return err
+	}
+	for _, lv := range lvs {
+		for _, tag := range lv.GetTags() {
+			if tag == ProtectedTag {
+				return &ProtectedError{VolumeGroup: volGroup, Name: volumeId}
+			}
+		}
+	}
+
 	req := lvmd.RemoveLVRequest{
 		VolumeGroup: volGroup,
 		Name:        volumeId,
@@ -131,6 +183,58 @@ func (c *lvmConnection) RemoveLV(ctx context.Context, volGroup string, volumeId
 	return err
 }
 
+func (c *lvmConnection) AddTagLV(ctx context.Context, volGroup string, volumeId string, tags []string) error {
+	client := lvmd.NewLVMClient(c.conn)
+
+	req := lvmd.AddTagLVRequest{
+		VolumeGroup: volGroup,
+		Name:        volumeId,
+		Tags:        tags,
+	}
+
+	rsp, err := client.AddTagLV(ctx, &req)
+	glog.V(5).Infof("addTagLV output: %v", rsp.GetCommandOutput())
+	return err
+}
+
+func (c *lvmConnection) RemoveTagLV(ctx context.Context, volGroup string, volumeId string, tags []string) error {
+	client := lvmd.NewLVMClient(c.conn)
+
+	req := lvmd.RemoveTagLVRequest{
+		VolumeGroup: volGroup,
+		Name:        volumeId,
+		Tags:        tags,
+	}
+
+	rsp, err := client.RemoveTagLV(ctx, &req)
+	glog.V(5).Infof("removeTagLV output: %v", rsp.GetCommandOutput())
+	return err
+}
+
+func (c *lvmConnection) ListVG(ctx context.Context) ([]*lvmd.VolumeGroup, error) {
+	client := lvmd.NewLVMClient(c.conn)
+
+	rsp, err := client.ListVG(ctx, &lvmd.ListVGRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return rsp.GetVolumeGroups(), nil
+}
+
+func (c *lvmConnection) CreateVG(ctx context.Context, name string, physicalVolume string, tags []string) error {
+	client := lvmd.NewLVMClient(c.conn)
+
+	req := lvmd.CreateVGRequest{
+		Name:           name,
+		PhysicalVolume: physicalVolume,
+		Tags:           tags,
+	}
+
+	rsp, err := client.CreateVG(ctx, &req)
+	glog.V(5).Infof("createVG output: %v", rsp.GetCommandOutput())
+	return err
+}
+
 func logGRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 	glog.V(5).Infof("GRPC call: %s", method)
 	glog.V(5).Infof("GRPC request: %+v", req)